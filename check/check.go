@@ -1,6 +1,45 @@
 package check
 
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pivotal-cf/email-resource/inbound"
+)
+
+//Source - configuration of the mailbox that is polled for new messages
+type Source inbound.Source
+
 //Execute - provides check capability
-func Execute() (string, error) {
-	return "[]", nil
+func Execute(input []byte) (string, error) {
+	var indata struct {
+		Source  Source          `json:"source"`
+		Version inbound.Version `json:"version"`
+	}
+
+	err := json.Unmarshal(input, &indata)
+	if err != nil {
+		return "", err
+	}
+
+	mailbox, err := inbound.Source(indata.Source).Mailbox()
+	if err != nil {
+		return "", fmt.Errorf("Invalid configuration: %s", err)
+	}
+
+	versions := []inbound.Version{}
+	if mailbox != nil {
+		versions, err = mailbox.Check(indata.Version)
+		if err != nil {
+			return "", err
+		}
+	} else if indata.Version != nil && indata.Version["dry_run"] != "true" {
+		// without a mailbox versions are only produced by out, so the
+		// latest known version is reported back unchanged, unless it is
+		// from a dry run and nothing was sent
+		versions = append(versions, indata.Version)
+	}
+
+	outbytes, err := json.Marshal(versions)
+	return string(outbytes), err
 }
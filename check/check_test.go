@@ -1,10 +1,13 @@
 package check_test
 
 import (
+	"encoding/json"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/onsi/gomega/gexec"
 	"github.com/pivotal-cf/email-resource/check"
+	"github.com/pivotal-cf/email-resource/inbound/fakes"
 )
 
 var _ = Describe("Check", func() {
@@ -18,8 +21,127 @@ var _ = Describe("Check", func() {
 	})
 
 	It("should output an empty JSON list", func() {
-		output, err := check.Execute()
+		output, err := check.Execute([]byte(`{"source": {}}`))
 		Expect(err).ShouldNot(HaveOccurred())
 		Expect(output).Should(MatchJSON("[]"))
 	})
+
+	Context("when a version is given on input", func() {
+		It("should output the version that it was given", func() {
+			output, err := check.Execute([]byte(`{"source": {}, "version": {"Time": "2020-01-01T00:00:00Z", "message_id": "<1@example.com>"}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(output).Should(MatchJSON(`[{"Time": "2020-01-01T00:00:00Z", "message_id": "<1@example.com>"}]`))
+		})
+
+		It("should not output a version from a dry run", func() {
+			output, err := check.Execute([]byte(`{"source": {}, "version": {"Time": "2020-01-01T00:00:00Z", "message_id": "<1@example.com>", "dry_run": "true"}}`))
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(output).Should(MatchJSON("[]"))
+		})
+	})
+
+	Context("when an IMAP mailbox is configured", func() {
+		var imapServer *fakes.FakeIMAPServer
+		var source map[string]interface{}
+
+		BeforeEach(func() {
+			imapServer = fakes.NewFakeIMAPServer()
+			imapServer.Deliver("INBOX", nil, "From: ci@example.com\r\nSubject: deploy\r\n\r\ngo\r\n")
+			imapServer.Deliver("INBOX", nil, "From: ci@example.com\r\nSubject: deploy again\r\n\r\ngo\r\n")
+			imapServer.Boot()
+
+			source = map[string]interface{}{
+				"imap": map[string]interface{}{
+					"host":     imapServer.Host,
+					"port":     imapServer.Port,
+					"username": "username",
+					"password": "password",
+					"tls_mode": "none",
+				},
+			}
+		})
+
+		AfterEach(func() {
+			imapServer.Close()
+		})
+
+		It("should output the new messages as versions", func() {
+			input, err := json.Marshal(map[string]interface{}{
+				"source":  source,
+				"version": map[string]string{"uid": "1", "uid_validity": "1"},
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			output, err := check.Execute(input)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(output).Should(MatchJSON(`[{"uid": "1", "uid_validity": "1"}, {"uid": "2", "uid_validity": "1"}]`))
+		})
+
+		It("should return an error when the configuration is incomplete", func() {
+			delete(source["imap"].(map[string]interface{}), "password")
+			input, err := json.Marshal(map[string]interface{}{"source": source})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			output, err := check.Execute(input)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(Equal(`Invalid configuration: missing required field "source.imap.password"`))
+			Expect(output).To(BeEmpty())
+		})
+	})
+
+	Context("when a POP3 mailbox is configured", func() {
+		var pop3Server *fakes.FakePOP3Server
+		var source map[string]interface{}
+
+		BeforeEach(func() {
+			pop3Server = fakes.NewFakePOP3Server()
+			pop3Server.Deliver("From: ci@example.com\r\nSubject: deploy\r\n\r\ngo\r\n")
+			pop3Server.Deliver("From: ci@example.com\r\nSubject: deploy again\r\n\r\ngo\r\n")
+			pop3Server.Boot()
+
+			source = map[string]interface{}{
+				"pop3": map[string]interface{}{
+					"host":     pop3Server.Host,
+					"port":     pop3Server.Port,
+					"username": "username",
+					"password": "password",
+					"tls_mode": "none",
+				},
+			}
+		})
+
+		AfterEach(func() {
+			pop3Server.Close()
+		})
+
+		It("should output the new messages as versions", func() {
+			input, err := json.Marshal(map[string]interface{}{
+				"source":  source,
+				"version": map[string]string{"uidl": "uidl-1"},
+			})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			output, err := check.Execute(input)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(output).Should(MatchJSON(`[{"uidl": "uidl-1"}, {"uidl": "uidl-2"}]`))
+		})
+
+		It("should return an error when an IMAP mailbox is configured as well", func() {
+			source["imap"] = map[string]interface{}{"host": "imap.example.com"}
+			input, err := json.Marshal(map[string]interface{}{"source": source})
+			Expect(err).ShouldNot(HaveOccurred())
+
+			_, err = check.Execute(input)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(Equal(`Invalid configuration: only one of "source.imap" and "source.pop3" may be specified`))
+		})
+	})
+
+	Context("when bad json given on input", func() {
+		It("should return an error", func() {
+			output, err := check.Execute([]byte(``))
+			Expect(err).Should(HaveOccurred())
+			Expect(output).To(BeEmpty())
+		})
+	})
 })
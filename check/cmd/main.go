@@ -2,14 +2,22 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/pivotal-cf/email-resource/check"
 )
 
 func main() {
-	output, err := check.Execute()
+	indata, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	output, err := check.Execute(indata)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
 	}
 	fmt.Println(output)
 }
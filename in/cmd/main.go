@@ -9,12 +9,16 @@ import (
 )
 
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "expected path to destination directory as first argument")
+		os.Exit(1)
+	}
 	indata, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
-	output, err := in.Execute(indata)
+	output, err := in.Execute(os.Args[1], indata)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
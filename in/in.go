@@ -1,23 +1,141 @@
 package in
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pivotal-cf/email-resource/inbound"
 )
 
+//Source - configuration of the mailbox messages are read from
+type Source inbound.Source
+
+//MetadataItem - metadata within output
+type MetadataItem struct {
+	Name  string
+	Value string
+}
+
 //Execute - provides in capability
-func Execute(input []byte) (string, error) {
-	var outdata struct {
-		Version interface{} `json:"version"`
+func Execute(destination string, input []byte) (string, error) {
+	if destination == "" {
+		return "", errors.New("expected path to destination directory as first argument")
 	}
 
-	err := json.Unmarshal(input, &outdata)
+	var indata struct {
+		Source  Source            `json:"source"`
+		Version map[string]string `json:"version"`
+	}
+
+	err := json.Unmarshal(input, &indata)
 	if err != nil {
 		return "", err
 	}
-	if outdata.Version == nil {
+	if indata.Version == nil {
 		return "", errors.New("missing version")
 	}
+
+	var outdata struct {
+		Version  map[string]string `json:"version"`
+		Metadata []MetadataItem    `json:"metadata,omitempty"`
+	}
+	outdata.Version = indata.Version
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return "", err
+	}
+
+	var raw []byte
+	if indata.Version["message"] != "" {
+		raw, err = decodeMessage(indata.Version["message"])
+		if err != nil {
+			return "", err
+		}
+	} else if indata.Version["uid"] != "" || indata.Version["uidl"] != "" {
+		mailbox, err := inbound.Source(indata.Source).Mailbox()
+		if err != nil {
+			return "", fmt.Errorf("Invalid configuration: %s", err)
+		}
+		if mailbox == nil {
+			return "", errors.New(`Invalid configuration: one of "source.imap" or "source.pop3" is required to fetch a received message`)
+		}
+		raw, err = mailbox.Fetch(inbound.Version(indata.Version))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if messageID := indata.Version["message_id"]; messageID != "" {
+		if err := ioutil.WriteFile(filepath.Join(destination, "message_id"), []byte(messageID), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	// a dry run rendered the message without sending it
+	if indata.Version["dry_run"] == "true" {
+		if err := ioutil.WriteFile(filepath.Join(destination, "dry_run"), []byte("true"), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	metadata := map[string]string{}
+	if raw != nil {
+		metadata, err = writeMessage(destination, raw)
+		if err != nil {
+			return "", err
+		}
+	}
+	if indata.Version["message_id"] != "" {
+		metadata["message_id"] = indata.Version["message_id"]
+	}
+	metadata["time"] = indata.Version["Time"]
+	metadata["uid"] = indata.Version["uid"]
+	metadata["uidl"] = indata.Version["uidl"]
+	metadata["dry_run"] = indata.Version["dry_run"]
+	for name, value := range metadata {
+		if value == "" {
+			delete(metadata, name)
+		}
+	}
+
+	metadataBytes, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(destination, "metadata.json"), metadataBytes, 0644); err != nil {
+		return "", err
+	}
+	for _, name := range []string{"message_id", "uid", "uidl", "time", "from", "to", "cc", "subject", "date", "dry_run"} {
+		if value, ok := metadata[name]; ok {
+			outdata.Metadata = append(outdata.Metadata, MetadataItem{Name: name, Value: value})
+		}
+	}
+
 	outbytes, err := json.Marshal(outdata)
 	return string(outbytes), err
 }
+
+// decodeMessage reverses the gzip and base64 encoding applied by out.
+func decodeMessage(encoded string) ([]byte, error) {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode message: %s", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress message: %s", err)
+	}
+	defer zr.Close()
+	msg, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress message: %s", err)
+	}
+	return msg, nil
+}
@@ -1,15 +1,33 @@
 package in_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	. "github.com/onsi/gomega/gexec"
 	"github.com/pivotal-cf/email-resource/in"
+	"github.com/pivotal-cf/email-resource/inbound/fakes"
 )
 
 var _ = Describe("In", func() {
+	var destination string
+
+	BeforeEach(func() {
+		var err error
+		destination, err = ioutil.TempDir("", "destination")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
 	AfterEach(func() {
 		CleanupBuildArtifacts()
+		os.RemoveAll(destination)
 	})
 
 	It("should compile", func() {
@@ -28,15 +46,322 @@ var _ = Describe("In", func() {
 	  "version": { "ref": "61cebf" }
 	}
 				`
-			output, err := in.Execute([]byte(inputData))
+			output, err := in.Execute(destination, []byte(inputData))
 			Ω(err).ShouldNot(HaveOccurred())
 			Expect(output).To(MatchJSON(`{"version": { "ref": "61cebf" }}`))
 		})
 	})
 
+	Context("when the version contains a sent message", func() {
+		var message string
+		var version map[string]string
+
+		BeforeEach(func() {
+			message = "From: sender@example.com\r\n" +
+				"Subject: =?UTF-8?q?some_subject_=E2=9C=93?=\r\n" +
+				"To: recipient@example.com\r\n" +
+				"Message-ID: <1234@example.com>\r\n" +
+				"\r\n" +
+				"some body\r\n"
+
+			var compressed bytes.Buffer
+			zw := gzip.NewWriter(&compressed)
+			zw.Write([]byte(message))
+			Expect(zw.Close()).To(Succeed())
+
+			version = map[string]string{
+				"Time":       "2020-01-01T00:00:00Z",
+				"message_id": "<1234@example.com>",
+				"message":    base64.StdEncoding.EncodeToString(compressed.Bytes()),
+			}
+		})
+
+		execute := func() string {
+			inputBytes, err := json.Marshal(map[string]interface{}{"source": map[string]string{}, "version": version})
+			Expect(err).NotTo(HaveOccurred())
+			output, err := in.Execute(destination, inputBytes)
+			Expect(err).ShouldNot(HaveOccurred())
+			return output
+		}
+
+		It("writes the message to the destination", func() {
+			execute()
+			contents, err := ioutil.ReadFile(filepath.Join(destination, "message.eml"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(message))
+
+			contents, err = ioutil.ReadFile(filepath.Join(destination, "message_id"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("<1234@example.com>"))
+		})
+
+		It("writes the message metadata to the destination", func() {
+			execute()
+			contents, err := ioutil.ReadFile(filepath.Join(destination, "metadata.json"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var metadata map[string]string
+			Expect(json.Unmarshal(contents, &metadata)).To(Succeed())
+			Expect(metadata).To(HaveKeyWithValue("subject", "some subject ✓"))
+			Expect(metadata).To(HaveKeyWithValue("from", "sender@example.com"))
+			Expect(metadata).To(HaveKeyWithValue("to", "recipient@example.com"))
+			Expect(metadata).To(HaveKeyWithValue("time", "2020-01-01T00:00:00Z"))
+		})
+
+		It("reports the message metadata", func() {
+			output := execute()
+			var outdata struct {
+				Version  map[string]string `json:"version"`
+				Metadata []in.MetadataItem `json:"metadata"`
+			}
+			Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+			Expect(outdata.Version).To(Equal(version))
+			Expect(outdata.Metadata).To(ContainElement(in.MetadataItem{Name: "subject", Value: "some subject ✓"}))
+			Expect(outdata.Metadata).To(ContainElement(in.MetadataItem{Name: "message_id", Value: "<1234@example.com>"}))
+		})
+
+		It("does not write the dry run marker for a sent message", func() {
+			execute()
+			Expect(filepath.Join(destination, "dry_run")).NotTo(BeAnExistingFile())
+		})
+
+		Context("when the message was rendered by a dry run", func() {
+			BeforeEach(func() {
+				version["dry_run"] = "true"
+			})
+
+			It("marks the message as not sent", func() {
+				output := execute()
+				contents, err := ioutil.ReadFile(filepath.Join(destination, "dry_run"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(contents)).To(Equal("true"))
+
+				contents, err = ioutil.ReadFile(filepath.Join(destination, "metadata.json"))
+				Expect(err).NotTo(HaveOccurred())
+				var metadata map[string]string
+				Expect(json.Unmarshal(contents, &metadata)).To(Succeed())
+				Expect(metadata).To(HaveKeyWithValue("dry_run", "true"))
+
+				var outdata struct {
+					Metadata []in.MetadataItem `json:"metadata"`
+				}
+				Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+				Expect(outdata.Metadata).To(ContainElement(in.MetadataItem{Name: "dry_run", Value: "true"}))
+			})
+		})
+
+		Context("when the message was not recorded in the version", func() {
+			BeforeEach(func() {
+				delete(version, "message")
+			})
+
+			It("only writes the message id and the metadata of the version", func() {
+				output := execute()
+				files, err := ioutil.ReadDir(destination)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(files).To(HaveLen(2))
+				Expect(files[0].Name()).To(Equal("message_id"))
+				Expect(files[1].Name()).To(Equal("metadata.json"))
+
+				contents, err := ioutil.ReadFile(filepath.Join(destination, "metadata.json"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(contents).To(MatchJSON(`{"message_id":"<1234@example.com>","time":"2020-01-01T00:00:00Z"}`))
+				Expect(output).To(MatchJSON(`{
+					"version":{"Time":"2020-01-01T00:00:00Z","message_id":"<1234@example.com>"},
+					"metadata":[{"Name":"message_id","Value":"<1234@example.com>"},{"Name":"time","Value":"2020-01-01T00:00:00Z"}]
+				}`))
+			})
+
+			Context("and the message was rendered by a dry run", func() {
+				BeforeEach(func() {
+					version["dry_run"] = "true"
+				})
+
+				It("marks the message as not sent", func() {
+					execute()
+					contents, err := ioutil.ReadFile(filepath.Join(destination, "dry_run"))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(contents)).To(Equal("true"))
+
+					contents, err = ioutil.ReadFile(filepath.Join(destination, "metadata.json"))
+					Expect(err).NotTo(HaveOccurred())
+					var metadata map[string]string
+					Expect(json.Unmarshal(contents, &metadata)).To(Succeed())
+					Expect(metadata).To(HaveKeyWithValue("dry_run", "true"))
+				})
+			})
+		})
+
+		Context("when the message is not valid", func() {
+			BeforeEach(func() {
+				version["message"] = "not base64!"
+			})
+
+			It("should return an error", func() {
+				inputBytes, err := json.Marshal(map[string]interface{}{"version": version})
+				Expect(err).NotTo(HaveOccurred())
+				_, err = in.Execute(destination, inputBytes)
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(ContainSubstring("unable to decode message"))
+			})
+		})
+	})
+
+	Context("when the version identifies a message in an IMAP mailbox", func() {
+		var imapServer *fakes.FakeIMAPServer
+		var input []byte
+
+		BeforeEach(func() {
+			imapServer = fakes.NewFakeIMAPServer()
+			imapServer.Deliver("INBOX", nil, "From: =?UTF-8?q?J=C3=BCrgen?= <ci@example.com>\r\n"+
+				"To: build@example.com\r\n"+
+				"Subject: Release notes\r\n"+
+				"Message-ID: <release@example.com>\r\n"+
+				"MIME-Version: 1.0\r\n"+
+				"Content-Type: multipart/mixed; boundary=\"mixed\"\r\n"+
+				"\r\n"+
+				"--mixed\r\n"+
+				"Content-Type: multipart/alternative; boundary=\"alt\"\r\n"+
+				"\r\n"+
+				"--alt\r\n"+
+				"Content-Type: text/plain; charset=ISO-8859-1\r\n"+
+				"Content-Transfer-Encoding: quoted-printable\r\n"+
+				"\r\n"+
+				"Gr=FC=DFe\r\n"+
+				"--alt\r\n"+
+				"Content-Type: text/html; charset=UTF-8\r\n"+
+				"\r\n"+
+				"<p>Hello</p>\r\n"+
+				"--alt--\r\n"+
+				"--mixed\r\n"+
+				"Content-Type: application/octet-stream; name=\"notes.txt\"\r\n"+
+				"Content-Disposition: attachment; filename=\"../notes.txt\"\r\n"+
+				"Content-Transfer-Encoding: base64\r\n"+
+				"\r\n"+
+				"c29tZSBu\r\nb3Rlcw==\r\n"+
+				"--mixed--\r\n")
+			imapServer.Boot()
+
+			var err error
+			input, err = json.Marshal(map[string]interface{}{
+				"source": map[string]interface{}{
+					"imap": map[string]interface{}{
+						"host":     imapServer.Host,
+						"port":     imapServer.Port,
+						"username": "username",
+						"password": "password",
+						"tls_mode": "none",
+					},
+				},
+				"version": map[string]string{"uid": "1", "uid_validity": "1"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			imapServer.Close()
+		})
+
+		readFile := func(name string) string {
+			contents, err := ioutil.ReadFile(filepath.Join(destination, name))
+			Expect(err).NotTo(HaveOccurred())
+			return string(contents)
+		}
+
+		It("writes the message and its parts to the destination", func() {
+			_, err := in.Execute(destination, input)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			Expect(readFile("message.eml")).To(ContainSubstring("Subject: Release notes"))
+			Expect(readFile("subject")).To(Equal("Release notes"))
+			Expect(readFile("from")).To(Equal("Jürgen <ci@example.com>"))
+			Expect(readFile("body.txt")).To(Equal("Grüße"))
+			Expect(readFile("body.html")).To(Equal("<p>Hello</p>"))
+			Expect(readFile("attachments/notes.txt")).To(Equal("some notes"))
+		})
+
+		It("reports the message metadata", func() {
+			output, err := in.Execute(destination, input)
+			Expect(err).ShouldNot(HaveOccurred())
+
+			var outdata struct {
+				Metadata []in.MetadataItem `json:"metadata"`
+			}
+			Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+			Expect(outdata.Metadata).To(ContainElement(in.MetadataItem{Name: "uid", Value: "1"}))
+			Expect(outdata.Metadata).To(ContainElement(in.MetadataItem{Name: "message_id", Value: "<release@example.com>"}))
+			Expect(outdata.Metadata).To(ContainElement(in.MetadataItem{Name: "subject", Value: "Release notes"}))
+		})
+	})
+
+	Context("when the version identifies a message in a POP3 mailbox", func() {
+		var pop3Server *fakes.FakePOP3Server
+		var pop3Source map[string]interface{}
+
+		BeforeEach(func() {
+			pop3Server = fakes.NewFakePOP3Server()
+			pop3Server.Deliver("From: ci@example.com\r\nTo: build@example.com\r\nSubject: deploy\r\n\r\ngo\r\n")
+			pop3Server.Boot()
+
+			pop3Source = map[string]interface{}{
+				"host":     pop3Server.Host,
+				"port":     pop3Server.Port,
+				"username": "username",
+				"password": "password",
+				"tls_mode": "none",
+			}
+		})
+
+		AfterEach(func() {
+			pop3Server.Close()
+		})
+
+		execute := func() (string, error) {
+			input, err := json.Marshal(map[string]interface{}{
+				"source":  map[string]interface{}{"pop3": pop3Source},
+				"version": map[string]string{"uidl": "uidl-1"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return in.Execute(destination, input)
+		}
+
+		It("writes the message to the destination and reports its metadata", func() {
+			output, err := execute()
+			Expect(err).ShouldNot(HaveOccurred())
+
+			contents, err := ioutil.ReadFile(filepath.Join(destination, "body.txt"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("go\r\n"))
+
+			var outdata struct {
+				Metadata []in.MetadataItem `json:"metadata"`
+			}
+			Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+			Expect(outdata.Metadata).To(ContainElement(in.MetadataItem{Name: "uidl", Value: "uidl-1"}))
+			Expect(outdata.Metadata).To(ContainElement(in.MetadataItem{Name: "subject", Value: "deploy"}))
+			Expect(pop3Server.UIDLs()).To(Equal([]string{"uidl-1"}))
+		})
+
+		It("deletes the message when delete_after_fetch is enabled", func() {
+			pop3Source["delete_after_fetch"] = true
+			_, err := execute()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(pop3Server.UIDLs()).To(BeEmpty())
+		})
+	})
+
+	Context("when the version identifies a received message but no mailbox is configured", func() {
+		It("should return an error", func() {
+			input := []byte(`{"source": {}, "version": {"uidl": "uidl-1"}}`)
+			_, err := in.Execute(destination, input)
+			Expect(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring(`one of "source.imap" or "source.pop3" is required`))
+		})
+	})
+
 	Context("when the version is not given on input", func() {
 		It("should return an error", func() {
-			output, err := in.Execute([]byte(`{ "missing" : "the version" }`))
+			output, err := in.Execute(destination, []byte(`{ "missing" : "the version" }`))
 			Ω(err).Should(HaveOccurred())
 			Expect(err.Error()).Should(Equal("missing version"))
 			Expect(output).To(BeEmpty())
@@ -45,11 +370,20 @@ var _ = Describe("In", func() {
 
 	Context("when bad json given on input", func() {
 		It("should return an error", func() {
-			output, err := in.Execute([]byte(``))
+			output, err := in.Execute(destination, []byte(``))
 			Ω(err).Should(HaveOccurred())
 			Expect(err.Error()).Should(Equal("unexpected end of JSON input"))
 			Expect(output).To(BeEmpty())
 		})
 	})
 
+	Context("when a destination is not provided as the first command-line argument", func() {
+		It("should return an error", func() {
+			output, err := in.Execute("", []byte(`{"version": {"ref": "61cebf"}}`))
+			Ω(err).Should(HaveOccurred())
+			Expect(err.Error()).Should(Equal("expected path to destination directory as first argument"))
+			Expect(output).To(BeEmpty())
+		})
+	})
+
 })
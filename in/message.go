@@ -0,0 +1,195 @@
+package in
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}
+
+type attachment struct {
+	name    string
+	content []byte
+}
+
+// messageParts collects the first plain text and HTML bodies and every
+// attachment found while walking a MIME tree.
+type messageParts struct {
+	text, html  []byte
+	attachments []attachment
+}
+
+// writeMessage writes the raw message and its extracted parts into
+// destination and returns the message metadata.
+func writeMessage(destination string, raw []byte) (map[string]string, error) {
+	if err := ioutil.WriteFile(filepath.Join(destination, "message.eml"), raw, 0644); err != nil {
+		return nil, err
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse message: %s", err)
+	}
+
+	metadata := map[string]string{
+		"message_id": parsed.Header.Get("Message-ID"),
+		"from":       decodeHeader(parsed.Header.Get("From")),
+		"to":         decodeHeader(parsed.Header.Get("To")),
+		"cc":         decodeHeader(parsed.Header.Get("Cc")),
+		"subject":    decodeHeader(parsed.Header.Get("Subject")),
+		"date":       parsed.Header.Get("Date"),
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(destination, "subject"), []byte(metadata["subject"]), 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(destination, "from"), []byte(metadata["from"]), 0644); err != nil {
+		return nil, err
+	}
+
+	parts := &messageParts{}
+	if err := parts.walk(textproto.MIMEHeader(parsed.Header), parsed.Body); err != nil {
+		return nil, fmt.Errorf("unable to parse message body: %s", err)
+	}
+
+	if parts.text != nil {
+		if err := ioutil.WriteFile(filepath.Join(destination, "body.txt"), parts.text, 0644); err != nil {
+			return nil, err
+		}
+	}
+	if parts.html != nil {
+		if err := ioutil.WriteFile(filepath.Join(destination, "body.html"), parts.html, 0644); err != nil {
+			return nil, err
+		}
+	}
+	if len(parts.attachments) > 0 {
+		attachmentsDir := filepath.Join(destination, "attachments")
+		if err := os.MkdirAll(attachmentsDir, 0755); err != nil {
+			return nil, err
+		}
+		for _, a := range parts.attachments {
+			if err := ioutil.WriteFile(filepath.Join(attachmentsDir, a.name), a.content, 0644); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return metadata, nil
+}
+
+func (p *messageParts) walk(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := p.walk(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	content, err := ioutil.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	isBody := disposition != "attachment" && filename == ""
+	switch {
+	case isBody && mediaType == "text/plain" && p.text == nil:
+		p.text, err = decodeCharset(params["charset"], content)
+		return err
+	case isBody && mediaType == "text/html" && p.html == nil:
+		p.html, err = decodeCharset(params["charset"], content)
+		return err
+	}
+
+	p.attachments = append(p.attachments, attachment{
+		name:    p.attachmentName(decodeHeader(filename)),
+		content: content,
+	})
+	return nil
+}
+
+// attachmentName returns a file name that is safe to write into the
+// attachments directory and does not collide with earlier attachments.
+func (p *messageParts) attachmentName(filename string) string {
+	name := filepath.Base(filepath.Clean("/" + filename))
+	if name == "/" || name == "." {
+		name = fmt.Sprintf("attachment-%d", len(p.attachments)+1)
+	}
+
+	candidate := name
+	for i := 2; p.hasAttachment(candidate); i++ {
+		candidate = fmt.Sprintf("%d-%s", i, name)
+	}
+	return candidate
+}
+
+func (p *messageParts) hasAttachment(name string) bool {
+	for _, a := range p.attachments {
+		if a.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+func decodeCharset(label string, content []byte) ([]byte, error) {
+	if label == "" || strings.EqualFold(label, "utf-8") || strings.EqualFold(label, "us-ascii") {
+		return content, nil
+	}
+	r, err := charset.NewReaderLabel(label, bytes.NewReader(content))
+	if err != nil {
+		// unknown charsets are written out unchanged
+		return content, nil
+	}
+	return ioutil.ReadAll(r)
+}
+
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
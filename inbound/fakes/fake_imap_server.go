@@ -0,0 +1,97 @@
+package fakes
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+)
+
+// FakeIMAPServer is an in-process IMAP server backed by memory, accepting the
+// credentials "username" / "password".
+type FakeIMAPServer struct {
+	listener net.Listener
+	server   *server.Server
+	user     backend.User
+	tls      *tls.Config
+	Host     string
+	Port     string
+}
+
+func NewFakeIMAPServer() *FakeIMAPServer {
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	if err != nil {
+		panic(err)
+	}
+
+	// start from an empty INBOX rather than the backend's sample message
+	inbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		panic(err)
+	}
+	inbox.(*memory.Mailbox).Messages = nil
+
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	return &FakeIMAPServer{server: s, user: user}
+}
+
+// NewFakeIMAPServerWithImplicitTLS returns a server that only accepts TLS
+// connections, using the given certificate and key files.
+func NewFakeIMAPServerWithImplicitTLS(crt string, key string) *FakeIMAPServer {
+	cert, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		panic(err)
+	}
+	s := NewFakeIMAPServer()
+	s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return s
+}
+
+// Deliver appends a raw message to folder, creating the folder if needed.
+func (s *FakeIMAPServer) Deliver(folder string, flags []string, message string) {
+	mailbox, err := s.user.GetMailbox(folder)
+	if err != nil {
+		if err := s.user.CreateMailbox(folder); err != nil {
+			panic(err)
+		}
+		mailbox, err = s.user.GetMailbox(folder)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := mailbox.CreateMessage(flags, time.Now(), bytes.NewBufferString(message)); err != nil {
+		panic(err)
+	}
+}
+
+func (s *FakeIMAPServer) Boot() {
+	var err error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s.Host, s.Port, err = net.SplitHostPort(s.listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	listener := s.listener
+	if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls)
+	}
+	go s.server.Serve(listener)
+}
+
+func (s *FakeIMAPServer) Close() {
+	s.server.Close()
+}
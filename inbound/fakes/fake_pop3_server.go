@@ -0,0 +1,216 @@
+package fakes
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FakePOP3Server is an in-process POP3 server accepting the credentials
+// "username" / "password". STLS is offered when a certificate is configured.
+type FakePOP3Server struct {
+	listener    net.Listener
+	tls         *tls.Config
+	implicitTLS bool
+
+	mu       sync.Mutex
+	messages []fakePOP3Message
+	nextUIDL int
+
+	Host string
+	Port string
+}
+
+type fakePOP3Message struct {
+	uidl    string
+	content string
+}
+
+func NewFakePOP3Server() *FakePOP3Server {
+	return &FakePOP3Server{}
+}
+
+// NewFakePOP3ServerWithTLS returns a server that offers STLS using the given
+// certificate and key files.
+func NewFakePOP3ServerWithTLS(crt string, key string) *FakePOP3Server {
+	cert, err := tls.LoadX509KeyPair(crt, key)
+	if err != nil {
+		panic(err)
+	}
+	s := NewFakePOP3Server()
+	s.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return s
+}
+
+// NewFakePOP3ServerWithImplicitTLS returns a server that only accepts TLS
+// connections, using the given certificate and key files.
+func NewFakePOP3ServerWithImplicitTLS(crt string, key string) *FakePOP3Server {
+	s := NewFakePOP3ServerWithTLS(crt, key)
+	s.implicitTLS = true
+	return s
+}
+
+// Deliver adds a raw message to the mailbox and returns its UIDL.
+func (s *FakePOP3Server) Deliver(message string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextUIDL++
+	uidl := fmt.Sprintf("uidl-%d", s.nextUIDL)
+	s.messages = append(s.messages, fakePOP3Message{uidl: uidl, content: message})
+	return uidl
+}
+
+// UIDLs returns the UIDLs of the messages currently in the mailbox.
+func (s *FakePOP3Server) UIDLs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uidls := []string{}
+	for _, m := range s.messages {
+		uidls = append(uidls, m.uidl)
+	}
+	return uidls
+}
+
+func (s *FakePOP3Server) Boot() {
+	var err error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s.Host, s.Port, err = net.SplitHostPort(s.listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	listener := s.listener
+	if s.implicitTLS {
+		listener = tls.NewListener(listener, s.tls)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+}
+
+func (s *FakePOP3Server) Close() {
+	s.listener.Close()
+}
+
+func (s *FakePOP3Server) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("+OK fake pop3 server ready")
+
+	var user string
+	authenticated := false
+	deleted := map[int]bool{}
+
+	s.mu.Lock()
+	messages := append([]fakePOP3Message{}, s.messages...)
+	s.mu.Unlock()
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			text.PrintfLine("-ERR empty command")
+			continue
+		}
+		arg := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+
+		switch strings.ToUpper(fields[0]) {
+		case "STLS":
+			if s.tls == nil || s.implicitTLS {
+				text.PrintfLine("-ERR STLS not supported")
+				continue
+			}
+			text.PrintfLine("+OK begin TLS negotiation")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(conn)
+		case "USER":
+			user = arg
+			text.PrintfLine("+OK")
+		case "PASS":
+			if user != "username" || arg != "password" {
+				text.PrintfLine("-ERR invalid credentials")
+				continue
+			}
+			authenticated = true
+			text.PrintfLine("+OK logged in")
+		case "UIDL":
+			if !authenticated {
+				text.PrintfLine("-ERR not authenticated")
+				continue
+			}
+			text.PrintfLine("+OK")
+			for i, m := range messages {
+				if !deleted[i+1] {
+					text.PrintfLine("%d %s", i+1, m.uidl)
+				}
+			}
+			text.PrintfLine(".")
+		case "RETR":
+			n, ok := s.message(messages, deleted, arg)
+			if !authenticated || !ok {
+				text.PrintfLine("-ERR no such message")
+				continue
+			}
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			fmt.Fprint(w, messages[n-1].content)
+			w.Close()
+		case "DELE":
+			n, ok := s.message(messages, deleted, arg)
+			if !authenticated || !ok {
+				text.PrintfLine("-ERR no such message")
+				continue
+			}
+			deleted[n] = true
+			text.PrintfLine("+OK deleted")
+		case "QUIT":
+			s.mu.Lock()
+			remaining := []fakePOP3Message{}
+			for _, m := range s.messages {
+				keep := true
+				for n := range deleted {
+					if messages[n-1].uidl == m.uidl {
+						keep = false
+					}
+				}
+				if keep {
+					remaining = append(remaining, m)
+				}
+			}
+			s.messages = remaining
+			s.mu.Unlock()
+			text.PrintfLine("+OK bye")
+			return
+		default:
+			text.PrintfLine("-ERR unknown command")
+		}
+	}
+}
+
+func (s *FakePOP3Server) message(messages []fakePOP3Message, deleted map[int]bool, arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(messages) || deleted[n] {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,203 @@
+package inbound
+
+import (
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/pkg/errors"
+)
+
+const defaultFolder = "INBOX"
+
+// IMAP - configuration of the mailbox polled by check and read by in
+type IMAP struct {
+	Host              string
+	Port              string
+	Username          string
+	Password          string
+	TLSMode           string `json:"tls_mode"`
+	SkipSSLValidation bool   `json:"skip_ssl_validation"`
+	CaCert            string `json:"ca_cert"`
+	Folder            string `json:"folder"`
+	Search            Search `json:"search"`
+}
+
+// Search - criteria messages must match to be reported as versions
+type Search struct {
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+	Unseen  bool   `json:"unseen"`
+}
+
+// Validate checks that all required fields are present.
+func (c IMAP) Validate() error {
+	if c.Host == "" {
+		return errors.New(`missing required field "source.imap.host"`)
+	}
+	if c.Port == "" {
+		return errors.New(`missing required field "source.imap.port"`)
+	}
+	if c.Username == "" {
+		return errors.New(`missing required field "source.imap.username"`)
+	}
+	if c.Password == "" {
+		return errors.New(`missing required field "source.imap.password"`)
+	}
+	return validateTLSMode("source.imap.tls_mode", c.TLSMode)
+}
+
+func (c IMAP) folder() string {
+	if c.Folder == "" {
+		return defaultFolder
+	}
+	return c.Folder
+}
+
+// Check returns the versions of the messages matching the search criteria,
+// oldest first. Without a current version only the latest message is
+// returned, otherwise every message from the current one onwards.
+func (config IMAP) Check(current Version) ([]Version, error) {
+	c, err := dialIMAP(config)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout()
+
+	status, err := c.Select(config.folder(), true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to select folder %s", config.folder())
+	}
+	uidValidity := strconv.FormatUint(uint64(status.UidValidity), 10)
+
+	var since uint32
+	if current != nil && current["uid_validity"] == uidValidity {
+		uid, err := strconv.ParseUint(current["uid"], 10, 32)
+		if err == nil {
+			since = uint32(uid)
+		}
+	}
+
+	criteria := imap.NewSearchCriteria()
+	if config.Search.From != "" {
+		criteria.Header.Add("From", config.Search.From)
+	}
+	if config.Search.Subject != "" {
+		criteria.Header.Add("Subject", config.Search.Subject)
+	}
+	if config.Search.Unseen {
+		criteria.WithoutFlags = []string{imap.SeenFlag}
+	}
+	if since > 0 {
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(since, 0)
+	}
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to search messages")
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	versions := []Version{}
+	for _, uid := range uids {
+		// "n:*" always matches the highest UID, even when it is below n
+		if uid < since {
+			continue
+		}
+		versions = append(versions, Version{
+			"uid":          strconv.FormatUint(uint64(uid), 10),
+			"uid_validity": uidValidity,
+		})
+	}
+	if since == 0 && len(versions) > 1 {
+		versions = versions[len(versions)-1:]
+	}
+	return versions, nil
+}
+
+// Fetch returns the raw message identified by version without marking it as
+// seen.
+func (config IMAP) Fetch(version Version) ([]byte, error) {
+	uid, err := strconv.ParseUint(version["uid"], 10, 32)
+	if err != nil {
+		return nil, errors.Errorf("invalid uid %q in version", version["uid"])
+	}
+
+	c, err := dialIMAP(config)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Logout()
+
+	status, err := c.Select(config.folder(), true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to select folder %s", config.folder())
+	}
+	if uidValidity := strconv.FormatUint(uint64(status.UidValidity), 10); version["uid_validity"] != "" && version["uid_validity"] != uidValidity {
+		return nil, errors.Errorf("folder %s has changed UIDVALIDITY from %s to %s, the message can no longer be fetched", config.folder(), version["uid_validity"], uidValidity)
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uint32(uid))
+	section := &imap.BodySectionName{Peek: true}
+
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages)
+	}()
+
+	var raw []byte
+	for msg := range messages {
+		if body := msg.GetBody(section); body != nil {
+			raw, err = ioutil.ReadAll(body)
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to read message")
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, errors.Wrapf(err, "unable to fetch message %d", uid)
+	}
+	if raw == nil {
+		return nil, errors.Errorf("message %d not found in folder %s", uid, config.folder())
+	}
+	return raw, nil
+}
+
+func dialIMAP(config IMAP) (*client.Client, error) {
+	addr := net.JoinHostPort(config.Host, config.Port)
+	tlsConfig := newTLSConfig(config.Host, config.CaCert, config.SkipSSLValidation)
+
+	// the dialer's timeout also bounds waiting for the greeting
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	var c *client.Client
+	var err error
+	switch config.TLSMode {
+	case "", TLSModeImplicit:
+		c, err = client.DialWithDialerTLS(dialer, addr, tlsConfig)
+	default:
+		c, err = client.DialWithDialer(dialer, addr)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error Dialing imap server")
+	}
+	c.Timeout = CommandTimeout
+
+	if config.TLSMode == TLSModeStartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Logout()
+			return nil, errors.Wrap(err, "unable to start TLS")
+		}
+	}
+
+	if err := c.Login(config.Username, config.Password); err != nil {
+		c.Logout()
+		return nil, errors.Wrap(err, "unable to login")
+	}
+	return c, nil
+}
@@ -0,0 +1,252 @@
+package inbound_test
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/pivotal-cf/email-resource/inbound"
+	"github.com/pivotal-cf/email-resource/inbound/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func message(from, subject string) string {
+	return fmt.Sprintf("From: %s\r\nTo: build@example.com\r\nSubject: %s\r\n\r\nsome body\r\n", from, subject)
+}
+
+// stalledListener accepts connections but never writes to them, like an
+// unresponsive server.
+func stalledListener() net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				for _, conn := range conns {
+					conn.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return listener
+}
+
+var _ = Describe("IMAP", func() {
+	var imapServer *fakes.FakeIMAPServer
+	var config inbound.IMAP
+
+	BeforeEach(func() {
+		imapServer = fakes.NewFakeIMAPServer()
+		imapServer.Deliver("INBOX", []string{imap.SeenFlag}, message("alice@example.com", "first"))
+		imapServer.Deliver("INBOX", nil, message("bob@example.com", "second"))
+		imapServer.Deliver("INBOX", nil, message("alice@example.com", "third"))
+		imapServer.Boot()
+
+		config = inbound.IMAP{
+			Host:     imapServer.Host,
+			Port:     imapServer.Port,
+			Username: "username",
+			Password: "password",
+			TLSMode:  "none",
+		}
+	})
+
+	AfterEach(func() {
+		imapServer.Close()
+	})
+
+	Describe("Check", func() {
+		Context("when no version is given", func() {
+			It("returns only the latest message", func() {
+				versions, err := config.Check(nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]inbound.Version{{"uid": "3", "uid_validity": "1"}}))
+			})
+
+			It("returns an empty list when nothing matches", func() {
+				config.Search.Subject = "nothing like this"
+				versions, err := config.Check(nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(BeEmpty())
+			})
+		})
+
+		Context("when a version is given", func() {
+			It("returns the given message and every newer message", func() {
+				versions, err := config.Check(inbound.Version{"uid": "2", "uid_validity": "1"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]inbound.Version{
+					{"uid": "2", "uid_validity": "1"},
+					{"uid": "3", "uid_validity": "1"},
+				}))
+			})
+
+			It("does not return older messages when the given one is the latest", func() {
+				config.Search.From = "bob@example.com"
+				versions, err := config.Check(inbound.Version{"uid": "3", "uid_validity": "1"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(BeEmpty())
+			})
+
+			It("starts over from the latest message when UIDVALIDITY has changed", func() {
+				versions, err := config.Check(inbound.Version{"uid": "1", "uid_validity": "42"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]inbound.Version{{"uid": "3", "uid_validity": "1"}}))
+			})
+		})
+
+		Context("when search criteria are given", func() {
+			It("filters by sender", func() {
+				config.Search.From = "alice@example.com"
+				versions, err := config.Check(inbound.Version{"uid": "1", "uid_validity": "1"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]inbound.Version{
+					{"uid": "1", "uid_validity": "1"},
+					{"uid": "3", "uid_validity": "1"},
+				}))
+			})
+
+			It("filters by subject", func() {
+				config.Search.Subject = "second"
+				versions, err := config.Check(inbound.Version{"uid": "1", "uid_validity": "1"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]inbound.Version{{"uid": "2", "uid_validity": "1"}}))
+			})
+
+			It("filters unseen messages", func() {
+				config.Search.Unseen = true
+				versions, err := config.Check(inbound.Version{"uid": "1", "uid_validity": "1"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]inbound.Version{
+					{"uid": "2", "uid_validity": "1"},
+					{"uid": "3", "uid_validity": "1"},
+				}))
+			})
+		})
+
+		Context("when a folder is given", func() {
+			BeforeEach(func() {
+				imapServer.Deliver("Builds", nil, message("ci@example.com", "in a folder"))
+				config.Folder = "Builds"
+			})
+
+			It("searches that folder", func() {
+				versions, err := config.Check(nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(Equal([]inbound.Version{{"uid": "1", "uid_validity": "1"}}))
+			})
+		})
+
+		Context("when the credentials are wrong", func() {
+			It("returns an error", func() {
+				config.Password = "wrong"
+				_, err := config.Check(nil)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("unable to login"))
+			})
+		})
+	})
+
+	Describe("Fetch", func() {
+		It("returns the raw message", func() {
+			raw, err := config.Fetch(inbound.Version{"uid": "2", "uid_validity": "1"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(raw)).To(Equal(message("bob@example.com", "second")))
+		})
+
+		It("returns an error when the message does not exist", func() {
+			_, err := config.Fetch(inbound.Version{"uid": "42", "uid_validity": "1"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("message 42 not found in folder INBOX"))
+		})
+
+		It("returns an error when UIDVALIDITY has changed", func() {
+			_, err := config.Fetch(inbound.Version{"uid": "2", "uid_validity": "42"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("has changed UIDVALIDITY"))
+		})
+	})
+
+	Context("when the server uses implicit TLS", func() {
+		var tlsServer *fakes.FakeIMAPServer
+
+		BeforeEach(func() {
+			tlsServer = fakes.NewFakeIMAPServerWithImplicitTLS("../out/test_certs/server.crt", "../out/test_certs/server.key")
+			tlsServer.Deliver("INBOX", nil, message("alice@example.com", "over TLS"))
+			tlsServer.Boot()
+
+			config.Host = tlsServer.Host
+			config.Port = tlsServer.Port
+			config.TLSMode = ""
+		})
+
+		AfterEach(func() {
+			tlsServer.Close()
+		})
+
+		It("connects when the certificate is trusted", func() {
+			config.SkipSSLValidation = true
+			versions, err := config.Check(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(HaveLen(1))
+		})
+
+		It("fails when the certificate is not trusted", func() {
+			_, err := config.Check(nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Error Dialing imap server"))
+		})
+	})
+
+	Context("when the server does not respond", func() {
+		var listener net.Listener
+		var dialTimeout time.Duration
+
+		BeforeEach(func() {
+			listener = stalledListener()
+			config.Host, config.Port, _ = net.SplitHostPort(listener.Addr().String())
+			dialTimeout = inbound.DialTimeout
+			inbound.DialTimeout = 100 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			inbound.DialTimeout = dialTimeout
+			listener.Close()
+		})
+
+		It("times out waiting for the greeting", func() {
+			start := time.Now()
+			_, err := config.Check(nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("Error Dialing imap server: "))
+			Expect(err.Error()).To(ContainSubstring("i/o timeout"))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+
+		It("times out with implicit TLS", func() {
+			config.TLSMode = "implicit"
+			_, err := config.Check(nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("i/o timeout"))
+		})
+	})
+
+	Describe("Validate", func() {
+		It("requires a host", func() {
+			config.Host = ""
+			Expect(config.Validate()).To(MatchError(`missing required field "source.imap.host"`))
+		})
+
+		It("rejects unknown TLS modes", func() {
+			config.TLSMode = "sometimes"
+			Expect(config.Validate()).To(MatchError(`invalid value "sometimes" for field "source.imap.tls_mode". Must be one of "starttls", "implicit" or "none"`))
+		})
+	})
+})
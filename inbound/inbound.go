@@ -0,0 +1,90 @@
+// Package inbound reads mail from the mailboxes used by check and in to
+// trigger pipelines from incoming mail.
+package inbound
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TLSModeStartTLS = "starttls"
+	TLSModeImplicit = "implicit"
+	TLSModeNone     = "none"
+)
+
+// DialTimeout bounds connecting to a mailbox and waiting for its greeting and
+// CommandTimeout every command after that, so that check and in fail instead
+// of hanging on an unresponsive server.
+var (
+	DialTimeout    = 30 * time.Second
+	CommandTimeout = 5 * time.Minute
+)
+
+// Version - identifies a message in a mailbox
+type Version map[string]string
+
+// Mailbox - a mailbox that can be polled for messages
+type Mailbox interface {
+	// Check returns the versions of the messages from current onwards,
+	// oldest first, or only the latest message if current is nil.
+	Check(current Version) ([]Version, error)
+	// Fetch returns the raw message identified by version.
+	Fetch(version Version) ([]byte, error)
+}
+
+// Source - the mailboxes that can be configured for check and in
+type Source struct {
+	IMAP IMAP `json:"imap"`
+	POP3 POP3 `json:"pop3"`
+}
+
+// Mailbox returns the configured mailbox, or nil if none is configured.
+func (s Source) Mailbox() (Mailbox, error) {
+	if s.IMAP.Host != "" && s.POP3.Host != "" {
+		return nil, errors.New(`only one of "source.imap" and "source.pop3" may be specified`)
+	}
+	if s.IMAP.Host != "" {
+		if err := s.IMAP.Validate(); err != nil {
+			return nil, err
+		}
+		return s.IMAP, nil
+	}
+	if s.POP3.Host != "" {
+		if err := s.POP3.Validate(); err != nil {
+			return nil, err
+		}
+		return s.POP3, nil
+	}
+	return nil, nil
+}
+
+func validateTLSMode(field, mode string) error {
+	switch mode {
+	case "", TLSModeStartTLS, TLSModeImplicit, TLSModeNone:
+		return nil
+	}
+	return errors.Errorf(`invalid value %q for field "%s". Must be one of "starttls", "implicit" or "none"`, mode, field)
+}
+
+func newTLSConfig(host, caCert string, skipSSLValidation bool) *tls.Config {
+	config := &tls.Config{
+		ServerName: host,
+	}
+
+	if skipSSLValidation {
+		config.InsecureSkipVerify = skipSSLValidation
+		return config
+	}
+
+	if caCert != "" {
+		caPool := x509.NewCertPool()
+		caPool.AppendCertsFromPEM([]byte(caCert))
+		config.RootCAs = caPool
+	}
+
+	return config
+}
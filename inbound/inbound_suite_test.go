@@ -0,0 +1,13 @@
+package inbound_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestInbound(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Inbound Suite")
+}
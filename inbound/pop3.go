@@ -0,0 +1,271 @@
+package inbound
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// POP3 - configuration of the POP3 mailbox polled by check and read by in
+type POP3 struct {
+	Host              string
+	Port              string
+	Username          string
+	Password          string
+	TLSMode           string `json:"tls_mode"`
+	SkipSSLValidation bool   `json:"skip_ssl_validation"`
+	CaCert            string `json:"ca_cert"`
+	DeleteAfterFetch  bool   `json:"delete_after_fetch"`
+}
+
+// Validate checks that all required fields are present.
+func (c POP3) Validate() error {
+	if c.Host == "" {
+		return errors.New(`missing required field "source.pop3.host"`)
+	}
+	if c.Port == "" {
+		return errors.New(`missing required field "source.pop3.port"`)
+	}
+	if c.Username == "" {
+		return errors.New(`missing required field "source.pop3.username"`)
+	}
+	if c.Password == "" {
+		return errors.New(`missing required field "source.pop3.password"`)
+	}
+	return validateTLSMode("source.pop3.tls_mode", c.TLSMode)
+}
+
+// Check returns the versions of the messages in the mailbox, oldest first,
+// identified by their UIDL. Without a current version only the latest message
+// is returned, otherwise every message from the current one onwards. When the
+// current message is no longer in the mailbox, for example because it was
+// deleted after it was fetched, every message is returned.
+func (config POP3) Check(current Version) ([]Version, error) {
+	c, err := dialPOP3(config)
+	if err != nil {
+		return nil, err
+	}
+	defer c.quit()
+
+	listing, err := c.uidl()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []Version{}
+	for _, m := range listing {
+		versions = append(versions, Version{"uidl": m.uidl})
+	}
+
+	if current == nil || current["uidl"] == "" {
+		if len(versions) > 1 {
+			versions = versions[len(versions)-1:]
+		}
+		return versions, nil
+	}
+	for i, v := range versions {
+		if v["uidl"] == current["uidl"] {
+			return versions[i:], nil
+		}
+	}
+	return versions, nil
+}
+
+// Fetch returns the raw message identified by version, deleting it from the
+// mailbox afterwards when delete_after_fetch is enabled.
+func (config POP3) Fetch(version Version) ([]byte, error) {
+	if version["uidl"] == "" {
+		return nil, errors.New("missing uidl in version")
+	}
+
+	c, err := dialPOP3(config)
+	if err != nil {
+		return nil, err
+	}
+
+	listing, err := c.uidl()
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	number := 0
+	for _, m := range listing {
+		if m.uidl == version["uidl"] {
+			number = m.number
+			break
+		}
+	}
+	if number == 0 {
+		c.close()
+		return nil, errors.Errorf("message %s not found in mailbox", version["uidl"])
+	}
+
+	raw, err := c.retr(number)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	if config.DeleteAfterFetch {
+		if err := c.dele(number); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	// deletions are only committed once the session ends with QUIT
+	if err := c.quit(); err != nil && config.DeleteAfterFetch {
+		return nil, errors.Wrap(err, "unable to delete message")
+	}
+	return raw, nil
+}
+
+type pop3Message struct {
+	number int
+	uidl   string
+}
+
+// pop3Client implements the subset of RFC 1939 and RFC 2595 used by check
+// and in.
+type pop3Client struct {
+	text *textproto.Conn
+	conn net.Conn
+}
+
+func dialPOP3(config POP3) (*pop3Client, error) {
+	addr := net.JoinHostPort(config.Host, config.Port)
+	tlsConfig := newTLSConfig(config.Host, config.CaCert, config.SkipSSLValidation)
+
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	var conn net.Conn
+	var err error
+	switch config.TLSMode {
+	case "", TLSModeImplicit:
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	default:
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error Dialing pop3 server")
+	}
+
+	// the greeting has to arrive within the dial timeout, every command
+	// after it within CommandTimeout
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	c := &pop3Client{text: textproto.NewConn(conn), conn: conn}
+	if _, err := c.response(); err != nil {
+		c.close()
+		return nil, errors.Wrap(err, "Error Dialing pop3 server")
+	}
+
+	if config.TLSMode == TLSModeStartTLS {
+		if _, err := c.cmd("STLS"); err != nil {
+			c.close()
+			return nil, errors.Wrap(err, "unable to start TLS")
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "unable to start TLS")
+		}
+		c.conn = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+	}
+
+	if _, err := c.cmd("USER %s", config.Username); err != nil {
+		c.close()
+		return nil, errors.Wrap(err, "unable to login")
+	}
+	if _, err := c.cmd("PASS %s", config.Password); err != nil {
+		c.close()
+		return nil, errors.Wrap(err, "unable to login")
+	}
+	return c, nil
+}
+
+// cmd sends a command and returns the text of its single line response. The
+// command, including any multi-line response read after it, has to complete
+// within CommandTimeout.
+func (c *pop3Client) cmd(format string, args ...interface{}) (string, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(CommandTimeout)); err != nil {
+		return "", err
+	}
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+	return c.response()
+}
+
+func (c *pop3Client) response() (string, error) {
+	line, err := c.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(strings.TrimPrefix(line, "+OK")), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", errors.New(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	}
+	return "", errors.Errorf("unexpected response from pop3 server: %q", line)
+}
+
+func (c *pop3Client) uidl() ([]pop3Message, error) {
+	if _, err := c.cmd("UIDL"); err != nil {
+		return nil, errors.Wrap(err, "unable to list messages")
+	}
+	lines, err := c.text.ReadDotLines()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list messages")
+	}
+
+	messages := []pop3Message{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("unexpected UIDL response line %q", line)
+		}
+		number, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, errors.Errorf("unexpected UIDL response line %q", line)
+		}
+		messages = append(messages, pop3Message{number: number, uidl: fields[1]})
+	}
+	return messages, nil
+}
+
+func (c *pop3Client) retr(number int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", number); err != nil {
+		return nil, errors.Wrapf(err, "unable to fetch message %d", number)
+	}
+	raw, err := ioutil.ReadAll(c.text.DotReader())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to fetch message %d", number)
+	}
+	// the dot reader converts line endings to \n, restore the CRLF of the
+	// message as it was stored on the server
+	return bytes.Replace(raw, []byte("\n"), []byte("\r\n"), -1), nil
+}
+
+func (c *pop3Client) dele(number int) error {
+	if _, err := c.cmd("DELE %d", number); err != nil {
+		return errors.Wrapf(err, "unable to delete message %d", number)
+	}
+	return nil
+}
+
+func (c *pop3Client) quit() error {
+	defer c.close()
+	_, err := c.cmd("QUIT")
+	return err
+}
+
+func (c *pop3Client) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,199 @@
+package inbound_test
+
+import (
+	"net"
+	"time"
+
+	"github.com/pivotal-cf/email-resource/inbound"
+	"github.com/pivotal-cf/email-resource/inbound/fakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("POP3", func() {
+	var pop3Server *fakes.FakePOP3Server
+	var config inbound.POP3
+
+	BeforeEach(func() {
+		pop3Server = fakes.NewFakePOP3Server()
+		pop3Server.Deliver(message("alice@example.com", "first"))
+		pop3Server.Deliver(message("bob@example.com", "second"))
+		pop3Server.Deliver(message("alice@example.com", "third"))
+		pop3Server.Boot()
+
+		config = inbound.POP3{
+			Host:     pop3Server.Host,
+			Port:     pop3Server.Port,
+			Username: "username",
+			Password: "password",
+			TLSMode:  "none",
+		}
+	})
+
+	AfterEach(func() {
+		pop3Server.Close()
+	})
+
+	Describe("Check", func() {
+		It("returns only the latest message when no version is given", func() {
+			versions, err := config.Check(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(Equal([]inbound.Version{{"uidl": "uidl-3"}}))
+		})
+
+		It("returns the given message and every newer message", func() {
+			versions, err := config.Check(inbound.Version{"uidl": "uidl-2"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(Equal([]inbound.Version{{"uidl": "uidl-2"}, {"uidl": "uidl-3"}}))
+		})
+
+		It("returns every message when the given one is no longer in the mailbox", func() {
+			versions, err := config.Check(inbound.Version{"uidl": "uidl-0"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(HaveLen(3))
+		})
+
+		It("returns an empty list when the mailbox is empty", func() {
+			emptyServer := fakes.NewFakePOP3Server()
+			emptyServer.Boot()
+			defer emptyServer.Close()
+			config.Port = emptyServer.Port
+
+			versions, err := config.Check(nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(versions).To(BeEmpty())
+		})
+
+		It("returns an error when the credentials are wrong", func() {
+			config.Password = "wrong"
+			_, err := config.Check(nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("unable to login: invalid credentials"))
+		})
+	})
+
+	Describe("Fetch", func() {
+		It("returns the raw message and leaves it in the mailbox", func() {
+			raw, err := config.Fetch(inbound.Version{"uidl": "uidl-2"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(raw)).To(Equal(message("bob@example.com", "second")))
+			Expect(pop3Server.UIDLs()).To(Equal([]string{"uidl-1", "uidl-2", "uidl-3"}))
+		})
+
+		It("deletes the message when delete_after_fetch is enabled", func() {
+			config.DeleteAfterFetch = true
+			_, err := config.Fetch(inbound.Version{"uidl": "uidl-2"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pop3Server.UIDLs()).To(Equal([]string{"uidl-1", "uidl-3"}))
+		})
+
+		It("returns an error when the message does not exist", func() {
+			_, err := config.Fetch(inbound.Version{"uidl": "uidl-42"})
+			Expect(err).To(MatchError("message uidl-42 not found in mailbox"))
+		})
+	})
+
+	Context("when the server uses TLS", func() {
+		var tlsServer *fakes.FakePOP3Server
+
+		AfterEach(func() {
+			tlsServer.Close()
+		})
+
+		Context("with STLS", func() {
+			BeforeEach(func() {
+				tlsServer = fakes.NewFakePOP3ServerWithTLS("../out/test_certs/server.crt", "../out/test_certs/server.key")
+				tlsServer.Deliver(message("alice@example.com", "over TLS"))
+				tlsServer.Boot()
+
+				config.Port = tlsServer.Port
+				config.TLSMode = "starttls"
+			})
+
+			It("upgrades the connection", func() {
+				config.SkipSSLValidation = true
+				versions, err := config.Check(nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(versions).To(HaveLen(1))
+			})
+
+			It("fails when the certificate is not trusted", func() {
+				_, err := config.Check(nil)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("unable to start TLS"))
+			})
+		})
+
+		Context("with implicit TLS", func() {
+			BeforeEach(func() {
+				tlsServer = fakes.NewFakePOP3ServerWithImplicitTLS("../out/test_certs/server.crt", "../out/test_certs/server.key")
+				tlsServer.Deliver(message("alice@example.com", "over TLS"))
+				tlsServer.Boot()
+
+				config.Port = tlsServer.Port
+				config.TLSMode = ""
+			})
+
+			It("connects when the certificate is trusted", func() {
+				config.SkipSSLValidation = true
+				raw, err := config.Fetch(inbound.Version{"uidl": "uidl-1"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(raw)).To(ContainSubstring("Subject: over TLS"))
+			})
+
+			It("fails when the certificate is not trusted", func() {
+				_, err := config.Check(nil)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Error Dialing pop3 server"))
+			})
+		})
+	})
+
+	Context("when the server does not respond", func() {
+		var listener net.Listener
+		var dialTimeout time.Duration
+
+		BeforeEach(func() {
+			listener = stalledListener()
+			config.Host, config.Port, _ = net.SplitHostPort(listener.Addr().String())
+			dialTimeout = inbound.DialTimeout
+			inbound.DialTimeout = 100 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			inbound.DialTimeout = dialTimeout
+			listener.Close()
+		})
+
+		It("times out waiting for the greeting", func() {
+			start := time.Now()
+			_, err := config.Check(nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("Error Dialing pop3 server: "))
+			Expect(err.Error()).To(ContainSubstring("i/o timeout"))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+
+		It("times out the TLS handshake with implicit TLS", func() {
+			config.TLSMode = "implicit"
+			start := time.Now()
+			_, err := config.Check(nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("Error Dialing pop3 server: "))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+	})
+
+	Describe("Validate", func() {
+		It("requires a password", func() {
+			config.Password = ""
+			Expect(config.Validate()).To(MatchError(`missing required field "source.pop3.password"`))
+		})
+
+		It("rejects unknown TLS modes", func() {
+			config.TLSMode = "sometimes"
+			Expect(config.Validate()).To(MatchError(`invalid value "sometimes" for field "source.pop3.tls_mode". Must be one of "starttls", "implicit" or "none"`))
+		})
+	})
+})
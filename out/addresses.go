@@ -0,0 +1,167 @@
+package out
+
+import (
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+// ParseAddresses parses a list of RFC 5322 addresses, such as
+// `"Doe, Jane" <jane@example.com>`, separated by commas, semicolons or line
+// breaks. Separators within quoted display names and comments are kept.
+// Internationalized domains are converted to punycode.
+func ParseAddresses(list string) ([]*mail.Address, error) {
+	var addresses []*mail.Address
+	for _, entry := range splitAddressList(list) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		address, err := parseAddress(entry)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+func splitAddressList(list string) []string {
+	var entries []string
+	var current strings.Builder
+	inQuote, escaped := false, false
+	comment, angle := 0, 0
+
+	for _, c := range list {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && (inQuote || comment > 0):
+			escaped = true
+		case c == '"' && comment == 0:
+			inQuote = !inQuote
+		case inQuote:
+		case c == '(':
+			comment++
+		case c == ')' && comment > 0:
+			comment--
+		case comment > 0:
+		case c == '<':
+			angle++
+		case c == '>' && angle > 0:
+			angle--
+		case angle == 0 && (c == ',' || c == ';' || c == '\n' || c == '\r'):
+			entries = append(entries, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	return append(entries, current.String())
+}
+
+// formatAddress formats an address for a header, leaving addresses without a
+// display name bare.
+func formatAddress(address *mail.Address) string {
+	if address.Name == "" {
+		return address.Address
+	}
+	return address.String()
+}
+
+// recipients are the parsed to, cc and bcc addresses of a message, each
+// address only appearing once across all three lists.
+type recipients struct {
+	to, cc, bcc []*mail.Address
+}
+
+func newRecipients(to, cc, bcc []*mail.Address) recipients {
+	seen := map[string]bool{}
+	unique := func(addresses []*mail.Address) []*mail.Address {
+		var result []*mail.Address
+		for _, address := range addresses {
+			key := strings.ToLower(address.Address)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, address)
+		}
+		return result
+	}
+	return recipients{to: unique(to), cc: unique(cc), bcc: unique(bcc)}
+}
+
+// bccAddresses returns the bare addresses of the blind copy recipients.
+func (r recipients) bccAddresses() []string {
+	var addresses []string
+	for _, address := range r.bcc {
+		addresses = append(addresses, address.Address)
+	}
+	return addresses
+}
+
+// envelope returns the bare addresses of every recipient.
+func (r recipients) envelope() []string {
+	var addresses []string
+	for _, list := range [][]*mail.Address{r.to, r.cc, r.bcc} {
+		for _, address := range list {
+			addresses = append(addresses, address.Address)
+		}
+	}
+	return addresses
+}
+
+func formatAddresses(addresses []*mail.Address) []string {
+	var formatted []string
+	for _, address := range addresses {
+		formatted = append(formatted, formatAddress(address))
+	}
+	return formatted
+}
+
+// parseAddressEntries parses every entry of a list, each of which may itself
+// be a list of addresses.
+func parseAddressEntries(entries []string) ([]*mail.Address, error) {
+	var addresses []*mail.Address
+	for _, entry := range entries {
+		parsed, err := ParseAddresses(entry)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, parsed...)
+	}
+	return addresses, nil
+}
+
+func parseSender(from string) (*mail.Address, error) {
+	return parseAddress(from)
+}
+
+func parseAddress(text string) (*mail.Address, error) {
+	address, err := mail.ParseAddress(text)
+	if err != nil {
+		return nil, errors.Errorf("invalid address %q: %s", text, strings.TrimPrefix(err.Error(), "mail: "))
+	}
+	at := strings.LastIndex(address.Address, "@")
+	if domain := address.Address[at+1:]; !isASCII(domain) {
+		ascii, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return nil, errors.Errorf("invalid address %q: invalid domain %q: %s", text, domain, err)
+		}
+		address.Address = address.Address[:at+1] + ascii
+	}
+	return address, nil
+}
+
+func isASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package out_test
+
+import (
+	"net/mail"
+
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseAddresses", func() {
+	It("parses bare addresses and addresses with display names", func() {
+		addresses, err := out.ParseAddresses(`jane@example.com, John Smith <john@example.com>`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addresses).To(Equal([]*mail.Address{
+			{Address: "jane@example.com"},
+			{Name: "John Smith", Address: "john@example.com"},
+		}))
+	})
+
+	It("accepts commas, semicolons and line breaks as separators", func() {
+		addresses, err := out.ParseAddresses("a@example.com;b@example.com\nc@example.com\r\nd@example.com,")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addresses).To(HaveLen(4))
+		Expect(addresses[3].Address).To(Equal("d@example.com"))
+	})
+
+	It("does not split quoted display names or comments", func() {
+		addresses, err := out.ParseAddresses(`"Doe, Jane" <jane@example.com>; john@example.com (Smith; John)`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addresses).To(Equal([]*mail.Address{
+			{Name: "Doe, Jane", Address: "jane@example.com"},
+			{Name: "Smith; John", Address: "john@example.com"},
+		}))
+	})
+
+	It("ignores empty entries", func() {
+		addresses, err := out.ParseAddresses("\n, ;\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addresses).To(BeEmpty())
+	})
+
+	It("converts internationalized domains to punycode", func() {
+		addresses, err := out.ParseAddresses("Zoë <zoë@bücher.example>, ops@example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addresses).To(Equal([]*mail.Address{
+			{Name: "Zoë", Address: "zoë@xn--bcher-kva.example"},
+			{Address: "ops@example.com"},
+		}))
+	})
+
+	It("names the invalid address", func() {
+		_, err := out.ParseAddresses("jane@example.com, john")
+		Expect(err).To(MatchError(`invalid address "john": missing '@' or angle-addr`))
+	})
+})
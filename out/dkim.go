@@ -0,0 +1,137 @@
+package out
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/pkg/errors"
+)
+
+// defaultDKIMHeaders are the header fields signed unless source.dkim.headers
+// is given, following RFC 6376 section 5.4.1. Fields missing from a message
+// are signed as absent, so they cannot be added on the way without breaking
+// the signature.
+var defaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Message-ID", "In-Reply-To", "References",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+func (d DKIM) configured() bool {
+	return d.Selector != "" || d.Domain != "" || d.PrivateKey != "" || len(d.Headers) > 0 || d.Canonicalization != ""
+}
+
+// signOptions returns the options messages from the from address are signed
+// with. The signing domain defaults to the domain of from.
+func (d DKIM) signOptions(from string) (*dkim.SignOptions, error) {
+	if d.Selector == "" {
+		return nil, errors.New(`missing required field "source.dkim.selector"`)
+	}
+	if d.PrivateKey == "" {
+		return nil, errors.New(`missing required field "source.dkim.private_key"`)
+	}
+	signer, err := parseDKIMKey(d.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	headerCanonicalization, bodyCanonicalization, err := d.canonicalization()
+	if err != nil {
+		return nil, err
+	}
+
+	domain := d.Domain
+	if domain == "" {
+		domain = from[strings.LastIndex(from, "@")+1:]
+	}
+	headers := defaultDKIMHeaders
+	if len(d.Headers) > 0 {
+		headers = d.Headers
+		if !containsFold(headers, "From") {
+			return nil, errors.New(`"source.dkim.headers" must include "From"`)
+		}
+	}
+
+	return &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               d.Selector,
+		Signer:                 signer,
+		HeaderCanonicalization: headerCanonicalization,
+		BodyCanonicalization:   bodyCanonicalization,
+		HeaderKeys:             headers,
+	}, nil
+}
+
+// canonicalization parses source.dkim.canonicalization, given like the c= tag
+// of a signature as header/body. A missing body canonicalization is simple.
+func (d DKIM) canonicalization() (dkim.Canonicalization, dkim.Canonicalization, error) {
+	value := strings.ToLower(d.Canonicalization)
+	if value == "" {
+		value = "relaxed/relaxed"
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) == 1 {
+		parts = append(parts, string(dkim.CanonicalizationSimple))
+	}
+	for _, part := range parts {
+		switch dkim.Canonicalization(part) {
+		case dkim.CanonicalizationSimple, dkim.CanonicalizationRelaxed:
+		default:
+			return "", "", errors.Errorf(`invalid value %q for field "source.dkim.canonicalization". Must be one of "simple" or "relaxed" for the header, optionally followed by "/" and one of them for the body, e.g. "relaxed/relaxed"`, d.Canonicalization)
+		}
+	}
+	return dkim.Canonicalization(parts[0]), dkim.Canonicalization(parts[1]), nil
+}
+
+// parseDKIMKey parses a PEM encoded RSA key in PKCS #1 or PKCS #8 form, or an
+// Ed25519 key in PKCS #8 form.
+func parseDKIMKey(text string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(text))
+	if block == nil {
+		return nil, errors.New(`"source.dkim.private_key" is not a PEM encoded private key`)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, `invalid "source.dkim.private_key"`)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, `invalid "source.dkim.private_key"`)
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, errors.Errorf(`"source.dkim.private_key" is a %T. Must be an RSA or Ed25519 key`, key)
+	}
+	return nil, errors.Errorf(`"source.dkim.private_key" is a %q block. Must be "RSA PRIVATE KEY" or "PRIVATE KEY"`, block.Type)
+}
+
+// signDKIM returns msg with a DKIM-Signature header field prepended.
+func signDKIM(msg []byte, options *dkim.SignOptions) ([]byte, error) {
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(msg), options); err != nil {
+		return nil, errors.Wrap(err, "Error signing mail with DKIM")
+	}
+	return signed.Bytes(), nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package out_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DKIM signing", func() {
+	fixture := newSMTPOutFixture()
+	var record string
+	var lookups []string
+
+	verify := func(data []byte) []*dkim.Verification {
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(data), &dkim.VerifyOptions{
+			LookupTXT: func(domain string) ([]string, error) {
+				lookups = append(lookups, domain)
+				return []string{record}, nil
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return verifications
+	}
+
+	useRSAKey := func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		Expect(err).NotTo(HaveOccurred())
+		fixture.inputs.Source.DKIM.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+		record = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(public)
+	}
+
+	useEd25519Key := func() {
+		public, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		private, err := x509.MarshalPKCS8PrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+		fixture.inputs.Source.DKIM.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}))
+		record = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)
+	}
+
+	BeforeEach(func() {
+		lookups = nil
+		fixture.inputs.Source.To = []string{"jane@example.net"}
+		fixture.inputs.Source.DKIM.Selector = "ci"
+		fixture.inputs.Params.BodyText = "the build passed\n\n"
+		useRSAKey()
+	})
+
+	It("signs with an RSA key for the domain of 'from'", func() {
+		_, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		data := fixture.delivered()
+		Expect(string(data)).To(HavePrefix("DKIM-Signature: "))
+		verifications := verify(data)
+		Expect(verifications).To(HaveLen(1))
+		Expect(verifications[0].Err).NotTo(HaveOccurred())
+		Expect(verifications[0].Domain).To(Equal("example.com"))
+		Expect(lookups).To(Equal([]string{"ci._domainkey.example.com"}))
+		Expect(verifications[0].HeaderKeys).To(ContainElements("From", "To", "Subject", "Date", "Message-ID", "Content-Type"))
+	})
+
+	It("signs with an Ed25519 key", func() {
+		useEd25519Key()
+		_, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		verifications := verify(fixture.delivered())
+		Expect(verifications).To(HaveLen(1))
+		Expect(verifications[0].Err).NotTo(HaveOccurred())
+		Expect(string(fixture.delivered())).To(ContainSubstring("a=ed25519-sha256"))
+	})
+
+	It("signs for the configured domain with the configured headers and canonicalization", func() {
+		fixture.inputs.Source.DKIM.Domain = "mail.example.com"
+		fixture.inputs.Source.DKIM.Headers = []string{"from", "subject"}
+		fixture.inputs.Source.DKIM.Canonicalization = "simple/simple"
+		_, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		data := fixture.delivered()
+		Expect(string(data)).To(ContainSubstring("c=simple/simple"))
+		verifications := verify(data)
+		Expect(verifications).To(HaveLen(1))
+		Expect(verifications[0].Err).NotTo(HaveOccurred())
+		Expect(verifications[0].Domain).To(Equal("mail.example.com"))
+		Expect(verifications[0].HeaderKeys).To(Equal([]string{"from", "subject"}))
+	})
+
+	It("produces a signature that does not verify once the body is changed", func() {
+		_, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		tampered := bytes.Replace(fixture.delivered(), []byte("the build passed"), []byte("the build failed"), 1)
+		verifications := verify(tampered)
+		Expect(verifications).To(HaveLen(1))
+		Expect(verifications[0].Err).To(HaveOccurred())
+	})
+
+	It("records the signed message in the version", func() {
+		fixture.inputs.Params.IncludeMessageInVersion = true
+		output, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		var outdata out.Output
+		Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+		message := decodeVersionMessage(outdata.Version.Message)
+		Expect(message).To(HavePrefix("DKIM-Signature: "))
+		verifications := verify([]byte(message))
+		Expect(verifications).To(HaveLen(1))
+		Expect(verifications[0].Err).NotTo(HaveOccurred())
+	})
+
+	Context("when the configuration is invalid", func() {
+		It("fails without a selector", func() {
+			fixture.inputs.Source.DKIM.Selector = ""
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: missing required field "source.dkim.selector"`))
+		})
+
+		It("fails when the private key is not PEM encoded", func() {
+			fixture.inputs.Source.DKIM.PrivateKey = "not a key"
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.dkim.private_key" is not a PEM encoded private key`))
+		})
+
+		It("fails when the signed headers do not include From", func() {
+			fixture.inputs.Source.DKIM.Headers = []string{"Subject"}
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.dkim.headers" must include "From"`))
+		})
+
+		It("fails when the canonicalization is unknown", func() {
+			fixture.inputs.Source.DKIM.Canonicalization = "relaxed/loose"
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: invalid value "relaxed/loose" for field "source.dkim.canonicalization". Must be one of "simple" or "relaxed" for the header, optionally followed by "/" and one of them for the body, e.g. "relaxed/relaxed"`))
+		})
+
+		It("fails with a transport that composes the message again", func() {
+			fixture.inputs.Source.Transport = "sendgrid"
+			fixture.inputs.Source.SendGrid.APIKey = "some-api-key"
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.dkim" cannot be used with transport "sendgrid", which composes the message again. Set up DKIM signing with the provider instead`))
+		})
+
+		AfterEach(func() {
+			Expect(fixture.smtpServer.Deliveries).To(BeEmpty())
+		})
+	})
+})
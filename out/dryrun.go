@@ -0,0 +1,79 @@
+package out
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DryRunSummary - a message rendered but not sent because of dry_run,
+// written to stderr. The build log is as visible as the metadata, so the
+// blind copy recipients are only counted.
+type DryRunSummary struct {
+	MessageID   string   `json:"message_id"`
+	Transport   string   `json:"transport"`
+	From        string   `json:"from"`
+	To          []string `json:"to,omitempty"`
+	Cc          []string `json:"cc,omitempty"`
+	Bcc         int      `json:"bcc,omitempty"`
+	Subject     string   `json:"subject"`
+	Attachments []string `json:"attachments,omitempty"`
+	Size        int      `json:"size"`
+	File        string   `json:"file,omitempty"`
+}
+
+// writeDryRun writes msg to emlPath, or to w if emlPath is empty, and then
+// summary as JSON to w.
+func writeDryRun(w io.Writer, sourceRoot, emlPath string, msg []byte, summary DryRunSummary) error {
+	if emlPath != "" {
+		if !filepath.IsAbs(emlPath) {
+			emlPath = filepath.Join(sourceRoot, emlPath)
+		}
+		if err := os.MkdirAll(filepath.Dir(emlPath), 0755); err != nil {
+			return errors.Wrapf(err, "unable to write message to %s", emlPath)
+		}
+		if err := ioutil.WriteFile(emlPath, msg, 0644); err != nil {
+			return errors.Wrapf(err, "unable to write message to %s", emlPath)
+		}
+		summary.File = emlPath
+	} else {
+		fmt.Fprintf(w, "Dry run, not sending the message:\n%s\n", msg)
+	}
+
+	contents, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal dry run summary")
+	}
+	_, err = fmt.Fprintf(w, "Dry run summary:\n%s\n", contents)
+	return err
+}
+
+// dryRunMetadata returns a metadata item for every recipient of a message
+// that was not sent, such as "jane@example.com: not sent (dry run)". As for
+// a sent message, the blind copy recipients in bcc are only counted.
+func dryRunMetadata(envelope, bcc []string) []MetadataItem {
+	blind := map[string]bool{}
+	for _, addr := range bcc {
+		blind[strings.ToLower(addr)] = true
+	}
+
+	items := []MetadataItem{{Name: "dry_run", Value: "true"}}
+	var bccCount int
+	for _, addr := range envelope {
+		if blind[strings.ToLower(addr)] {
+			bccCount++
+			continue
+		}
+		items = append(items, MetadataItem{Name: "recipient", Value: addr + ": not sent (dry run)"})
+	}
+	if bccCount > 0 {
+		items = append(items, MetadataItem{Name: "bcc", Value: fmt.Sprintf("%d not sent (dry run)", bccCount)})
+	}
+	return items
+}
@@ -0,0 +1,201 @@
+package out_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Dry run", func() {
+	fixture := newOutFixture()
+	var listener net.Listener
+	var tokenServer *httptest.Server
+	var connections, tokenRequests int32
+	var stderr string
+	var buildID string
+	var buildIDSet bool
+
+	execute := func() (string, error) {
+		captured, err := ioutil.TempFile("", "stderr")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.Remove(captured.Name())
+		original := os.Stderr
+		os.Stderr = captured
+		output, err := fixture.run()
+		os.Stderr = original
+
+		contents, readErr := ioutil.ReadFile(captured.Name())
+		Expect(readErr).NotTo(HaveOccurred())
+		stderr = string(contents)
+		return output, err
+	}
+
+	summary := func() out.DryRunSummary {
+		index := strings.Index(stderr, "Dry run summary:\n")
+		Expect(index).NotTo(Equal(-1))
+		var summary out.DryRunSummary
+		Expect(json.Unmarshal([]byte(stderr[index+len("Dry run summary:\n"):]), &summary)).To(Succeed())
+		return summary
+	}
+
+	versionMessage := func(output string) string {
+		var outdata out.Output
+		Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+		return decodeVersionMessage(outdata.Version.Message)
+	}
+
+	BeforeEach(func() {
+		Expect(os.MkdirAll(filepath.Join(fixture.sourceRoot, "reports"), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(fixture.sourceRoot, "reports", "report.txt"), []byte("all green"), 0600)).To(Succeed())
+
+		connections, tokenRequests = 0, 0
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		l := listener
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&connections, 1)
+				conn.Close()
+			}
+		}()
+		tokenServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&tokenRequests, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		host, port, err := net.SplitHostPort(listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+
+		buildID, buildIDSet = os.LookupEnv("BUILD_ID")
+		os.Setenv("BUILD_ID", "5")
+		fixture.inputs.Source.SMTP.Host = host
+		fixture.inputs.Source.SMTP.Port = port
+		fixture.inputs.Source.SMTP.Username = "bot@example.com"
+		fixture.inputs.Source.SMTP.AuthMechanism = "xoauth2"
+		fixture.inputs.Source.SMTP.OAuth2.TokenURL = tokenServer.URL
+		fixture.inputs.Source.SMTP.OAuth2.ClientID = "some-client"
+		fixture.inputs.Source.To = []string{"Jane Doe <jane@example.com>"}
+		fixture.inputs.Source.Bcc = []string{"audit@example.com"}
+		fixture.inputs.Params.SubjectText = "Build #${BUILD_ID} passed"
+		fixture.inputs.Params.CcText = "ops@example.com"
+		fixture.inputs.Params.AttachmentGlobs = []string{"reports/*.txt"}
+		fixture.inputs.Params.DryRun = true
+		fixture.inputs.Params.IncludeMessageInVersion = true
+	})
+
+	AfterEach(func() {
+		listener.Close()
+		tokenServer.Close()
+		if buildIDSet {
+			os.Setenv("BUILD_ID", buildID)
+		} else {
+			os.Unsetenv("BUILD_ID")
+		}
+	})
+
+	It("renders the message without connecting to the SMTP server", func() {
+		output, err := execute()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(atomic.LoadInt32(&connections)).To(BeZero())
+		Expect(atomic.LoadInt32(&tokenRequests)).To(BeZero())
+
+		message := versionMessage(output)
+		Expect(message).To(ContainSubstring("Subject: Build #5 passed\r\n"))
+		Expect(message).To(ContainSubstring("Content-Disposition: attachment; filename=report.txt\r\n"))
+		Expect(stderr).To(ContainSubstring("Dry run, not sending the message:\n" + message + "\n"))
+	})
+
+	It("writes a summary of the message to stderr", func() {
+		output, err := execute()
+		Expect(err).NotTo(HaveOccurred())
+
+		var outdata out.Output
+		Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+		Expect(summary()).To(Equal(out.DryRunSummary{
+			MessageID:   outdata.Version.MessageID,
+			Transport:   "smtp",
+			From:        `"Build Bot" <bot@example.com>`,
+			To:          []string{`"Jane Doe" <jane@example.com>`},
+			Cc:          []string{"ops@example.com"},
+			Bcc:         1,
+			Subject:     "Build #5 passed",
+			Attachments: []string{"report.txt"},
+			Size:        len(versionMessage(output)),
+		}))
+		Expect(stderr).NotTo(ContainSubstring("audit@example.com"))
+	})
+
+	It("reports the recipients as not sent in the metadata", func() {
+		output, err := execute()
+		Expect(err).NotTo(HaveOccurred())
+
+		var outdata out.Output
+		Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+		Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "dry_run", Value: "true"}))
+		Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "message_id", Value: outdata.Version.MessageID}))
+		Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "recipient", Value: "jane@example.com: not sent (dry run)"}))
+		Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "recipient", Value: "ops@example.com: not sent (dry run)"}))
+		Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "bcc", Value: "1 not sent (dry run)"}))
+		Expect(outdata.Metadata).NotTo(ContainElement(out.MetadataItem{Name: "recipient", Value: "audit@example.com: not sent (dry run)"}))
+		Expect(outdata.Metadata).NotTo(ContainElement(HaveField("Name", "delivered_by")))
+	})
+
+	It("marks the version as a dry run", func() {
+		output, err := execute()
+		Expect(err).NotTo(HaveOccurred())
+
+		var outdata out.Output
+		Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+		Expect(outdata.Version.DryRun).To(Equal("true"))
+		Expect(outdata.Version.MessageID).NotTo(BeEmpty())
+
+		var raw struct {
+			Version map[string]string `json:"version"`
+		}
+		Expect(json.Unmarshal([]byte(output), &raw)).To(Succeed())
+		Expect(raw.Version).To(HaveKeyWithValue("dry_run", "true"))
+	})
+
+	It("writes the message to 'dry_run_file' instead of stderr", func() {
+		fixture.inputs.Params.DryRunFile = "out/message.eml"
+		output, err := execute()
+		Expect(err).NotTo(HaveOccurred())
+
+		path := filepath.Join(fixture.sourceRoot, "out", "message.eml")
+		contents, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(contents)).To(Equal(versionMessage(output)))
+		Expect(stderr).NotTo(ContainSubstring("Dry run, not sending the message"))
+		Expect(summary().File).To(Equal(path))
+	})
+
+	It("is enabled by 'dry_run' in the source", func() {
+		fixture.inputs.Params.DryRun = false
+		fixture.inputs.Source.DryRun = true
+		_, err := execute()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(atomic.LoadInt32(&connections)).To(BeZero())
+		Expect(summary().Subject).To(Equal("Build #5 passed"))
+	})
+
+	It("still validates the configuration", func() {
+		fixture.inputs.Params.SubjectText = ""
+		_, err := execute()
+		Expect(err).To(MatchError(`Invalid configuration: missing required field "params.subject" or "params.subject_text". Must specify at least one`))
+	})
+})
@@ -6,7 +6,6 @@ import (
 	"io"
 	"sync"
 
-	mailyak "github.com/domodwyer/mailyak/v3"
 	"github.com/pivotal-cf/email-resource/out"
 )
 
@@ -23,6 +22,12 @@ type FakeMail struct {
 		arg1 string
 		arg2 io.Reader
 	}
+	AttachInlineStub        func(string, io.Reader)
+	attachInlineMutex       sync.RWMutex
+	attachInlineArgsForCall []struct {
+		arg1 string
+		arg2 io.Reader
+	}
 	BccStub        func(...string)
 	bccMutex       sync.RWMutex
 	bccArgsForCall []struct {
@@ -38,15 +43,15 @@ type FakeMail struct {
 	fromArgsForCall []struct {
 		arg1 string
 	}
-	HTMLStub        func() *mailyak.BodyPart
+	HTMLStub        func() *out.BodyPart
 	hTMLMutex       sync.RWMutex
 	hTMLArgsForCall []struct {
 	}
 	hTMLReturns struct {
-		result1 *mailyak.BodyPart
+		result1 *out.BodyPart
 	}
 	hTMLReturnsOnCall map[int]struct {
-		result1 *mailyak.BodyPart
+		result1 *out.BodyPart
 	}
 	MimeBufStub        func() (*bytes.Buffer, error)
 	mimeBufMutex       sync.RWMutex
@@ -60,15 +65,15 @@ type FakeMail struct {
 		result1 *bytes.Buffer
 		result2 error
 	}
-	PlainStub        func() *mailyak.BodyPart
+	PlainStub        func() *out.BodyPart
 	plainMutex       sync.RWMutex
 	plainArgsForCall []struct {
 	}
 	plainReturns struct {
-		result1 *mailyak.BodyPart
+		result1 *out.BodyPart
 	}
 	plainReturnsOnCall map[int]struct {
-		result1 *mailyak.BodyPart
+		result1 *out.BodyPart
 	}
 	SubjectStub        func(string)
 	subjectMutex       sync.RWMutex
@@ -90,9 +95,10 @@ func (fake *FakeMail) AddHeader(arg1 string, arg2 string) {
 		arg1 string
 		arg2 string
 	}{arg1, arg2})
+	stub := fake.AddHeaderStub
 	fake.recordInvocation("AddHeader", []interface{}{arg1, arg2})
 	fake.addHeaderMutex.Unlock()
-	if fake.AddHeaderStub != nil {
+	if stub != nil {
 		fake.AddHeaderStub(arg1, arg2)
 	}
 }
@@ -122,9 +128,10 @@ func (fake *FakeMail) Attach(arg1 string, arg2 io.Reader) {
 		arg1 string
 		arg2 io.Reader
 	}{arg1, arg2})
+	stub := fake.AttachStub
 	fake.recordInvocation("Attach", []interface{}{arg1, arg2})
 	fake.attachMutex.Unlock()
-	if fake.AttachStub != nil {
+	if stub != nil {
 		fake.AttachStub(arg1, arg2)
 	}
 }
@@ -148,14 +155,48 @@ func (fake *FakeMail) AttachArgsForCall(i int) (string, io.Reader) {
 	return argsForCall.arg1, argsForCall.arg2
 }
 
+func (fake *FakeMail) AttachInline(arg1 string, arg2 io.Reader) {
+	fake.attachInlineMutex.Lock()
+	fake.attachInlineArgsForCall = append(fake.attachInlineArgsForCall, struct {
+		arg1 string
+		arg2 io.Reader
+	}{arg1, arg2})
+	stub := fake.AttachInlineStub
+	fake.recordInvocation("AttachInline", []interface{}{arg1, arg2})
+	fake.attachInlineMutex.Unlock()
+	if stub != nil {
+		fake.AttachInlineStub(arg1, arg2)
+	}
+}
+
+func (fake *FakeMail) AttachInlineCallCount() int {
+	fake.attachInlineMutex.RLock()
+	defer fake.attachInlineMutex.RUnlock()
+	return len(fake.attachInlineArgsForCall)
+}
+
+func (fake *FakeMail) AttachInlineCalls(stub func(string, io.Reader)) {
+	fake.attachInlineMutex.Lock()
+	defer fake.attachInlineMutex.Unlock()
+	fake.AttachInlineStub = stub
+}
+
+func (fake *FakeMail) AttachInlineArgsForCall(i int) (string, io.Reader) {
+	fake.attachInlineMutex.RLock()
+	defer fake.attachInlineMutex.RUnlock()
+	argsForCall := fake.attachInlineArgsForCall[i]
+	return argsForCall.arg1, argsForCall.arg2
+}
+
 func (fake *FakeMail) Bcc(arg1 ...string) {
 	fake.bccMutex.Lock()
 	fake.bccArgsForCall = append(fake.bccArgsForCall, struct {
 		arg1 []string
 	}{arg1})
+	stub := fake.BccStub
 	fake.recordInvocation("Bcc", []interface{}{arg1})
 	fake.bccMutex.Unlock()
-	if fake.BccStub != nil {
+	if stub != nil {
 		fake.BccStub(arg1...)
 	}
 }
@@ -184,9 +225,10 @@ func (fake *FakeMail) Cc(arg1 ...string) {
 	fake.ccArgsForCall = append(fake.ccArgsForCall, struct {
 		arg1 []string
 	}{arg1})
+	stub := fake.CcStub
 	fake.recordInvocation("Cc", []interface{}{arg1})
 	fake.ccMutex.Unlock()
-	if fake.CcStub != nil {
+	if stub != nil {
 		fake.CcStub(arg1...)
 	}
 }
@@ -215,9 +257,10 @@ func (fake *FakeMail) From(arg1 string) {
 	fake.fromArgsForCall = append(fake.fromArgsForCall, struct {
 		arg1 string
 	}{arg1})
+	stub := fake.FromStub
 	fake.recordInvocation("From", []interface{}{arg1})
 	fake.fromMutex.Unlock()
-	if fake.FromStub != nil {
+	if stub != nil {
 		fake.FromStub(arg1)
 	}
 }
@@ -241,20 +284,21 @@ func (fake *FakeMail) FromArgsForCall(i int) string {
 	return argsForCall.arg1
 }
 
-func (fake *FakeMail) HTML() *mailyak.BodyPart {
+func (fake *FakeMail) HTML() *out.BodyPart {
 	fake.hTMLMutex.Lock()
 	ret, specificReturn := fake.hTMLReturnsOnCall[len(fake.hTMLArgsForCall)]
 	fake.hTMLArgsForCall = append(fake.hTMLArgsForCall, struct {
 	}{})
+	stub := fake.HTMLStub
+	fakeReturns := fake.hTMLReturns
 	fake.recordInvocation("HTML", []interface{}{})
 	fake.hTMLMutex.Unlock()
-	if fake.HTMLStub != nil {
-		return fake.HTMLStub()
+	if stub != nil {
+		return stub()
 	}
 	if specificReturn {
 		return ret.result1
 	}
-	fakeReturns := fake.hTMLReturns
 	return fakeReturns.result1
 }
 
@@ -264,32 +308,32 @@ func (fake *FakeMail) HTMLCallCount() int {
 	return len(fake.hTMLArgsForCall)
 }
 
-func (fake *FakeMail) HTMLCalls(stub func() *mailyak.BodyPart) {
+func (fake *FakeMail) HTMLCalls(stub func() *out.BodyPart) {
 	fake.hTMLMutex.Lock()
 	defer fake.hTMLMutex.Unlock()
 	fake.HTMLStub = stub
 }
 
-func (fake *FakeMail) HTMLReturns(result1 *mailyak.BodyPart) {
+func (fake *FakeMail) HTMLReturns(result1 *out.BodyPart) {
 	fake.hTMLMutex.Lock()
 	defer fake.hTMLMutex.Unlock()
 	fake.HTMLStub = nil
 	fake.hTMLReturns = struct {
-		result1 *mailyak.BodyPart
+		result1 *out.BodyPart
 	}{result1}
 }
 
-func (fake *FakeMail) HTMLReturnsOnCall(i int, result1 *mailyak.BodyPart) {
+func (fake *FakeMail) HTMLReturnsOnCall(i int, result1 *out.BodyPart) {
 	fake.hTMLMutex.Lock()
 	defer fake.hTMLMutex.Unlock()
 	fake.HTMLStub = nil
 	if fake.hTMLReturnsOnCall == nil {
 		fake.hTMLReturnsOnCall = make(map[int]struct {
-			result1 *mailyak.BodyPart
+			result1 *out.BodyPart
 		})
 	}
 	fake.hTMLReturnsOnCall[i] = struct {
-		result1 *mailyak.BodyPart
+		result1 *out.BodyPart
 	}{result1}
 }
 
@@ -298,15 +342,16 @@ func (fake *FakeMail) MimeBuf() (*bytes.Buffer, error) {
 	ret, specificReturn := fake.mimeBufReturnsOnCall[len(fake.mimeBufArgsForCall)]
 	fake.mimeBufArgsForCall = append(fake.mimeBufArgsForCall, struct {
 	}{})
+	stub := fake.MimeBufStub
+	fakeReturns := fake.mimeBufReturns
 	fake.recordInvocation("MimeBuf", []interface{}{})
 	fake.mimeBufMutex.Unlock()
-	if fake.MimeBufStub != nil {
-		return fake.MimeBufStub()
+	if stub != nil {
+		return stub()
 	}
 	if specificReturn {
 		return ret.result1, ret.result2
 	}
-	fakeReturns := fake.mimeBufReturns
 	return fakeReturns.result1, fakeReturns.result2
 }
 
@@ -348,20 +393,21 @@ func (fake *FakeMail) MimeBufReturnsOnCall(i int, result1 *bytes.Buffer, result2
 	}{result1, result2}
 }
 
-func (fake *FakeMail) Plain() *mailyak.BodyPart {
+func (fake *FakeMail) Plain() *out.BodyPart {
 	fake.plainMutex.Lock()
 	ret, specificReturn := fake.plainReturnsOnCall[len(fake.plainArgsForCall)]
 	fake.plainArgsForCall = append(fake.plainArgsForCall, struct {
 	}{})
+	stub := fake.PlainStub
+	fakeReturns := fake.plainReturns
 	fake.recordInvocation("Plain", []interface{}{})
 	fake.plainMutex.Unlock()
-	if fake.PlainStub != nil {
-		return fake.PlainStub()
+	if stub != nil {
+		return stub()
 	}
 	if specificReturn {
 		return ret.result1
 	}
-	fakeReturns := fake.plainReturns
 	return fakeReturns.result1
 }
 
@@ -371,32 +417,32 @@ func (fake *FakeMail) PlainCallCount() int {
 	return len(fake.plainArgsForCall)
 }
 
-func (fake *FakeMail) PlainCalls(stub func() *mailyak.BodyPart) {
+func (fake *FakeMail) PlainCalls(stub func() *out.BodyPart) {
 	fake.plainMutex.Lock()
 	defer fake.plainMutex.Unlock()
 	fake.PlainStub = stub
 }
 
-func (fake *FakeMail) PlainReturns(result1 *mailyak.BodyPart) {
+func (fake *FakeMail) PlainReturns(result1 *out.BodyPart) {
 	fake.plainMutex.Lock()
 	defer fake.plainMutex.Unlock()
 	fake.PlainStub = nil
 	fake.plainReturns = struct {
-		result1 *mailyak.BodyPart
+		result1 *out.BodyPart
 	}{result1}
 }
 
-func (fake *FakeMail) PlainReturnsOnCall(i int, result1 *mailyak.BodyPart) {
+func (fake *FakeMail) PlainReturnsOnCall(i int, result1 *out.BodyPart) {
 	fake.plainMutex.Lock()
 	defer fake.plainMutex.Unlock()
 	fake.PlainStub = nil
 	if fake.plainReturnsOnCall == nil {
 		fake.plainReturnsOnCall = make(map[int]struct {
-			result1 *mailyak.BodyPart
+			result1 *out.BodyPart
 		})
 	}
 	fake.plainReturnsOnCall[i] = struct {
-		result1 *mailyak.BodyPart
+		result1 *out.BodyPart
 	}{result1}
 }
 
@@ -405,9 +451,10 @@ func (fake *FakeMail) Subject(arg1 string) {
 	fake.subjectArgsForCall = append(fake.subjectArgsForCall, struct {
 		arg1 string
 	}{arg1})
+	stub := fake.SubjectStub
 	fake.recordInvocation("Subject", []interface{}{arg1})
 	fake.subjectMutex.Unlock()
-	if fake.SubjectStub != nil {
+	if stub != nil {
 		fake.SubjectStub(arg1)
 	}
 }
@@ -436,9 +483,10 @@ func (fake *FakeMail) To(arg1 ...string) {
 	fake.toArgsForCall = append(fake.toArgsForCall, struct {
 		arg1 []string
 	}{arg1})
+	stub := fake.ToStub
 	fake.recordInvocation("To", []interface{}{arg1})
 	fake.toMutex.Unlock()
-	if fake.ToStub != nil {
+	if stub != nil {
 		fake.ToStub(arg1...)
 	}
 }
@@ -469,6 +517,8 @@ func (fake *FakeMail) Invocations() map[string][][]interface{} {
 	defer fake.addHeaderMutex.RUnlock()
 	fake.attachMutex.RLock()
 	defer fake.attachMutex.RUnlock()
+	fake.attachInlineMutex.RLock()
+	defer fake.attachInlineMutex.RUnlock()
 	fake.bccMutex.RLock()
 	defer fake.bccMutex.RUnlock()
 	fake.ccMutex.RLock()
@@ -1,18 +1,126 @@
 package out_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
 
 	"bitbucket.org/chrj/smtpd"
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
+// runOut runs out with inputs as its JSON input.
+func runOut(sourceRoot string, inputs out.Input) (string, error) {
+	inputBytes, err := json.Marshal(inputs)
+	Expect(err).NotTo(HaveOccurred())
+	return out.Execute(sourceRoot, "", inputBytes)
+}
+
+// decodeVersionMessage reverses the gzip and base64 encoding of the message
+// recorded in the version.
+func decodeVersionMessage(encoded string) string {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	Expect(err).NotTo(HaveOccurred())
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	Expect(err).NotTo(HaveOccurred())
+	message, err := ioutil.ReadAll(zr)
+	Expect(err).NotTo(HaveOccurred())
+	return string(message)
+}
+
+// outFixture - the sources directory and inputs of a spec that sends a
+// "Build passed" notification through out, and the SMTP server it is sent to
+// when there is one. Every spec gets a new one.
+type outFixture struct {
+	sourceRoot string
+	inputs     out.Input
+	smtpServer *FakeSMTPServer
+}
+
+// newOutFixture registers the BeforeEach and AfterEach blocks setting up and
+// removing the fixture of each spec in the calling container. The inputs send
+// from the build bot with a plain and an HTML body, but have no recipients or
+// transport.
+func newOutFixture() *outFixture {
+	fixture := &outFixture{}
+	BeforeEach(func() {
+		var err error
+		fixture.sourceRoot, err = ioutil.TempDir("", "sources")
+		Expect(err).NotTo(HaveOccurred())
+
+		fixture.inputs = out.Input{}
+		fixture.inputs.Source.From = "Build Bot <bot@example.com>"
+		fixture.inputs.Params.SubjectText = "Build passed"
+		fixture.inputs.Params.BodyText = "the build passed"
+		fixture.inputs.Params.HTMLBodyText = "<p>the build <b>passed</b></p>"
+	})
+	AfterEach(func() {
+		os.RemoveAll(fixture.sourceRoot)
+	})
+	return fixture
+}
+
+// newSMTPOutFixture is newOutFixture with a fake SMTP server the inputs
+// authenticate to and send through.
+func newSMTPOutFixture() *outFixture {
+	fixture := newOutFixture()
+	BeforeEach(func() {
+		fixture.smtpServer = NewFakeSMTPServerWithCustomCert("./test_certs/server.crt", "./test_certs/server.key")
+		fixture.smtpServer.Boot()
+
+		fixture.inputs.Source.SMTP.Username = "some username"
+		fixture.inputs.Source.SMTP.Password = "some password"
+		fixture.inputs.Source.SMTP.Host = fixture.smtpServer.Host
+		fixture.inputs.Source.SMTP.Port = fixture.smtpServer.Port
+		fixture.inputs.Source.SMTP.SkipSSLValidation = true
+	})
+	AfterEach(func() {
+		fixture.smtpServer.Close()
+	})
+	return fixture
+}
+
+// run runs out with the inputs of the fixture.
+func (f *outFixture) run() (string, error) {
+	return runOut(f.sourceRoot, f.inputs)
+}
+
+// delivered returns the single message the SMTP server received. The server
+// stores lines ending in LF, the message is returned in the canonical CRLF
+// form signatures are made over.
+func (f *outFixture) delivered() []byte {
+	Expect(f.smtpServer.Deliveries).To(HaveLen(1))
+	return bytes.Replace(f.smtpServer.Deliveries[0].Data, []byte("\n"), []byte("\r\n"), -1)
+}
+
+// deliveredMessage parses the message returned by delivered.
+func (f *outFixture) deliveredMessage() *mail.Message {
+	message, err := mail.ReadMessage(bytes.NewReader(f.delivered()))
+	Expect(err).NotTo(HaveOccurred())
+	return message
+}
+
 type FakeSMTPServer struct {
-	listener   net.Listener
-	server     *smtpd.Server
-	Deliveries []smtpd.Envelope
-	Host       string
-	Port       string
+	listener    net.Listener
+	server      *smtpd.Server
+	implicitTLS *tls.Config
+	Deliveries  []smtpd.Envelope
+	Peers       []smtpd.Peer
+	Host        string
+	Port        string
 }
 
 func newFakeSMPTServer(tlsConfig *tls.Config) *FakeSMTPServer {
@@ -20,23 +128,71 @@ func newFakeSMPTServer(tlsConfig *tls.Config) *FakeSMTPServer {
 		server: &smtpd.Server{
 			Hostname:  "127.0.0.1:0",
 			TLSConfig: tlsConfig,
+			Authenticator: func(peer smtpd.Peer, username, password string) error {
+				return nil
+			},
 		},
 		Deliveries: make([]smtpd.Envelope, 0),
 	}
 }
 
+// DisableAuth stops the server from advertising AUTH. It must be called
+// before Boot.
+func (s *FakeSMTPServer) DisableAuth() {
+	s.server.Authenticator = nil
+}
+
+// RejectRecipients makes the server reject the given recipients with a 550
+// reply. It must be called before Boot.
+func (s *FakeSMTPServer) RejectRecipients(addrs ...string) {
+	s.server.RecipientChecker = func(peer smtpd.Peer, addr string) error {
+		for _, rejected := range addrs {
+			if addr == rejected {
+				return smtpd.Error{Code: 550, Message: "mailbox unavailable"}
+			}
+		}
+		return nil
+	}
+}
+
 func NewFakeSMTPServer() *FakeSMTPServer {
 	return newFakeSMPTServer(nil)
 }
 
 func NewFakeSMTPServerWithCustomCert(crt string, key string) *FakeSMTPServer {
+	return newFakeSMPTServer(loadServerTLSConfig(crt, key))
+}
+
+func NewFakeSMTPServerWithImplicitTLS(crt string, key string) *FakeSMTPServer {
+	server := newFakeSMPTServer(nil)
+	server.implicitTLS = loadServerTLSConfig(crt, key)
+	return server
+}
+
+func loadServerTLSConfig(crt string, key string) *tls.Config {
 	cert, err := tls.LoadX509KeyPair(crt, key)
 	if err != nil {
 		panic(err)
 	}
-	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// RequireClientCert makes the server reject TLS clients that do not present a
+// certificate signed by the CA in caFile. It must be called before Boot.
+func (s *FakeSMTPServer) RequireClientCert(caFile string) {
+	caCert, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		panic(err)
+	}
+	caPool := x509.NewCertPool()
+	caPool.AppendCertsFromPEM(caCert)
 
-	return newFakeSMPTServer(config)
+	for _, config := range []*tls.Config{s.server.TLSConfig, s.implicitTLS} {
+		if config != nil {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+			config.ClientCAs = caPool
+		}
+	}
 }
 
 func (s *FakeSMTPServer) Boot() {
@@ -45,15 +201,20 @@ func (s *FakeSMTPServer) Boot() {
 	if err != nil {
 		panic(err)
 	}
+	addr := s.listener.Addr().String()
+
+	if s.implicitTLS != nil {
+		s.listener = tls.NewListener(s.listener, s.implicitTLS)
+	}
 
 	s.server.Handler = func(peer smtpd.Peer, env smtpd.Envelope) error {
 		s.Deliveries = append(s.Deliveries, env)
+		s.Peers = append(s.Peers, peer)
 		return nil
 	}
 
 	go s.server.Serve(s.listener)
 
-	addr := s.listener.Addr().String()
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		panic(err)
@@ -65,3 +226,144 @@ func (s *FakeSMTPServer) Boot() {
 func (s *FakeSMTPServer) Close() {
 	s.listener.Close()
 }
+
+// FakeSASLServer is a minimal cleartext SMTP server that advertises arbitrary
+// AUTH mechanisms and extensions, for exercising mechanisms and extensions
+// the smtpd package does not implement. It records the mechanism, the decoded
+// client response and the MAIL and RCPT commands.
+type FakeSASLServer struct {
+	listener      net.Listener
+	Mechanisms    []string
+	Extensions    []string
+	Commands      []string
+	Challenge     string
+	AuthMechanism string
+	AuthResponse  string
+	Deliveries    int
+	Host          string
+	Port          string
+	// TransientFailures is the number of MAIL commands to reply to with a
+	// temporary 451 failure before accepting them.
+	TransientFailures int
+	// StallOn is a command the server never replies to.
+	StallOn string
+	// DroppedDeliveries is the number of messages to receive and then close
+	// the connection on without replying.
+	DroppedDeliveries int
+	// mu guards Deliveries, as nothing else orders counting a dropped
+	// delivery before the client sees the connection close.
+	mu sync.Mutex
+}
+
+func NewFakeSASLServer(mechanisms ...string) *FakeSASLServer {
+	return &FakeSASLServer{
+		Mechanisms: mechanisms,
+		Challenge:  "<1896.697170952@fake.example.com>",
+	}
+}
+
+func (s *FakeSASLServer) Boot() {
+	var err error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	s.Host, s.Port, err = net.SplitHostPort(s.listener.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(textproto.NewConn(conn))
+		}
+	}()
+}
+
+func (s *FakeSASLServer) serve(conn *textproto.Conn) {
+	defer conn.Close()
+
+	conn.PrintfLine("220 fake ESMTP ready")
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			conn.PrintfLine("500 empty command")
+			continue
+		}
+		if strings.EqualFold(fields[0], s.StallOn) {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "EHLO":
+			lines := append([]string{"fake"}, s.Extensions...)
+			if len(s.Mechanisms) > 0 {
+				lines = append(lines, "AUTH "+strings.Join(s.Mechanisms, " "))
+			}
+			for _, l := range lines[:len(lines)-1] {
+				conn.PrintfLine("250-%s", l)
+			}
+			conn.PrintfLine("250 %s", lines[len(lines)-1])
+		case "AUTH":
+			s.AuthMechanism = strings.ToUpper(fields[1])
+			var response string
+			switch {
+			case s.AuthMechanism == "CRAM-MD5":
+				conn.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(s.Challenge)))
+				response, _ = conn.ReadLine()
+			case len(fields) > 2:
+				response = fields[2]
+			default:
+				conn.PrintfLine("334 ")
+				response, _ = conn.ReadLine()
+			}
+			decoded, _ := base64.StdEncoding.DecodeString(response)
+			s.AuthResponse = string(decoded)
+			conn.PrintfLine("235 2.7.0 Authentication successful")
+		case "MAIL", "RCPT":
+			s.Commands = append(s.Commands, line)
+			if strings.ToUpper(fields[0]) == "MAIL" && s.TransientFailures > 0 {
+				s.TransientFailures--
+				conn.PrintfLine("451 4.3.0 Try again later")
+				continue
+			}
+			conn.PrintfLine("250 OK")
+		case "RSET", "NOOP":
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			conn.PrintfLine("354 Go ahead")
+			ioutil.ReadAll(conn.DotReader())
+			s.mu.Lock()
+			s.Deliveries++
+			s.mu.Unlock()
+			if s.DroppedDeliveries > 0 {
+				s.DroppedDeliveries--
+				return
+			}
+			conn.PrintfLine("250 OK")
+		case "QUIT":
+			conn.PrintfLine("221 Bye")
+			return
+		default:
+			conn.PrintfLine("502 %s not implemented", fields[0])
+		}
+	}
+}
+
+// DeliveryCount returns Deliveries, synchronized with the server.
+func (s *FakeSASLServer) DeliveryCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Deliveries
+}
+
+func (s *FakeSASLServer) Close() {
+	s.listener.Close()
+}
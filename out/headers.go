@@ -0,0 +1,130 @@
+package out
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Header - a header field of the message
+type Header struct {
+	Name  string
+	Value string
+}
+
+// ParseHeaders parses header fields in the RFC 5322 "Name: value" format, one
+// per line. Lines starting with whitespace continue the previous field, the
+// same name may appear more than once, and blank lines and lines starting with
+// # are ignored. Errors name the offending line.
+func ParseHeaders(r io.Reader) ([]Header, error) {
+	var headers []Header
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			continue
+		case line[0] == ' ' || line[0] == '\t':
+			if len(headers) == 0 {
+				return nil, errors.Errorf("line %d: continuation line %q does not follow a header", lineNumber, line)
+			}
+			last := &headers[len(headers)-1]
+			last.Value = strings.TrimSpace(last.Value + line)
+			continue
+		case line[0] == '#':
+			continue
+		}
+
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, errors.Errorf(`line %d: expected "Name: value" but got %q`, lineNumber, line)
+		}
+		name := line[:colon]
+		if err := validateHeaderName(name); err != nil {
+			return nil, errors.Wrapf(err, "line %d", lineNumber)
+		}
+		headers = append(headers, Header{Name: name, Value: strings.TrimSpace(line[colon+1:])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "unable to read headers")
+	}
+	return headers, nil
+}
+
+// validateHeaderName checks that name only consists of the printable ASCII
+// characters RFC 5322 allows in field names.
+func validateHeaderName(name string) error {
+	if name == "" {
+		return errors.New("header name is empty")
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 || c == ':' {
+			return errors.Errorf("invalid header name %q, names may only contain printable ASCII characters other than spaces and colons", name)
+		}
+	}
+	return nil
+}
+
+// HeadersFromMap returns the headers of a map of header names to a value or a
+// list of values. Headers are ordered by name, and the values of a list in
+// the order given.
+func HeadersFromMap(m map[string]interface{}) ([]Header, error) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var headers []Header
+	for _, name := range names {
+		if err := validateHeaderName(name); err != nil {
+			return nil, err
+		}
+		values, ok := m[name].([]interface{})
+		if !ok {
+			values = []interface{}{m[name]}
+		}
+		for _, value := range values {
+			text, err := headerValue(name, value)
+			if err != nil {
+				return nil, err
+			}
+			headers = append(headers, Header{Name: name, Value: text})
+		}
+	}
+	return headers, nil
+}
+
+func headerValue(name string, value interface{}) (string, error) {
+	var text string
+	switch v := value.(type) {
+	case string:
+		text = v
+	case float64:
+		// JSON numbers are decoded as float64, formatted without an exponent
+		// so build and ticket numbers stay as given
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		text = strconv.FormatBool(v)
+	default:
+		return "", errors.Errorf("value of header %s must be a string or a list of strings", name)
+	}
+	if err := checkHeaderValue(name, text); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// checkHeaderValue rejects values with line breaks, which would end the
+// header block early or add headers of their own.
+func checkHeaderValue(name, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.Errorf("value of header %s contains a line break", name)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package out_test
+
+import (
+	"strings"
+
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseHeaders", func() {
+	parse := func(text string) ([]out.Header, error) {
+		return out.ParseHeaders(strings.NewReader(text))
+	}
+
+	It("parses one header per line", func() {
+		headers, err := parse("X-First: 1\nX-Second:2\r\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(Equal([]out.Header{{Name: "X-First", Value: "1"}, {Name: "X-Second", Value: "2"}}))
+	})
+
+	It("keeps colons within values", func() {
+		headers, err := parse("X-Link: <https://example.com/a: b>")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(Equal([]out.Header{{Name: "X-Link", Value: "<https://example.com/a: b>"}}))
+	})
+
+	It("unfolds continuation lines", func() {
+		headers, err := parse("List-Unsubscribe: <mailto:leave@example.com>,\n <https://example.com/leave>\nX-Other: value")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(Equal([]out.Header{
+			{Name: "List-Unsubscribe", Value: "<mailto:leave@example.com>, <https://example.com/leave>"},
+			{Name: "X-Other", Value: "value"},
+		}))
+	})
+
+	It("keeps every value of repeated headers in order", func() {
+		headers, err := parse("X-Tag: a\nX-Other: b\nX-Tag: c")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(Equal([]out.Header{{Name: "X-Tag", Value: "a"}, {Name: "X-Other", Value: "b"}, {Name: "X-Tag", Value: "c"}}))
+	})
+
+	It("ignores blank lines and comments", func() {
+		headers, err := parse("# generated by the release task\n\nX-Release: 1.0\n\n\n")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(Equal([]out.Header{{Name: "X-Release", Value: "1.0"}}))
+	})
+
+	It("allows empty values", func() {
+		headers, err := parse("X-Empty:")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(Equal([]out.Header{{Name: "X-Empty", Value: ""}}))
+	})
+
+	It("rejects lines without a colon", func() {
+		_, err := parse("X-Good: 1\nnot a header")
+		Expect(err).To(MatchError(`line 2: expected "Name: value" but got "not a header"`))
+	})
+
+	It("rejects invalid header names", func() {
+		_, err := parse("X-Good: 1\n\nX Bad: 2")
+		Expect(err).To(MatchError(`line 3: invalid header name "X Bad", names may only contain printable ASCII characters other than spaces and colons`))
+	})
+
+	It("rejects empty header names", func() {
+		_, err := parse(": value")
+		Expect(err).To(MatchError("line 1: header name is empty"))
+	})
+
+	It("rejects continuation lines before the first header", func() {
+		_, err := parse("  folded\nX-Good: 1")
+		Expect(err).To(MatchError(`line 1: continuation line "  folded" does not follow a header`))
+	})
+})
+
+var _ = Describe("HeadersFromMap", func() {
+	It("orders headers by name and keeps the order of list values", func() {
+		headers, err := out.HeadersFromMap(map[string]interface{}{
+			"X-Tag":      []interface{}{"b", "a"},
+			"List-Id":    "builds.example.com",
+			"X-Priority": float64(1),
+			"X-Auto":     true,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(Equal([]out.Header{
+			{Name: "List-Id", Value: "builds.example.com"},
+			{Name: "X-Auto", Value: "true"},
+			{Name: "X-Priority", Value: "1"},
+			{Name: "X-Tag", Value: "b"},
+			{Name: "X-Tag", Value: "a"},
+		}))
+	})
+
+	It("formats large numbers without an exponent", func() {
+		headers, err := out.HeadersFromMap(map[string]interface{}{"X-Build": float64(1234567), "X-Ratio": 0.25})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(headers).To(Equal([]out.Header{
+			{Name: "X-Build", Value: "1234567"},
+			{Name: "X-Ratio", Value: "0.25"},
+		}))
+	})
+
+	It("rejects invalid header names", func() {
+		_, err := out.HeadersFromMap(map[string]interface{}{"X Bad": "value"})
+		Expect(err).To(MatchError(`invalid header name "X Bad", names may only contain printable ASCII characters other than spaces and colons`))
+	})
+
+	It("rejects values that are not strings", func() {
+		_, err := out.HeadersFromMap(map[string]interface{}{"X-Nested": map[string]interface{}{"a": "b"}})
+		Expect(err).To(MatchError("value of header X-Nested must be a string or a list of strings"))
+	})
+
+	It("rejects values with line breaks", func() {
+		_, err := out.HeadersFromMap(map[string]interface{}{"X-Injected": "a\r\nBcc: victim@example.com"})
+		Expect(err).To(MatchError("value of header X-Injected contains a line break"))
+	})
+})
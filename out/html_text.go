@@ -0,0 +1,222 @@
+package out
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText renders an HTML body as plain text for clients that do not
+// display HTML. Block elements start new lines, list items are bulleted and
+// links are followed by their target.
+func HTMLToText(body string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return body
+	}
+	t := &textRenderer{}
+	t.render(doc)
+	return t.String()
+}
+
+type textRenderer struct {
+	lines   []string
+	current strings.Builder
+	pre     int
+	lists   []int
+}
+
+func (t *textRenderer) String() string {
+	t.breakLine()
+	// drop leading, trailing and repeated blank lines
+	var out []string
+	for _, line := range t.lines {
+		if line == "" && (len(out) == 0 || out[len(out)-1] == "") {
+			continue
+		}
+		out = append(out, line)
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return strings.Join(out, "\n")
+}
+
+// breakLine ends the current line, if there is one.
+func (t *textRenderer) breakLine() {
+	if t.current.Len() > 0 {
+		t.lines = append(t.lines, strings.TrimRight(t.current.String(), " "))
+		t.current.Reset()
+	}
+}
+
+// paragraph ends the current line and leaves a blank line.
+func (t *textRenderer) paragraph() {
+	t.breakLine()
+	t.lines = append(t.lines, "")
+}
+
+func (t *textRenderer) write(text string) {
+	if t.pre > 0 {
+		for i, line := range strings.Split(text, "\n") {
+			if i > 0 {
+				t.lines = append(t.lines, t.current.String())
+				t.current.Reset()
+			}
+			t.current.WriteString(line)
+		}
+		return
+	}
+
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		if text != "" && t.current.Len() > 0 {
+			t.current.WriteString(" ")
+		}
+		return
+	}
+	if t.current.Len() > 0 && startsWithSpace(text) && !strings.HasSuffix(t.current.String(), " ") {
+		t.current.WriteString(" ")
+	}
+	t.current.WriteString(strings.Join(words, " "))
+	if endsWithSpace(text) {
+		t.current.WriteString(" ")
+	}
+}
+
+func (t *textRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		t.write(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		t.renderChildren(n)
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Template:
+		return
+	case atom.Br:
+		if t.current.Len() == 0 {
+			t.lines = append(t.lines, "")
+		}
+		t.breakLine()
+	case atom.Hr:
+		t.paragraph()
+		t.lines = append(t.lines, "---", "")
+	case atom.Img:
+		if alt := attr(n, "alt"); alt != "" {
+			t.write(alt)
+		}
+	case atom.A:
+		before := t.current.Len()
+		t.renderChildren(n)
+		href := attr(n, "href")
+		text := strings.TrimSpace(t.current.String()[min(before, t.current.Len()):])
+		if href != "" && !strings.HasPrefix(href, "#") && href != text && "mailto:"+text != href {
+			t.write(fmt.Sprintf(" (%s)", href))
+		}
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		t.paragraph()
+		before := len(t.lines)
+		t.renderChildren(n)
+		t.breakLine()
+		if n.DataAtom == atom.H1 || n.DataAtom == atom.H2 {
+			underline := "="
+			if n.DataAtom == atom.H2 {
+				underline = "-"
+			}
+			if len(t.lines) > before {
+				t.lines = append(t.lines, strings.Repeat(underline, len([]rune(t.lines[len(t.lines)-1]))))
+			}
+		}
+		t.paragraph()
+	case atom.P, atom.Div, atom.Blockquote, atom.Table, atom.Section, atom.Article, atom.Header, atom.Footer:
+		t.paragraph()
+		t.renderChildren(n)
+		t.paragraph()
+	case atom.Pre:
+		t.paragraph()
+		t.pre++
+		t.renderChildren(n)
+		t.pre--
+		t.paragraph()
+	case atom.Ul, atom.Ol:
+		if len(t.lists) == 0 {
+			t.paragraph()
+		} else {
+			t.breakLine()
+		}
+		counter := 0
+		if n.DataAtom == atom.Ul {
+			counter = -1
+		}
+		t.lists = append(t.lists, counter)
+		t.renderChildren(n)
+		t.lists = t.lists[:len(t.lists)-1]
+		if len(t.lists) == 0 {
+			t.paragraph()
+		} else {
+			t.breakLine()
+		}
+	case atom.Li:
+		t.breakLine()
+		bullet := "* "
+		if depth := len(t.lists); depth > 0 {
+			if t.lists[depth-1] >= 0 {
+				t.lists[depth-1]++
+				bullet = fmt.Sprintf("%d. ", t.lists[depth-1])
+			}
+			t.current.WriteString(strings.Repeat("  ", depth-1))
+		}
+		t.current.WriteString(bullet)
+		t.renderChildren(n)
+		t.breakLine()
+	case atom.Tr:
+		t.breakLine()
+		t.renderChildren(n)
+		t.breakLine()
+	case atom.Td, atom.Th:
+		if t.current.Len() > 0 && !strings.HasSuffix(t.current.String(), " ") {
+			t.current.WriteString(" ")
+		}
+		t.renderChildren(n)
+		t.current.WriteString(" ")
+	default:
+		t.renderChildren(n)
+	}
+}
+
+func (t *textRenderer) renderChildren(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		t.render(c)
+	}
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func startsWithSpace(s string) bool {
+	return s != "" && strings.ContainsAny(s[:1], " \t\r\n")
+}
+
+func endsWithSpace(s string) bool {
+	return s != "" && strings.ContainsAny(s[len(s)-1:], " \t\r\n")
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
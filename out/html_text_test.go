@@ -0,0 +1,49 @@
+package out_test
+
+import (
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTMLToText", func() {
+	It("separates paragraphs and collapses whitespace", func() {
+		Expect(out.HTMLToText("<p>The   build\n  passed.</p><p>All good.</p>")).To(Equal("The build passed.\n\nAll good."))
+	})
+
+	It("skips the head, scripts and styles", func() {
+		html := "<html><head><title>Report</title><style>p { color: red; }</style></head><body><script>alert(1)</script><p>Body</p></body></html>"
+		Expect(out.HTMLToText(html)).To(Equal("Body"))
+	})
+
+	It("underlines top level headings", func() {
+		Expect(out.HTMLToText("<h1>Release</h1><h2>Fixes</h2><h3>Details</h3>")).To(Equal("Release\n=======\n\nFixes\n-----\n\nDetails"))
+	})
+
+	It("follows links with their target", func() {
+		Expect(out.HTMLToText(`<p>See <a href="https://ci.example.com/builds/1">the build</a>.</p>`)).To(Equal("See the build (https://ci.example.com/builds/1)."))
+	})
+
+	It("does not repeat link targets that are the link text", func() {
+		Expect(out.HTMLToText(`<a href="https://example.com">https://example.com</a>`)).To(Equal("https://example.com"))
+	})
+
+	It("bullets and numbers list items", func() {
+		html := "<ul><li>one</li><li>two<ol><li>first</li><li>second</li></ol></li></ul>"
+		Expect(out.HTMLToText(html)).To(Equal("* one\n* two\n  1. first\n  2. second"))
+	})
+
+	It("keeps preformatted text", func() {
+		Expect(out.HTMLToText("<pre>line 1\n  line 2</pre>")).To(Equal("line 1\n  line 2"))
+	})
+
+	It("puts table rows on their own lines", func() {
+		html := "<table><tr><th>Job</th><th>Status</th></tr><tr><td>unit</td><td>passed</td></tr></table>"
+		Expect(out.HTMLToText(html)).To(Equal("Job Status\nunit passed"))
+	})
+
+	It("breaks lines and uses image alt text", func() {
+		Expect(out.HTMLToText(`first<br>second <img src="badge.png" alt="[passing]">`)).To(Equal("first\nsecond [passing]"))
+	})
+})
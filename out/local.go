@@ -0,0 +1,237 @@
+package out
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// mboxFromLine matches the lines mboxrd quotes with a ">", so they are not
+// read as the From_ line of the next message.
+var mboxFromLine = regexp.MustCompile(`(?m)^>*From `)
+
+func (config Maildir) validate() error {
+	if config.Path == "" {
+		return errors.New(`missing required field "source.maildir.path"`)
+	}
+	return nil
+}
+
+func (config Mbox) validate() error {
+	if config.Path == "" {
+		return errors.New(`missing required field "source.mbox.path"`)
+	}
+	return nil
+}
+
+func (config Pickup) validate() error {
+	if config.Path == "" {
+		return errors.New(`missing required field "source.pickup.path"`)
+	}
+	return nil
+}
+
+// localTransport - delivers messages into a Maildir, an mbox file or the
+// pickup directory of a local MTA, without connecting to any server
+type localTransport struct {
+	kind      string
+	path      string
+	from      string
+	to        []string
+	delivered string
+}
+
+// newLocalTransport returns a transport writing to the path configured for
+// the transport of source. Relative paths are relative to sourceRoot.
+func newLocalTransport(source Source, sourceRoot, from string, to []string) (*localTransport, error) {
+	t := &localTransport{kind: source.transport(), from: from, to: to}
+	switch t.kind {
+	case TransportMaildir:
+		t.path = source.Maildir.Path
+	case TransportMbox:
+		t.path = source.Mbox.Path
+	case TransportPickup:
+		t.path = source.Pickup.Path
+	default:
+		return nil, errors.Errorf("unknown transport %q", t.kind)
+	}
+	if !filepath.IsAbs(t.path) {
+		t.path = filepath.Join(sourceRoot, t.path)
+	}
+	return t, nil
+}
+
+func (t *localTransport) Send(msg []byte) ([]RecipientStatus, error) {
+	var err error
+	switch t.kind {
+	case TransportMaildir:
+		t.delivered, err = deliverToMaildir(t.path, msg)
+	case TransportMbox:
+		t.delivered, err = appendToMbox(t.path, t.from, msg)
+	case TransportPickup:
+		t.delivered, err = writeToPickup(t.path, t.from, t.to, msg)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to deliver to %s", t.kind)
+	}
+
+	statuses := make([]RecipientStatus, 0, len(t.to))
+	for _, addr := range t.to {
+		statuses = append(statuses, RecipientStatus{Address: addr, Accepted: true, Message: "delivered to " + t.kind})
+	}
+	return statuses, nil
+}
+
+func (t *localTransport) DeliveredBy() string {
+	return t.delivered
+}
+
+// deliverToMaildir writes msg into tmp/ of the Maildir at dir and then moves
+// it into new/, creating the Maildir if needed. Messages in a Maildir end
+// lines in LF.
+func deliverToMaildir(dir string, msg []byte) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+	name, err := maildirName()
+	if err != nil {
+		return "", err
+	}
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := writeFileSync(tmp, lf(msg), 0600); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	delivered := filepath.Join(dir, "new", name)
+	if err := os.Rename(tmp, delivered); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return delivered, nil
+}
+
+// maildirName returns a unique file name of the form
+// time.MusecPpidRrandom.host.
+func maildirName() (string, error) {
+	random, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), random, host), nil
+}
+
+// appendToMbox appends msg to the mbox file at path in the mboxrd format: a
+// From_ line with the envelope sender, the message with LF line endings and
+// every line matching >*From quoted with one more ">", and an empty line.
+func appendToMbox(path, from string, msg []byte) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	body := mboxFromLine.ReplaceAllFunc(lf(msg), func(line []byte) []byte {
+		return append([]byte(">"), line...)
+	})
+	if !bytes.HasSuffix(body, []byte("\n")) {
+		body = append(body, '\n')
+	}
+
+	entry := &bytes.Buffer{}
+	fmt.Fprintf(entry, "From %s %s\n", from, time.Now().UTC().Format(time.ANSIC))
+	entry.Write(body)
+	entry.WriteString("\n")
+
+	// The entry is written in one append, so concurrent deliveries do not
+	// interleave.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(entry.Bytes()); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writeToPickup writes msg as an .eml file into the pickup directory dir,
+// preceded by X-Sender and X-Receiver header fields holding the envelope, as
+// read by the IIS SMTP service and Exchange. The file is written under a name
+// the MTA ignores and renamed once complete, so it is never picked up half
+// written.
+func writeToPickup(dir, from string, to []string, msg []byte) (string, error) {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", errors.Errorf("pickup directory %s does not exist", dir)
+	}
+	random, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	file := &bytes.Buffer{}
+	fmt.Fprintf(file, "X-Sender: %s\r\n", from)
+	for _, addr := range to {
+		fmt.Fprintf(file, "X-Receiver: %s\r\n", addr)
+	}
+	file.Write(msg)
+
+	tmp := filepath.Join(dir, random+".tmp")
+	if err := writeFileSync(tmp, file.Bytes(), 0644); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	delivered := filepath.Join(dir, random+".eml")
+	if err := os.Rename(tmp, delivered); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return delivered, nil
+}
+
+// writeFileSync writes data to a new file at path and syncs it to disk before
+// it is renamed into place.
+func writeFileSync(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "unable to generate file name")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// lf converts the line endings of msg to LF.
+func lf(msg []byte) []byte {
+	return bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)
+}
@@ -0,0 +1,174 @@
+package out_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Local transports", func() {
+	fixture := newOutFixture()
+	var deliveryRoot string
+
+	execute := func() out.Output {
+		output, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+		var outdata out.Output
+		Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+		return outdata
+	}
+
+	versionMessage := func(outdata out.Output) string {
+		return decodeVersionMessage(outdata.Version.Message)
+	}
+
+	deliveredBy := func(outdata out.Output) string {
+		for _, item := range outdata.Metadata {
+			if item.Name == "delivered_by" {
+				return item.Value
+			}
+		}
+		Fail("no delivered_by metadata")
+		return ""
+	}
+
+	BeforeEach(func() {
+		var err error
+		deliveryRoot, err = ioutil.TempDir("", "deliveries")
+		Expect(err).NotTo(HaveOccurred())
+
+		fixture.inputs.Source.To = []string{"Jane Doe <jane@example.com>"}
+		fixture.inputs.Source.Bcc = []string{"audit@example.com"}
+		fixture.inputs.Params.BodyText = "the build passed\nFrom the pipeline\n>From a quote"
+		fixture.inputs.Params.IncludeMessageInVersion = true
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(deliveryRoot)
+	})
+
+	Describe("Maildir", func() {
+		BeforeEach(func() {
+			fixture.inputs.Source.Transport = "maildir"
+			fixture.inputs.Source.Maildir.Path = filepath.Join(deliveryRoot, "Maildir")
+		})
+
+		It("delivers the message into new/", func() {
+			outdata := execute()
+
+			files, err := filepath.Glob(filepath.Join(deliveryRoot, "Maildir", "new", "*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			Expect(deliveredBy(outdata)).To(Equal(files[0]))
+			Expect(filepath.Base(files[0])).To(MatchRegexp(`^[0-9]+\.M[0-9]+P[0-9]+R[0-9a-f]+\.`))
+
+			contents, err := ioutil.ReadFile(files[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal(strings.Replace(versionMessage(outdata), "\r\n", "\n", -1)))
+
+			for _, sub := range []string{"tmp", "cur"} {
+				entries, err := ioutil.ReadDir(filepath.Join(deliveryRoot, "Maildir", sub))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(entries).To(BeEmpty())
+			}
+
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "transport", Value: "maildir"}))
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "recipient", Value: "jane@example.com: accepted (delivered to maildir)"}))
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "bcc", Value: "1 accepted, 0 rejected"}))
+		})
+
+		It("gives every message its own file", func() {
+			execute()
+			execute()
+
+			files, err := filepath.Glob(filepath.Join(deliveryRoot, "Maildir", "new", "*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(2))
+		})
+
+		It("resolves a relative path against the working directory", func() {
+			fixture.inputs.Source.Maildir.Path = "mail"
+			execute()
+
+			files, err := filepath.Glob(filepath.Join(fixture.sourceRoot, "mail", "new", "*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+		})
+	})
+
+	Describe("mbox", func() {
+		BeforeEach(func() {
+			fixture.inputs.Source.Transport = "mbox"
+			fixture.inputs.Source.Mbox.Path = filepath.Join(deliveryRoot, "mail", "ci.mbox")
+		})
+
+		It("appends every message with a From_ line and quotes From lines in the body", func() {
+			first := execute()
+			second := execute()
+			Expect(deliveredBy(first)).To(Equal(fixture.inputs.Source.Mbox.Path))
+
+			contents, err := ioutil.ReadFile(fixture.inputs.Source.Mbox.Path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).NotTo(ContainSubstring("\r\n"))
+
+			entries := strings.Split(string(contents), "\n\nFrom bot@example.com ")
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0]).To(MatchRegexp(`^From bot@example\.com [A-Z][a-z]{2} [A-Z][a-z]{2} [ 0-9]{2} [0-9:]{8} [0-9]{4}\n`))
+			Expect(entries[1]).To(HaveSuffix("\n\n"))
+
+			for i, outdata := range []out.Output{first, second} {
+				message := strings.Replace(versionMessage(outdata), "\r\n", "\n", -1)
+				Expect(message).To(ContainSubstring("\nFrom the pipeline\n"))
+				quoted := strings.Replace(strings.Replace(message, "\n>From a quote", "\n>>From a quote", 1), "\nFrom the pipeline", "\n>From the pipeline", 1)
+				Expect(entries[i]).To(ContainSubstring("Message-ID: " + outdata.Version.MessageID))
+				Expect(entries[i]).To(ContainSubstring(strings.TrimSuffix(quoted, "\n")))
+			}
+		})
+	})
+
+	Describe("pickup directory", func() {
+		var pickupDir string
+
+		BeforeEach(func() {
+			pickupDir = filepath.Join(deliveryRoot, "Pickup")
+			Expect(os.Mkdir(pickupDir, 0700)).To(Succeed())
+			fixture.inputs.Source.Transport = "pickup"
+			fixture.inputs.Source.Pickup.Path = pickupDir
+		})
+
+		It("writes an .eml file with the envelope in X-Sender and X-Receiver", func() {
+			outdata := execute()
+
+			entries, err := ioutil.ReadDir(pickupDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Name()).To(HaveSuffix(".eml"))
+			Expect(deliveredBy(outdata)).To(Equal(filepath.Join(pickupDir, entries[0].Name())))
+
+			contents, err := ioutil.ReadFile(filepath.Join(pickupDir, entries[0].Name()))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(contents)).To(Equal("X-Sender: bot@example.com\r\nX-Receiver: jane@example.com\r\nX-Receiver: audit@example.com\r\n" + versionMessage(outdata)))
+		})
+
+		It("fails when the pickup directory does not exist", func() {
+			fixture.inputs.Source.Pickup.Path = filepath.Join(deliveryRoot, "Missing")
+			_, err := fixture.run()
+			Expect(err).To(MatchError("unable to deliver to pickup: pickup directory " + fixture.inputs.Source.Pickup.Path + " does not exist"))
+		})
+	})
+
+	Context("when the path is missing", func() {
+		It("fails", func() {
+			fixture.inputs.Source.Transport = "mbox"
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: missing required field "source.mbox.path"`))
+		})
+	})
+})
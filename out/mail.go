@@ -2,12 +2,16 @@ package out
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"net/mail"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/domodwyer/mailyak/v3"
 	"github.com/pkg/errors"
 )
 
@@ -20,23 +24,27 @@ type Mail interface {
 	Subject(string)
 	AddHeader(name, value string)
 	Attach(name string, r io.Reader)
-	Plain() *mailyak.BodyPart
-	HTML() *mailyak.BodyPart
+	AttachInline(name string, r io.Reader)
+	Plain() *BodyPart
+	HTML() *BodyPart
 	MimeBuf() (*bytes.Buffer, error)
 }
 
 type MailCreator struct {
 	Mail                Mail
 	From, Subject, Body string
+	HTMLBody            string
+	MessageID           string
 	To, CC, BCC         []string
-	headers             map[string]string
+	headers             []Header
 	attachments         map[string]io.Reader
+	inlineImages        map[string]io.Reader
 	html                bool
 }
 
 func NewMailCreator() *MailCreator {
 	return &MailCreator{
-		Mail: mailyak.New("", nil),
+		Mail: NewMessage(),
 	}
 }
 func (m *MailCreator) AddAttachment(filePath string) error {
@@ -51,17 +59,37 @@ func (m *MailCreator) AddAttachment(filePath string) error {
 	return nil
 }
 
-func (m *MailCreator) AddHeader(key, value string) {
-	if m.headers == nil {
-		m.headers = make(map[string]string)
+// AddInlineImage embeds the file as an inline part of the HTML body, which
+// can refer to it as cid:<base name of the file>.
+func (m *MailCreator) AddInlineImage(filePath string) error {
+	if err := checkContentID(filepath.Base(filePath)); err != nil {
+		return err
+	}
+	reader, err := os.Open(filePath)
+	if err != nil {
+		return err
 	}
+	if m.inlineImages == nil {
+		m.inlineImages = make(map[string]io.Reader)
+	}
+	m.inlineImages[filepath.Base(reader.Name())] = reader
+	return nil
+}
+
+// AddHeader adds a header to the message. Headers are written in the order
+// they were added and a header added more than once is written more than once.
+func (m *MailCreator) AddHeader(key, value string) {
 	if strings.EqualFold(key, "Content-Type") && strings.Contains(value, "text/html") {
 		m.html = true
 	}
 	if strings.EqualFold(key, "MIME-version") || strings.EqualFold(key, "Content-Type") {
 		return
 	}
-	m.headers[key] = value
+	if strings.EqualFold(key, "Message-ID") {
+		m.MessageID = value
+		return
+	}
+	m.headers = append(m.headers, Header{Name: key, Value: value})
 }
 
 func (m *MailCreator) Compose() ([]byte, error) {
@@ -70,19 +98,31 @@ func (m *MailCreator) Compose() ([]byte, error) {
 	m.Mail.Cc(m.CC...)
 	m.Mail.Bcc(m.BCC...)
 	m.Mail.Subject(m.Subject)
-	if m.headers != nil {
-		for key, value := range m.headers {
-			m.Mail.AddHeader(key, value)
-		}
+	if m.MessageID != "" {
+		m.Mail.AddHeader("Message-ID", m.MessageID)
 	}
-	if m.attachments != nil {
-		for name, reader := range m.attachments {
-			m.Mail.Attach(name, reader)
-		}
+	for _, header := range m.headers {
+		m.Mail.AddHeader(header.Name, header.Value)
 	}
-	if m.html {
+	for _, name := range sortedNames(m.attachments) {
+		m.Mail.Attach(name, m.attachments[name])
+	}
+	for _, name := range sortedNames(m.inlineImages) {
+		m.Mail.AttachInline(name, m.inlineImages[name])
+	}
+	switch {
+	case m.HTMLBody != "":
+		// both parts are sent as multipart/alternative, generating the
+		// plain text from the HTML when no plain body was given
+		plain := m.Body
+		if plain == "" {
+			plain = HTMLToText(m.HTMLBody)
+		}
+		m.Mail.Plain().WriteString(plain)
+		m.Mail.HTML().WriteString(m.HTMLBody)
+	case m.html:
 		m.Mail.HTML().WriteString(m.Body)
-	} else {
+	default:
 		m.Mail.Plain().WriteString(m.Body)
 	}
 	buf, err := m.Mail.MimeBuf()
@@ -91,3 +131,19 @@ func (m *MailCreator) Compose() ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// NewMessageID returns a unique Message-ID using the domain of the from
+// address as the right hand side.
+func NewMessageID(from string) (string, error) {
+	domain := "localhost"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+			domain = addr.Address[at+1:]
+		}
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.Wrap(err, "unable to generate message id")
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(random), domain), nil
+}
@@ -3,7 +3,6 @@ package out_test
 import (
 	"bytes"
 
-	"github.com/domodwyer/mailyak/v3"
 	"github.com/pivotal-cf/email-resource/out"
 	"github.com/pivotal-cf/email-resource/out/fakes"
 
@@ -17,10 +16,10 @@ var _ = Describe("Sender", func() {
 		var mailCreator out.MailCreator
 		BeforeEach(func() {
 			mailfake = &fakes.FakeMail{}
-			mailfake.PlainReturns(&mailyak.BodyPart{})
-			mailfake.HTMLReturns(&mailyak.BodyPart{})
+			mailfake.PlainReturns(&out.BodyPart{})
+			mailfake.HTMLReturns(&out.BodyPart{})
 			mailfake.MimeBufReturns(&bytes.Buffer{}, nil)
-			mailCreator.Mail = mailfake
+			mailCreator = out.MailCreator{Mail: mailfake}
 		})
 		It("Will not add mime and content type headers", func() {
 			mailCreator.AddHeader("MIME-version", "1.0")
@@ -30,6 +29,21 @@ var _ = Describe("Sender", func() {
 			Expect(mailfake.AddHeaderCallCount()).Should(Equal(0))
 		})
 
+		It("Will add repeated headers in order", func() {
+			mailCreator.AddHeader("X-Tag", "a")
+			mailCreator.AddHeader("X-Other", "b")
+			mailCreator.AddHeader("X-Tag", "c")
+			_, err := mailCreator.Compose()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mailfake.AddHeaderCallCount()).Should(Equal(3))
+			name, value := mailfake.AddHeaderArgsForCall(0)
+			Expect(name + ": " + value).Should(Equal("X-Tag: a"))
+			name, value = mailfake.AddHeaderArgsForCall(1)
+			Expect(name + ": " + value).Should(Equal("X-Other: b"))
+			name, value = mailfake.AddHeaderArgsForCall(2)
+			Expect(name + ": " + value).Should(Equal("X-Tag: c"))
+		})
+
 		It("Will use HTML body part if header is found", func() {
 			mailCreator.AddHeader("Content-Type", "text/html; charset=\"UTF-8\"")
 			_, err := mailCreator.Compose()
@@ -39,4 +53,41 @@ var _ = Describe("Sender", func() {
 			Expect(mailfake.HTMLCallCount()).Should(Equal(1))
 		})
 	})
+
+	Context("Adding an HTML body", func() {
+		var mailCreator out.MailCreator
+		var plain, html *out.BodyPart
+		BeforeEach(func() {
+			plain, html = &out.BodyPart{}, &out.BodyPart{}
+			mailfake := &fakes.FakeMail{}
+			mailfake.PlainReturns(plain)
+			mailfake.HTMLReturns(html)
+			mailfake.MimeBufReturns(&bytes.Buffer{}, nil)
+			mailCreator = out.MailCreator{Mail: mailfake}
+			mailCreator.HTMLBody = "<p>Hello <b>world</b></p>"
+		})
+
+		It("Will use both body parts", func() {
+			mailCreator.Body = "Hello world, in plain text"
+			_, err := mailCreator.Compose()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(plain.String()).Should(Equal("Hello world, in plain text"))
+			Expect(html.String()).Should(Equal("<p>Hello <b>world</b></p>"))
+		})
+
+		It("Will generate the plain body part from the HTML", func() {
+			_, err := mailCreator.Compose()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(plain.String()).Should(Equal("Hello world"))
+		})
+
+		It("Will not use the HTML body part for the plain body when the header is found", func() {
+			mailCreator.Body = "plain"
+			mailCreator.AddHeader("Content-Type", "text/html; charset=\"UTF-8\"")
+			_, err := mailCreator.Compose()
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(plain.String()).Should(Equal("plain"))
+			Expect(html.String()).Should(Equal("<p>Hello <b>world</b></p>"))
+		})
+	})
 })
@@ -0,0 +1,56 @@
+package out
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+const mailgunEndpoint = "https://api.mailgun.net"
+
+func (config Mailgun) validate() error {
+	if config.APIKey == "" {
+		return errors.New(`missing required field "source.mailgun.api_key"`)
+	}
+	if config.Domain == "" {
+		return errors.New(`missing required field "source.mailgun.domain"`)
+	}
+	return nil
+}
+
+// request builds a request to the messages.mime API, which sends the composed
+// message as it is to the envelope recipients.
+func (config Mailgun) request(from string, to []string, msg []byte) (*http.Request, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, addr := range to {
+		if err := form.WriteField("to", addr); err != nil {
+			return nil, err
+		}
+	}
+	message, err := form.CreateFormFile("message", "message.eml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := message.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	endpoint, err := endpointURL(config.Endpoint, mailgunEndpoint, "/v3/"+url.PathEscape(config.Domain)+"/messages.mime")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("api", config.APIKey)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req, nil
+}
@@ -0,0 +1,43 @@
+package out
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+const (
+	BodyFormatText     = "text"
+	BodyFormatMarkdown = "markdown"
+)
+
+// markdownStylesheet is embedded in rendered Markdown bodies, since most mail
+// clients do not load external stylesheets.
+const markdownStylesheet = `body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; font-size: 14px; line-height: 1.5; color: #24292e; max-width: 800px; }
+h1, h2 { border-bottom: 1px solid #eaecef; padding-bottom: .3em; }
+a { color: #0366d6; }
+code { font-family: Menlo, Consolas, monospace; font-size: 90%; background-color: #f6f8fa; padding: .2em .4em; border-radius: 3px; }
+pre { background-color: #f6f8fa; padding: 16px; overflow: auto; border-radius: 3px; }
+pre code { background-color: transparent; padding: 0; }
+blockquote { color: #6a737d; border-left: .25em solid #dfe2e5; margin: 0; padding: 0 1em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #dfe2e5; padding: 6px 13px; }
+th { background-color: #f6f8fa; }`
+
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// RenderMarkdown renders a GitHub flavored Markdown body as an HTML document
+// with a default stylesheet. Raw HTML within the Markdown is not rendered.
+func RenderMarkdown(source string) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"UTF-8\">\n<style>\n")
+	buf.WriteString(markdownStylesheet)
+	buf.WriteString("\n</style>\n</head>\n<body>\n")
+	if err := markdown.Convert([]byte(source), &buf); err != nil {
+		return "", errors.Wrap(err, "unable to render markdown")
+	}
+	buf.WriteString("</body>\n</html>\n")
+	return buf.String(), nil
+}
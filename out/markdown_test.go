@@ -0,0 +1,34 @@
+package out_test
+
+import (
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RenderMarkdown", func() {
+	It("renders an HTML document with the default stylesheet", func() {
+		html, err := out.RenderMarkdown("# Release\n\nSome *notes*")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(html).To(HavePrefix("<!DOCTYPE html>"))
+		Expect(html).To(ContainSubstring("<style>"))
+		Expect(html).To(ContainSubstring("<h1>Release</h1>"))
+		Expect(html).To(ContainSubstring("<p>Some <em>notes</em></p>"))
+	})
+
+	It("renders GitHub flavored tables, task lists and autolinks", func() {
+		html, err := out.RenderMarkdown("| Job | Status |\n| --- | --- |\n| unit | passed |\n\n- [x] deployed\n\nhttps://ci.example.com")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(html).To(ContainSubstring("<th>Job</th>"))
+		Expect(html).To(ContainSubstring("<td>passed</td>"))
+		Expect(html).To(ContainSubstring(`<input checked="" disabled="" type="checkbox">`))
+		Expect(html).To(ContainSubstring(`<a href="https://ci.example.com">https://ci.example.com</a>`))
+	})
+
+	It("does not render raw HTML", func() {
+		html, err := out.RenderMarkdown("<script>alert(1)</script>")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(html).ToNot(ContainSubstring("<script>"))
+	})
+})
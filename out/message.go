@@ -0,0 +1,430 @@
+package out
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BodyPart - the text of the plain or HTML body
+type BodyPart struct {
+	bytes.Buffer
+}
+
+type mimeAttachment struct {
+	name    string
+	content io.Reader
+}
+
+// Message - builds the MIME message sent by out. Plain and HTML bodies are
+// sent as multipart/alternative, inline parts are related to the HTML body
+// and attachments are added as multipart/mixed.
+type Message struct {
+	from        string
+	to, cc, bcc []string
+	subject     string
+	headers     []Header
+	plain, html BodyPart
+	attachments []mimeAttachment
+	inline      []mimeAttachment
+	date        time.Time
+}
+
+func NewMessage() *Message {
+	return &Message{date: time.Now()}
+}
+
+func (m *Message) From(addr string) {
+	m.from = addr
+}
+
+func (m *Message) To(addrs ...string) {
+	m.to = addrs
+}
+
+func (m *Message) Cc(addrs ...string) {
+	m.cc = addrs
+}
+
+// Bcc records the blind copy recipients, which are never written into the
+// message headers.
+func (m *Message) Bcc(addrs ...string) {
+	m.bcc = addrs
+}
+
+func (m *Message) Subject(subject string) {
+	m.subject = subject
+}
+
+// AddHeader adds a header, keeping the order headers were added in. Adding a
+// header more than once writes it more than once. Names and values with line
+// breaks are rejected by MimeBuf.
+func (m *Message) AddHeader(name, value string) {
+	m.headers = append(m.headers, Header{Name: name, Value: value})
+}
+
+// Attach adds the contents of r as an attachment named name.
+func (m *Message) Attach(name string, r io.Reader) {
+	m.attachments = append(m.attachments, mimeAttachment{name: name, content: r})
+}
+
+// AttachInline adds the contents of r as an inline part of the HTML body with
+// the Content-ID <name>, so the HTML can refer to it as cid:name.
+func (m *Message) AttachInline(name string, r io.Reader) {
+	m.inline = append(m.inline, mimeAttachment{name: name, content: r})
+}
+
+func (m *Message) Plain() *BodyPart {
+	return &m.plain
+}
+
+func (m *Message) HTML() *BodyPart {
+	return &m.html
+}
+
+// MimeBuf returns the complete message.
+func (m *Message) MimeBuf() (*bytes.Buffer, error) {
+	if err := m.checkHeaders(); err != nil {
+		return nil, err
+	}
+	root, err := m.buildTree()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", m.from)
+	if len(m.to) > 0 {
+		fmt.Fprintf(buf, "To: %s\r\n", strings.Join(m.to, ","))
+	}
+	if len(m.cc) > 0 {
+		fmt.Fprintf(buf, "Cc: %s\r\n", strings.Join(m.cc, ","))
+	}
+	writeHeader(buf, "Subject", mime.QEncoding.Encode("UTF-8", m.subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", m.date.Format(time.RFC1123Z))
+	for _, h := range m.headers {
+		writeHeader(buf, h.Name, encodeHeaderValue(h.Name, h.Value))
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if err := root.writeTo(buf); err != nil {
+		return nil, errors.Wrap(err, "unable to write message")
+	}
+	return buf, nil
+}
+
+// checkHeaders rejects header names and values containing CR or LF, which
+// would end the header early or start another one when written.
+func (m *Message) checkHeaders() error {
+	fields := []Header{{Name: "From", Value: m.from}}
+	for _, addr := range m.to {
+		fields = append(fields, Header{Name: "To", Value: addr})
+	}
+	for _, addr := range m.cc {
+		fields = append(fields, Header{Name: "Cc", Value: addr})
+	}
+	fields = append(fields, m.headers...)
+	for _, h := range fields {
+		if strings.ContainsAny(h.Name, "\r\n") {
+			return errors.Errorf("header name %q contains a line break", h.Name)
+		}
+		if strings.ContainsAny(h.Value, "\r\n") {
+			return errors.Errorf("value of header %q contains a line break", h.Name)
+		}
+	}
+	return nil
+}
+
+// addressHeaders are the header fields holding address lists, whose display
+// names are encoded by the address formatter instead of encoding the whole
+// value.
+var addressHeaders = map[string]bool{
+	"Reply-To":                    true,
+	"Sender":                      true,
+	"Resent-From":                 true,
+	"Resent-Sender":               true,
+	"Resent-To":                   true,
+	"Resent-Cc":                   true,
+	"Disposition-Notification-To": true,
+}
+
+// encodeHeaderValue encodes a non-ASCII header value as RFC 2047
+// encoded-words. Address lists are parsed and formatted again instead, so
+// only their display names are encoded; values that cannot be parsed as one
+// are written as given.
+func encodeHeaderValue(name, value string) string {
+	if isASCII(value) {
+		return value
+	}
+	if addressHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+		addresses, err := ParseAddresses(value)
+		if err != nil || len(addresses) == 0 {
+			return value
+		}
+		return strings.Join(formatAddresses(addresses), ", ")
+	}
+	return mime.QEncoding.Encode("UTF-8", value)
+}
+
+// maxHeaderLineLength is the line length RFC 5322 recommends header fields
+// to be folded at.
+const maxHeaderLineLength = 78
+
+// writeHeader writes a header field, folding its value at spaces so that
+// lines stay within maxHeaderLineLength where the words allow it. Adjacent
+// encoded-words are separated by spaces, so long encoded values are folded
+// between them.
+func writeHeader(w io.Writer, name, value string) {
+	words := strings.Split(value, " ")
+	line := name + ": " + words[0]
+	for _, word := range words[1:] {
+		if word != "" && len(line)+1+len(word) > maxHeaderLineLength {
+			io.WriteString(w, line+"\r\n")
+			line = " " + word
+			continue
+		}
+		line += " " + word
+	}
+	io.WriteString(w, line+"\r\n")
+}
+
+func (m *Message) buildTree() (*mimeNode, error) {
+	var plain, html *mimeNode
+	if m.plain.Len() > 0 {
+		plain = textNode("text/plain", m.plain.Bytes())
+	}
+	if m.html.Len() > 0 {
+		html = textNode("text/html", m.html.Bytes())
+	}
+
+	var inline []*mimeNode
+	for _, a := range m.inline {
+		node, err := attachmentNode(a, true)
+		if err != nil {
+			return nil, err
+		}
+		inline = append(inline, node)
+	}
+	if html != nil && len(inline) > 0 {
+		html = multipartNode("multipart/related", map[string]string{"type": "text/html"}, append([]*mimeNode{html}, inline...)...)
+		inline = nil
+	}
+
+	var body *mimeNode
+	switch {
+	case plain != nil && html != nil:
+		body = multipartNode("multipart/alternative", nil, plain, html)
+	case html != nil:
+		body = html
+	case plain != nil:
+		body = plain
+	default:
+		body = textNode("text/plain", nil)
+	}
+
+	// inline parts without an HTML body to refer to them are sent along
+	// with the attachments
+	parts := inline
+	for _, a := range m.attachments {
+		node, err := attachmentNode(a, false)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, node)
+	}
+	if len(parts) > 0 {
+		body = multipartNode("multipart/mixed", nil, append([]*mimeNode{body}, parts...)...)
+	}
+	return body, nil
+}
+
+// mimeNode is a part of the MIME tree, either a leaf with content or a
+// multipart container.
+type mimeNode struct {
+	header   []Header
+	content  []byte
+	encoding string
+	children []*mimeNode
+}
+
+func textNode(mediaType string, content []byte) *mimeNode {
+	return &mimeNode{
+		header: []Header{
+			{"Content-Type", mime.FormatMediaType(mediaType, map[string]string{"charset": "UTF-8"})},
+			{"Content-Transfer-Encoding", "quoted-printable"},
+		},
+		content:  content,
+		encoding: "quoted-printable",
+	}
+}
+
+func attachmentNode(a mimeAttachment, inline bool) (*mimeNode, error) {
+	if strings.ContainsAny(a.name, "\r\n") {
+		return nil, errors.Errorf("attachment name %q contains a line break", a.name)
+	}
+	if inline {
+		if err := checkContentID(a.name); err != nil {
+			return nil, err
+		}
+	}
+	content, err := ioutil.ReadAll(a.content)
+	if closer, ok := a.content.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s", a.name)
+	}
+
+	mediaType := mime.TypeByExtension(filepath.Ext(a.name))
+	if mediaType == "" {
+		mediaType = http.DetectContentType(content)
+	}
+	if parsed, params, err := mime.ParseMediaType(mediaType); err == nil {
+		params["name"] = a.name
+		mediaType = mime.FormatMediaType(parsed, params)
+	}
+
+	disposition := "attachment"
+	if inline {
+		disposition = "inline"
+	}
+
+	node := &mimeNode{
+		header: []Header{
+			{"Content-Type", mediaType},
+			{"Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.name})},
+			{"Content-Transfer-Encoding", "base64"},
+		},
+		content:  content,
+		encoding: "base64",
+	}
+	if inline {
+		node.header = append(node.header, Header{"Content-ID", "<" + a.name + ">"})
+	}
+	return node, nil
+}
+
+// contentIDSpecials are the characters other than letters and digits RFC 5322
+// allows in a dot-atom.
+const contentIDSpecials = "!#$%&'*+-/=?^_`{|}~"
+
+// checkContentID checks that name is a dot-atom, so it can be written into a
+// Content-ID header and referred to by a cid: URL unchanged.
+func checkContentID(name string) error {
+	valid := name != "" && name[0] != '.' && name[len(name)-1] != '.' && !strings.Contains(name, "..")
+	for _, c := range name {
+		if !valid {
+			break
+		}
+		valid = c < 128 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '.' || strings.ContainsRune(contentIDSpecials, c))
+	}
+	if !valid {
+		return errors.Errorf("inline image name %q cannot be used as a Content-ID. Names may only contain letters, digits, single dots between them and the characters %s", name, contentIDSpecials)
+	}
+	return nil
+}
+
+func multipartNode(mediaType string, params map[string]string, children ...*mimeNode) *mimeNode {
+	return &mimeNode{
+		header:   []Header{{"Content-Type", mime.FormatMediaType(mediaType, params)}},
+		children: children,
+	}
+}
+
+func (n *mimeNode) writeTo(w io.Writer) error {
+	if len(n.children) == 0 {
+		for _, h := range n.header {
+			fmt.Fprintf(w, "%s: %s\r\n", h.Name, h.Value)
+		}
+		io.WriteString(w, "\r\n")
+		return n.writeContent(w)
+	}
+
+	boundary, err := randomBoundary()
+	if err != nil {
+		return err
+	}
+	for _, h := range n.header {
+		if h.Name == "Content-Type" {
+			mediaType, params, _ := mime.ParseMediaType(h.Value)
+			if params == nil {
+				params = map[string]string{}
+			}
+			params["boundary"] = boundary
+			h.Value = mime.FormatMediaType(mediaType, params)
+		}
+		fmt.Fprintf(w, "%s: %s\r\n", h.Name, h.Value)
+	}
+	io.WriteString(w, "\r\n")
+	for _, child := range n.children {
+		fmt.Fprintf(w, "--%s\r\n", boundary)
+		if err := child.writeTo(w); err != nil {
+			return err
+		}
+		io.WriteString(w, "\r\n")
+	}
+	_, err = fmt.Fprintf(w, "--%s--\r\n", boundary)
+	return err
+}
+
+func (n *mimeNode) writeContent(w io.Writer) error {
+	switch n.encoding {
+	case "base64":
+		return writeBase64(w, n.content)
+	case "quoted-printable":
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(n.content); err != nil {
+			return err
+		}
+		return qp.Close()
+	}
+	_, err := w.Write(n.content)
+	return err
+}
+
+// writeBase64 writes content base64 encoded in lines of 76 characters.
+func writeBase64(w io.Writer, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(w, encoded)
+	return err
+}
+
+func randomBoundary() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "unable to generate MIME boundary")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// sortedNames returns the keys of m in order, so parts are always added in
+// the same order.
+func sortedNames(m map[string]io.Reader) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,233 @@
+package out_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type parsedPart struct {
+	mediaType string
+	params    map[string]string
+	header    map[string][]string
+	body      string
+	parts     []parsedPart
+}
+
+func parsePart(header map[string][]string, body []byte) parsedPart {
+	mediaType, params, err := mime.ParseMediaType(mail.Header(header).Get("Content-Type"))
+	Expect(err).ToNot(HaveOccurred())
+	p := parsedPart{mediaType: mediaType, params: params, header: header}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		p.body = string(body)
+		return p
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err != nil {
+			break
+		}
+		content, err := ioutil.ReadAll(part)
+		Expect(err).ToNot(HaveOccurred())
+		p.parts = append(p.parts, parsePart(part.Header, content))
+	}
+	return p
+}
+
+var _ = Describe("Message", func() {
+	var message *out.Message
+
+	compose := func() (mail.Header, parsedPart) {
+		buf, err := message.MimeBuf()
+		Expect(err).ToNot(HaveOccurred())
+		parsed, err := mail.ReadMessage(buf)
+		Expect(err).ToNot(HaveOccurred())
+		body, err := ioutil.ReadAll(parsed.Body)
+		Expect(err).ToNot(HaveOccurred())
+		return parsed.Header, parsePart(parsed.Header, body)
+	}
+
+	BeforeEach(func() {
+		message = out.NewMessage()
+		message.From("sender@example.com")
+		message.To("a@example.com", "b@example.com")
+		message.Cc("c@example.com")
+		message.Bcc("hidden@example.com")
+		message.Subject("Build #1")
+	})
+
+	It("writes the envelope headers without the blind copy recipients", func() {
+		message.Plain().WriteString("hello")
+		buf, err := message.MimeBuf()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.String()).To(HavePrefix("From: sender@example.com\r\nTo: a@example.com,b@example.com\r\nCc: c@example.com\r\nSubject: Build #1\r\nDate: "))
+		Expect(buf.String()).To(ContainSubstring("MIME-Version: 1.0\r\n"))
+		Expect(buf.String()).ToNot(ContainSubstring("hidden@example.com"))
+	})
+
+	It("encodes non-ASCII subjects", func() {
+		message.Subject("Grüße")
+		header, _ := compose()
+		Expect(header["Subject"]).To(Equal([]string{"=?UTF-8?q?Gr=C3=BC=C3=9Fe?="}))
+	})
+
+	It("folds long subjects between encoded-words", func() {
+		message.Subject(strings.Repeat("Grüße aus der Pipeline, ", 12))
+		buf, err := message.MimeBuf()
+		Expect(err).ToNot(HaveOccurred())
+		raw := buf.String()
+		header := raw[:strings.Index(raw, "\r\n\r\n")]
+		Expect(header).To(ContainSubstring("?=\r\n =?UTF-8?q?"))
+		for _, line := range strings.Split(header, "\r\n") {
+			// an encoded-word is at most 75 characters and cannot be split
+			Expect(len(line)).To(BeNumerically("<=", len("Subject: ")+75))
+		}
+
+		parsed, err := mail.ReadMessage(buf)
+		Expect(err).ToNot(HaveOccurred())
+		subject, err := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(subject).To(Equal(strings.Repeat("Grüße aus der Pipeline, ", 12)))
+	})
+
+	It("folds long ASCII subjects at spaces", func() {
+		message.Subject(strings.Repeat("build passed ", 20))
+		buf, err := message.MimeBuf()
+		Expect(err).ToNot(HaveOccurred())
+		raw := buf.String()
+		for _, line := range strings.Split(raw[:strings.Index(raw, "\r\n\r\n")], "\r\n") {
+			Expect(len(line)).To(BeNumerically("<=", 78))
+		}
+		parsed, err := mail.ReadMessage(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parsed.Header.Get("Subject")).To(Equal(strings.TrimSuffix(strings.Repeat("build passed ", 20), " ")))
+	})
+
+	It("encodes non-ASCII header values", func() {
+		message.AddHeader("X-Approver", "Jürgen")
+		message.AddHeader("X-Build", "42")
+		header, _ := compose()
+		Expect(header["X-Approver"]).To(Equal([]string{"=?UTF-8?q?J=C3=BCrgen?="}))
+		Expect(header["X-Build"]).To(Equal([]string{"42"}))
+	})
+
+	It("encodes only the display names of address headers", func() {
+		message.AddHeader("Reply-To", "Jürgen Schmidt <juergen@example.com>, ops@example.com")
+		header, _ := compose()
+		Expect(header["Reply-To"]).To(Equal([]string{`=?utf-8?q?J=C3=BCrgen_Schmidt?= <juergen@example.com>, ops@example.com`}))
+
+		addresses, err := header.AddressList("Reply-To")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addresses[0].Name).To(Equal("Jürgen Schmidt"))
+		Expect(addresses[1].Address).To(Equal("ops@example.com"))
+	})
+
+	It("keeps the order and repetitions of added headers", func() {
+		message.AddHeader("X-First", "1")
+		message.AddHeader("X-Second", "2")
+		message.AddHeader("X-First", "3")
+		header, _ := compose()
+		Expect(header["X-First"]).To(Equal([]string{"1", "3"}))
+		buf, err := message.MimeBuf()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(buf.String()).To(ContainSubstring("X-First: 1\r\nX-Second: 2\r\nX-First: 3\r\n"))
+	})
+
+	It("rejects header values with line breaks", func() {
+		message.AddHeader("X-Tag", "v1\r\nBcc: evil@example.com")
+		_, err := message.MimeBuf()
+		Expect(err).To(MatchError(`value of header "X-Tag" contains a line break`))
+	})
+
+	It("rejects header names with line breaks", func() {
+		message.AddHeader("X-Tag\nBcc", "evil@example.com")
+		_, err := message.MimeBuf()
+		Expect(err).To(MatchError(`header name "X-Tag\nBcc" contains a line break`))
+	})
+
+	It("rejects addresses with line breaks", func() {
+		message.To("a@example.com\r\nBcc: evil@example.com")
+		_, err := message.MimeBuf()
+		Expect(err).To(MatchError(`value of header "To" contains a line break`))
+	})
+
+	It("sends a plain body as a single part", func() {
+		message.Plain().WriteString("hello")
+		_, root := compose()
+		Expect(root.mediaType).To(Equal("text/plain"))
+		Expect(root.params["charset"]).To(Equal("UTF-8"))
+		Expect(root.body).To(Equal("hello"))
+	})
+
+	It("sends plain and HTML bodies as alternatives", func() {
+		message.Plain().WriteString("hello")
+		message.HTML().WriteString("<p>hello</p>")
+		_, root := compose()
+		Expect(root.mediaType).To(Equal("multipart/alternative"))
+		Expect(root.parts).To(HaveLen(2))
+		Expect(root.parts[0].mediaType).To(Equal("text/plain"))
+		Expect(root.parts[1].mediaType).To(Equal("text/html"))
+	})
+
+	It("relates inline parts to the HTML body", func() {
+		message.Plain().WriteString("hello")
+		message.HTML().WriteString(`<img src="cid:chart.png">`)
+		message.AttachInline("chart.png", strings.NewReader("\x89PNG\r\n\x1a\n"))
+		message.Attach("report.txt", strings.NewReader("report"))
+		_, root := compose()
+
+		Expect(root.mediaType).To(Equal("multipart/mixed"))
+		Expect(root.parts).To(HaveLen(2))
+
+		alternative := root.parts[0]
+		Expect(alternative.mediaType).To(Equal("multipart/alternative"))
+		related := alternative.parts[1]
+		Expect(related.mediaType).To(Equal("multipart/related"))
+		Expect(related.params["type"]).To(Equal("text/html"))
+		Expect(related.parts[0].mediaType).To(Equal("text/html"))
+
+		image := related.parts[1]
+		Expect(image.mediaType).To(Equal("image/png"))
+		Expect(mail.Header(image.header).Get("Content-ID")).To(Equal("<chart.png>"))
+		Expect(mail.Header(image.header).Get("Content-Disposition")).To(Equal(`inline; filename=chart.png`))
+
+		attachment := root.parts[1]
+		Expect(mail.Header(attachment.header).Get("Content-Disposition")).To(Equal(`attachment; filename=report.txt`))
+		Expect(attachment.body).To(Equal("cmVwb3J0"))
+	})
+
+	It("sends inline parts along with the attachments without an HTML body", func() {
+		message.Plain().WriteString("hello")
+		message.AttachInline("chart.png", strings.NewReader("\x89PNG\r\n\x1a\n"))
+		_, root := compose()
+		Expect(root.mediaType).To(Equal("multipart/mixed"))
+		Expect(root.parts[0].mediaType).To(Equal("text/plain"))
+		Expect(root.parts[1].mediaType).To(Equal("image/png"))
+	})
+
+	It("rejects inline parts whose names are not valid Content-IDs", func() {
+		message.HTML().WriteString(`<img src="cid:build status.png">`)
+		message.AttachInline("build status.png", strings.NewReader("\x89PNG\r\n\x1a\n"))
+		_, err := message.MimeBuf()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix(`inline image name "build status.png" cannot be used as a Content-ID`))
+	})
+
+	It("wraps base64 encoded attachments", func() {
+		message.Plain().WriteString("hello")
+		message.Attach("data.bin", bytes.NewReader(make([]byte, 200)))
+		_, root := compose()
+		for _, line := range strings.Split(strings.TrimSpace(root.parts[1].body), "\r\n") {
+			Expect(len(line)).To(BeNumerically("<=", 76))
+		}
+	})
+})
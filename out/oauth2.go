@@ -0,0 +1,73 @@
+package out
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// FetchAccessToken requests an access token from the configured token
+// endpoint. A refresh token grant is used when a refresh token is configured,
+// otherwise the client credentials grant is used.
+func FetchAccessToken(config OAuth2, client *http.Client) (string, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	form := url.Values{}
+	if config.RefreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", config.RefreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	form.Set("client_id", config.ClientID)
+	if config.ClientSecret != "" {
+		form.Set("client_secret", config.ClientSecret)
+	}
+	if len(config.Scopes) > 0 {
+		form.Set("scope", strings.Join(config.Scopes, " "))
+	}
+
+	resp, err := client.PostForm(config.TokenURL, form)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to request access token")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read access token response")
+	}
+
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return "", errors.Errorf("token endpoint returned %s", resp.Status)
+		}
+		return "", errors.Wrap(err, "unable to parse access token response")
+	}
+	if token.Error != "" {
+		return "", errors.Errorf("token endpoint returned %s: %s", resp.Status, strings.TrimSpace(token.Error+" "+token.ErrorDescription))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("token endpoint did not return an access token")
+	}
+	return token.AccessToken, nil
+}
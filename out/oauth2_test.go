@@ -0,0 +1,88 @@
+package out_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FetchAccessToken", func() {
+	var tokenServer *httptest.Server
+	var requests []url.Values
+	var status int
+	var response string
+
+	BeforeEach(func() {
+		requests = nil
+		status = http.StatusOK
+		response = `{"access_token":"some-access-token","token_type":"Bearer","expires_in":3600}`
+		tokenServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Method).To(Equal(http.MethodPost))
+			Expect(r.ParseForm()).To(Succeed())
+			requests = append(requests, r.PostForm)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte(response))
+		}))
+	})
+
+	AfterEach(func() {
+		tokenServer.Close()
+	})
+
+	It("uses the refresh token grant when a refresh token is configured", func() {
+		token, err := out.FetchAccessToken(out.OAuth2{
+			TokenURL:     tokenServer.URL,
+			ClientID:     "some-client",
+			ClientSecret: "some-secret",
+			RefreshToken: "some-refresh-token",
+			Scopes:       []string{"https://mail.google.com/"},
+		}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("some-access-token"))
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Get("grant_type")).To(Equal("refresh_token"))
+		Expect(requests[0].Get("refresh_token")).To(Equal("some-refresh-token"))
+		Expect(requests[0].Get("client_id")).To(Equal("some-client"))
+		Expect(requests[0].Get("client_secret")).To(Equal("some-secret"))
+		Expect(requests[0].Get("scope")).To(Equal("https://mail.google.com/"))
+	})
+
+	It("uses the client credentials grant otherwise", func() {
+		token, err := out.FetchAccessToken(out.OAuth2{
+			TokenURL:     tokenServer.URL,
+			ClientID:     "some-client",
+			ClientSecret: "some-secret",
+			Scopes:       []string{"scope-1", "scope-2"},
+		}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("some-access-token"))
+
+		Expect(requests).To(HaveLen(1))
+		Expect(requests[0].Get("grant_type")).To(Equal("client_credentials"))
+		Expect(requests[0].Get("scope")).To(Equal("scope-1 scope-2"))
+	})
+
+	It("returns the error reported by the token endpoint", func() {
+		status = http.StatusBadRequest
+		response = `{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`
+
+		_, err := out.FetchAccessToken(out.OAuth2{TokenURL: tokenServer.URL, ClientID: "some-client"}, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("token endpoint returned 400 Bad Request: invalid_grant Token has been expired or revoked."))
+	})
+
+	It("returns an error when no access token is returned", func() {
+		response = `{}`
+
+		_, err := out.FetchAccessToken(out.OAuth2{TokenURL: tokenServer.URL, ClientID: "some-client"}, nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("token endpoint did not return an access token"))
+	})
+})
@@ -1,10 +1,14 @@
 package out
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/mail"
 	"os"
 	"path/filepath"
 	"strings"
@@ -37,6 +41,7 @@ func Execute(sourceRoot, version string, input []byte) (string, error) {
 	source := indata.Source
 	params := indata.Params
 	debug := strings.EqualFold("true", params.Debug)
+	dryRun := source.DryRun || params.DryRun
 	smtpConfig := source.SMTP
 
 	if debug {
@@ -59,23 +64,120 @@ func Execute(sourceRoot, version string, input []byte) (string, error) {
 		return "", errors.Wrap(err, "Error getting Body:")
 	}
 
-	toArray, err := sliceFromTextOrFile(sourceRoot, params.ToText, params.To)
+	htmlBody, err := fromTextOrFile(sourceRoot, params.HTMLBodyText, params.HTMLBody)
 	if err != nil {
-		return "", errors.Wrap(err, "Error getting to list:")
+		return "", errors.Wrap(err, "Error getting HTML Body:")
 	}
-	source.To = append(source.To, toArray...)
 
-	ccArray, err := sliceFromTextOrFile(sourceRoot, params.CcText, params.Cc)
+	var headersString string
+	if params.Headers != "" {
+		if debug {
+			logger.Println("Getting headers")
+		}
+		headersString, err = readSource(sourceRoot, params.Headers)
+		if err != nil {
+			return "", errors.Wrap(err, "unable to read source file for headers")
+		}
+		headersString = strings.Trim(headersString, "\n")
+	}
+
+	var renderer *templateRenderer
+	if params.Template {
+		if debug {
+			logger.Println("Rendering templates")
+		}
+		renderer = newTemplateRenderer(sourceRoot, params.Vars)
+		subject, err = renderer.renderText("subject", subject)
+		if err != nil {
+			return "", err
+		}
+		subject = strings.Trim(subject, "\n")
+		headersString, err = renderer.renderText("headers", headersString)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	headers, err := ParseHeaders(strings.NewReader(headersString))
 	if err != nil {
-		return "", errors.Wrap(err, "Error getting cc list:")
+		return "", errors.Wrapf(err, "unable to parse headers from %s", params.Headers)
 	}
-	source.Cc = append(source.Cc, ccArray...)
 
-	bccArray, err := sliceFromTextOrFile(sourceRoot, params.BccText, params.Bcc)
+	headersFromMap, err := HeadersFromMap(params.HeadersMap)
 	if err != nil {
-		return "", errors.Wrap(err, "Error getting cc list:")
+		return "", errors.Wrap(err, `invalid "params.headers_map"`)
+	}
+	for _, header := range headersFromMap {
+		header.Value = replaceTokens(header.Value)
+		if renderer != nil {
+			header.Value, err = renderer.renderText("headers_map", header.Value)
+			if err != nil {
+				return "", err
+			}
+		}
+		// files read by templates usually end in a newline
+		header.Value = strings.TrimRight(header.Value, " \t\r\n")
+		if err := checkHeaderValue(header.Name, header.Value); err != nil {
+			return "", errors.Wrap(err, `invalid "params.headers_map"`)
+		}
+		headers = append(headers, header)
+	}
+
+	if renderer != nil {
+		if htmlBody == "" && hasHTMLContentType(headers) {
+			body, err = renderer.renderHTML("body", body)
+		} else {
+			body, err = renderer.renderText("body", body)
+		}
+		if err != nil {
+			return "", err
+		}
+		htmlBody, err = renderer.renderHTML("html_body", htmlBody)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if strings.EqualFold(params.BodyFormat, BodyFormatMarkdown) && body != "" {
+		if debug {
+			logger.Println("Rendering Markdown body")
+		}
+		htmlBody, err = RenderMarkdown(body)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	from, err := parseSender(source.From)
+	if err != nil {
+		return "", errors.Wrap(err, `invalid "source.from"`)
+	}
+
+	var to, cc, bcc []*mail.Address
+	for _, list := range []struct {
+		name           string
+		addresses      *[]*mail.Address
+		entries        []string
+		text, filePath string
+	}{
+		{"to", &to, source.To, params.ToText, params.To},
+		{"cc", &cc, source.Cc, params.CcText, params.Cc},
+		{"bcc", &bcc, source.Bcc, params.BccText, params.Bcc},
+	} {
+		fromSource, err := parseAddressEntries(list.entries)
+		if err != nil {
+			return "", errors.Wrapf(err, `invalid "source.%s"`, list.name)
+		}
+		fromParams, err := addressesFromTextOrFile(sourceRoot, list.text, list.filePath)
+		if err != nil {
+			return "", errors.Wrapf(err, "Error getting %s list:", list.name)
+		}
+		*list.addresses = append(fromSource, fromParams...)
+	}
+	rcpts := newRecipients(to, cc, bcc)
+	if len(rcpts.envelope()) == 0 {
+		return "", errors.New("no recipients found in to, cc or bcc")
 	}
-	source.Bcc = append(source.Bcc, bccArray...)
 
 	var outdata Output
 	outdata.Version.Time = time.Now().UTC()
@@ -84,14 +186,13 @@ func Execute(sourceRoot, version string, input []byte) (string, error) {
 		{Name: "subject", Value: subject},
 		{Name: "version", Value: version},
 	}
-	outbytes, err := json.Marshal(outdata)
-	if err != nil {
-		return "", errors.Wrap(err, "Error Marshalling JSON:")
+	if source.transport() != TransportSMTP {
+		outdata.Metadata[0] = MetadataItem{Name: "transport", Value: source.transport()}
 	}
 
-	if params.SendEmptyBody == false && len(body) == 0 {
+	if params.SendEmptyBody == false && len(body) == 0 && len(htmlBody) == 0 {
 		logger.Println("Message not sent because the message body is empty and send_empty_body parameter was set to false. Github readme: https://github.com/pivotal-cf/email-resource")
-		return string(outbytes), nil
+		return marshalOutput(outdata)
 	}
 
 	if debug {
@@ -99,29 +200,18 @@ func Execute(sourceRoot, version string, input []byte) (string, error) {
 	}
 
 	mail := NewMailCreator()
-	mail.From = source.From
-	mail.To = source.To
-	mail.CC = source.Cc
-	mail.BCC = source.Bcc
+	mail.From = formatAddress(from)
+	mail.To = formatAddresses(rcpts.to)
+	mail.CC = formatAddresses(rcpts.cc)
+	mail.BCC = formatAddresses(rcpts.bcc)
 	mail.Subject = subject
 	mail.Body = body
-	if params.Headers != "" {
-		if debug {
-			logger.Println("Getting headers")
-		}
-		var headersString string
-		headersString, err = readSource(sourceRoot, params.Headers)
-		if err != nil {
-			return "", errors.Wrap(err, "unable to read source file for headers")
-		}
-		headersString = strings.Trim(headersString, "\n")
-		lines := strings.Split(headersString, "\n")
-		for _, line := range lines {
-			kv := strings.Split(line, ": ")
-			mail.AddHeader(kv[0], kv[1])
-		}
+	mail.HTMLBody = htmlBody
+	for _, header := range headers {
+		mail.AddHeader(header.Name, header.Value)
 	}
 
+	var attachments []string
 	if len(params.AttachmentGlobs) > 0 {
 		for _, glob := range params.AttachmentGlobs {
 			globPath := filepath.Join(sourceRoot, glob)
@@ -136,38 +226,229 @@ func Execute(sourceRoot, version string, input []byte) (string, error) {
 				if err != nil {
 					return "", errors.Wrapf(err, "Error adding attachement from path %s", attachmentPath)
 				}
+				attachments = append(attachments, filepath.Base(attachmentPath))
 			}
 		}
 	}
 
+	for _, glob := range params.InlineImages {
+		globPath := filepath.Join(sourceRoot, glob)
+		logger.Println(fmt.Sprintf("Looking for inline images with pattern %s", globPath))
+		paths, err := filepath.Glob(globPath)
+		if err != nil {
+			return "", errors.Wrapf(err, "Error getting files from glob %s", globPath)
+		}
+		for _, imagePath := range paths {
+			logger.Println(fmt.Sprintf("Embedding inline image %s", imagePath))
+			err = mail.AddInlineImage(imagePath)
+			if err != nil {
+				return "", errors.Wrapf(err, "Error adding inline image from path %s", imagePath)
+			}
+			attachments = append(attachments, filepath.Base(imagePath))
+		}
+	}
+
+	var transport Transport
+	switch {
+	case dryRun:
+	case source.transport() == TransportSMTP:
+		transport, err = newSMTPSender(smtpConfig, from.Address, rcpts.envelope(), debug, logger)
+	case source.transport() == TransportMaildir, source.transport() == TransportMbox, source.transport() == TransportPickup:
+		transport, err = newLocalTransport(source, sourceRoot, from.Address, rcpts.envelope())
+	default:
+		transport, err = newHTTPTransport(source, from.Address, rcpts.envelope(), nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if mail.MessageID == "" {
+		mail.MessageID, err = NewMessageID(from.Address)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	msg, err := mail.Compose()
+	if err != nil {
+		return "", errors.Wrapf(err, "Error composing mail")
+	}
+	if source.SMIME.configured() {
+		keys, err := source.SMIME.keys()
+		if err != nil {
+			return "", err
+		}
+		if msg, err = keys.protect(msg); err != nil {
+			return "", err
+		}
+	}
+	if source.PGP.configured() || params.PGPKeyring != "" {
+		var keyring []byte
+		if params.PGPKeyring != "" {
+			keyringPath := params.PGPKeyring
+			if !filepath.IsAbs(keyringPath) {
+				keyringPath = filepath.Join(sourceRoot, keyringPath)
+			}
+			if keyring, err = ioutil.ReadFile(keyringPath); err != nil {
+				return "", errors.Wrap(err, "Error reading OpenPGP keyring")
+			}
+		}
+		keys, err := source.PGP.keys(keyring)
+		if err != nil {
+			return "", err
+		}
+		if msg, err = keys.protect(msg, rcpts.envelope(), rcpts.bccAddresses()); err != nil {
+			return "", err
+		}
+	}
+	if source.DKIM.configured() {
+		options, err := source.DKIM.signOptions(from.Address)
+		if err != nil {
+			return "", err
+		}
+		if msg, err = signDKIM(msg, options); err != nil {
+			return "", err
+		}
+	}
+	// the version is checked before sending, so an oversized message fails
+	// the put without being sent
+	if params.IncludeMessageInVersion {
+		outdata.Version.Message, err = encodeMessage(msg)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	var statuses []RecipientStatus
+	if dryRun {
+		summary := DryRunSummary{
+			MessageID:   mail.MessageID,
+			Transport:   source.transport(),
+			From:        mail.From,
+			To:          mail.To,
+			Cc:          mail.CC,
+			Bcc:         len(mail.BCC),
+			Subject:     subject,
+			Attachments: attachments,
+			Size:        len(msg),
+		}
+		if err := writeDryRun(logger.Writer(), sourceRoot, params.DryRunFile, msg, summary); err != nil {
+			return "", err
+		}
+	} else {
+		statuses, err = transport.Send(msg)
+		if err != nil {
+			return "", err
+		}
+
+		if params.ReportFile != "" {
+			report := DeliveryReport{MessageID: mail.MessageID, SMTPHost: transport.DeliveredBy(), Recipients: statuses}
+			if err := writeReport(sourceRoot, params.ReportFile, report); err != nil {
+				return "", err
+			}
+		}
+		if err := checkRejections(params.failOnRejectedRecipient(), statuses); err != nil {
+			return "", err
+		}
+	}
+
+	outdata.Version.MessageID = mail.MessageID
+	outdata.Metadata = append(outdata.Metadata, MetadataItem{Name: "message_id", Value: mail.MessageID})
+	if dryRun {
+		// marked so that check and in can tell it apart from a sent message
+		outdata.Version.DryRun = "true"
+		outdata.Metadata = append(outdata.Metadata, dryRunMetadata(rcpts.envelope(), rcpts.bccAddresses())...)
+	} else {
+		outdata.Metadata = append(outdata.Metadata, MetadataItem{Name: "delivered_by", Value: transport.DeliveredBy()})
+		outdata.Metadata = append(outdata.Metadata, recipientMetadata(statuses, rcpts.bccAddresses())...)
+	}
+
+	return marshalOutput(outdata)
+}
+
+// newSMTPSender returns a Sender configured from source.smtp.
+func newSMTPSender(smtpConfig SMTP, from string, to []string, debug bool, logger *log.Logger) (*Sender, error) {
+	var err error
 	sender := NewSender(smtpConfig.Host, smtpConfig.Port, smtpConfig.Username, smtpConfig.Password, debug, logger)
 	sender.HostOrigin = smtpConfig.HostOrigin
 	sender.CaCert = smtpConfig.CaCert
+	sender.ClientCert = smtpConfig.ClientCert
+	sender.ClientKey = smtpConfig.ClientKey
+	sender.TLSMode = smtpConfig.TLSMode
+	sender.RequireTLS = smtpConfig.requiresTLS()
 	sender.Anonymous = smtpConfig.Anonymous
 	sender.LoginAuth = smtpConfig.LoginAuth
+	sender.AuthMechanism = smtpConfig.authMechanism()
+	sender.AccessToken = smtpConfig.AccessToken
+	if smtpConfig.usesOAuth2() && sender.AccessToken == "" && !smtpConfig.Anonymous {
+		if debug {
+			logger.Println("Fetching access token")
+		}
+		sender.AccessToken, err = FetchAccessToken(smtpConfig.OAuth2, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error fetching access token")
+		}
+	}
 	sender.SkipSSLValidation = smtpConfig.SkipSSLValidation
-	sender.From = source.From
-	sender.To = append(append(source.To, source.Cc...), source.Bcc...)
-
-	msg, err := mail.Compose()
+	sender.From = from
+	sender.To = to
+	sender.FallbackHosts = smtpConfig.fallbackHosts()
+	sender.Retry, err = smtpConfig.Retry.policy()
 	if err != nil {
-		return "", errors.Wrapf(err, "Error composing mail")
+		return nil, err
 	}
-	err = sender.Send(msg)
+	sender.Timeouts, err = smtpConfig.timeouts()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
+	return sender, nil
+}
+
+func marshalOutput(outdata Output) (string, error) {
+	outbytes, err := json.Marshal(outdata)
+	if err != nil {
+		return "", errors.Wrap(err, "Error Marshalling JSON:")
+	}
 	return string(outbytes), nil
 }
 
-func validateConfiguration(indata Input) error {
-	if indata.Source.SMTP.Host == "" {
-		return errors.New(`missing required field "source.smtp.host"`)
+// maxVersionMessageSize is the largest encoded message carried in the
+// version. Concourse stores every version in its database and shows it in
+// the UI, so versions have to stay small.
+const maxVersionMessageSize = 64 * 1024
+
+// encodeMessage gzips and base64 encodes the sent message so that it can be
+// carried in the version and written out again by in.
+func encodeMessage(msg []byte) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(msg); err != nil {
+		return "", errors.Wrap(err, "Error compressing message")
+	}
+	if err := zw.Close(); err != nil {
+		return "", errors.Wrap(err, "Error compressing message")
+	}
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) > maxVersionMessageSize {
+		return "", errors.Errorf(`message is %d bytes compressed and encoded, more than the %d bytes allowed by "params.include_message_in_version"`, len(encoded), maxVersionMessageSize)
 	}
+	return encoded, nil
+}
 
-	if indata.Source.SMTP.Port == "" {
-		return errors.New(`missing required field "source.smtp.port"`)
+func validateConfiguration(indata Input) error {
+	switch indata.Source.transport() {
+	case TransportSMTP:
+		if indata.Source.SMTP.Host == "" {
+			return errors.New(`missing required field "source.smtp.host"`)
+		}
+
+		if indata.Source.SMTP.Port == "" {
+			return errors.New(`missing required field "source.smtp.port"`)
+		}
+	case TransportSendGrid, TransportMailgun, TransportSES, TransportPostmark, TransportMaildir, TransportMbox, TransportPickup:
+	default:
+		return errors.Errorf(`invalid value %q for field "source.transport". Must be one of "smtp", "sendgrid", "mailgun", "ses", "postmark", "maildir", "mbox" or "pickup"`, indata.Source.Transport)
 	}
 
 	if indata.Source.From == "" {
@@ -182,18 +463,150 @@ func validateConfiguration(indata Input) error {
 		return errors.New(`missing required field "params.subject" or "params.subject_text". Must specify at least one`)
 	}
 
-	if indata.Source.SMTP.Anonymous == false {
+	if _, err := parseSender(indata.Source.From); err != nil {
+		return errors.Wrap(err, `invalid "source.from"`)
+	}
+	for _, list := range []struct {
+		field   string
+		entries []string
+	}{
+		{"source.to", indata.Source.To},
+		{"source.cc", indata.Source.Cc},
+		{"source.bcc", indata.Source.Bcc},
+		{"params.to_text", []string{indata.Params.ToText}},
+		{"params.cc_text", []string{indata.Params.CcText}},
+		{"params.bcc_text", []string{indata.Params.BccText}},
+	} {
+		if _, err := parseAddressEntries(list.entries); err != nil {
+			return errors.Wrapf(err, `invalid "%s"`, list.field)
+		}
+	}
+
+	switch strings.ToLower(indata.Params.BodyFormat) {
+	case "", BodyFormatText:
+	case BodyFormatMarkdown:
+		if indata.Params.HTMLBody != "" || indata.Params.HTMLBodyText != "" {
+			return errors.New(`"params.body_format" is "markdown" but "params.html_body" or "params.html_body_text" is set. The HTML body is rendered from the Markdown body`)
+		}
+	default:
+		return errors.Errorf(`invalid value %q for field "params.body_format". Must be one of "text" or "markdown"`, indata.Params.BodyFormat)
+	}
+
+	switch indata.Params.failOnRejectedRecipient() {
+	case FailOnRejectedNever, FailOnRejectedAny, FailOnRejectedAll:
+	default:
+		return errors.Errorf(`invalid value %q for field "params.fail_on_rejected_recipient". Must be one of "never", "any" or "all"`, indata.Params.FailOnRejectedRecipient)
+	}
+
+	recomposed := indata.Source.transport() == TransportSendGrid || indata.Source.transport() == TransportPostmark
+	if indata.Source.PGP.configured() || indata.Params.PGPKeyring != "" {
+		if recomposed {
+			return errors.Errorf(`"source.pgp" cannot be used with transport %q, which composes the message again`, indata.Source.transport())
+		}
+		if indata.Source.SMIME.configured() {
+			return errors.New(`"source.smime" and "source.pgp" cannot be used together`)
+		}
+		if _, err := indata.Source.PGP.signingKey(); err != nil {
+			return err
+		}
+		if _, err := indata.Source.PGP.publicKeys(nil); err != nil {
+			return err
+		}
+	}
+	if indata.Source.SMIME.configured() {
+		if recomposed {
+			return errors.Errorf(`"source.smime" cannot be used with transport %q, which composes the message again`, indata.Source.transport())
+		}
+		if _, err := indata.Source.SMIME.keys(); err != nil {
+			return err
+		}
+	}
+	if indata.Source.DKIM.configured() {
+		if recomposed {
+			return errors.Errorf(`"source.dkim" cannot be used with transport %q, which composes the message again. Set up DKIM signing with the provider instead`, indata.Source.transport())
+		}
+		from, _ := parseSender(indata.Source.From)
+		if _, err := indata.Source.DKIM.signOptions(from.Address); err != nil {
+			return err
+		}
+	}
+
+	switch indata.Source.transport() {
+	case TransportSendGrid:
+		return indata.Source.SendGrid.validate()
+	case TransportMailgun:
+		return indata.Source.Mailgun.validate()
+	case TransportSES:
+		return indata.Source.SES.validate()
+	case TransportPostmark:
+		return indata.Source.Postmark.validate()
+	case TransportMaildir:
+		return indata.Source.Maildir.validate()
+	case TransportMbox:
+		return indata.Source.Mbox.validate()
+	case TransportPickup:
+		return indata.Source.Pickup.validate()
+	}
+
+	if _, err := indata.Source.SMTP.Retry.policy(); err != nil {
+		return err
+	}
+	if _, err := indata.Source.SMTP.timeouts(); err != nil {
+		return err
+	}
+
+	switch indata.Source.SMTP.TLSMode {
+	case "", TLSModeStartTLS, TLSModeImplicit, TLSModeNone:
+	default:
+		return errors.Errorf(`invalid value %q for field "source.smtp.tls_mode". Must be one of "starttls", "implicit" or "none"`, indata.Source.SMTP.TLSMode)
+	}
+
+	if indata.Source.SMTP.TLSMode == TLSModeNone && indata.Source.SMTP.requiresTLS() {
+		return errors.New(`"source.smtp.tls_mode" is "none" but "source.smtp.require_tls" is enabled (the default when authenticating). Set require_tls: false to send without TLS`)
+	}
+
+	if (indata.Source.SMTP.ClientCert == "") != (indata.Source.SMTP.ClientKey == "") {
+		return errors.New(`"source.smtp.client_cert" and "source.smtp.client_key" must be specified together`)
+	}
+
+	if indata.Source.SMTP.ClientCert != "" && indata.Source.SMTP.TLSMode == TLSModeNone {
+		return errors.New(`"source.smtp.client_cert" requires TLS but "source.smtp.tls_mode" is "none"`)
+	}
+
+	switch indata.Source.SMTP.authMechanism() {
+	case AuthMechanismAuto, AuthMechanismCRAMMD5, AuthMechanismPlain, AuthMechanismLogin, AuthMechanismXOAuth2, AuthMechanismOAuthBearer:
+	default:
+		return errors.Errorf(`invalid value %q for field "source.smtp.auth_mechanism". Must be one of "auto", "cram-md5", "plain", "login", "xoauth2" or "oauthbearer"`, indata.Source.SMTP.AuthMechanism)
+	}
+
+	certAuth := indata.Source.SMTP.ClientCert != "" && indata.Source.SMTP.Username == "" && indata.Source.SMTP.Password == ""
+	if indata.Source.SMTP.Anonymous == false && !certAuth {
 		if indata.Source.SMTP.Username == "" {
 			return errors.New(`missing required field "source.smtp.username" if anonymous specify anonymous: true`)
 		}
 
-		if indata.Source.SMTP.Password == "" {
+		if indata.Source.SMTP.usesOAuth2() {
+			if indata.Source.SMTP.AccessToken == "" && indata.Source.SMTP.OAuth2.TokenURL == "" {
+				return errors.New(`missing required field "source.smtp.access_token" or "source.smtp.oauth2.token_url" when using OAuth2 authentication`)
+			}
+		} else if indata.Source.SMTP.Password == "" {
 			return errors.New(`missing required field "source.smtp.password" if anonymous specify anonymous: true`)
 		}
 	}
 	return nil
 }
 
+// hasHTMLContentType reports whether the headers set an HTML Content-Type,
+// the same way MailCreator.AddHeader detects HTML bodies.
+func hasHTMLContentType(headers []Header) bool {
+	for _, header := range headers {
+		if strings.EqualFold(header.Name, "Content-Type") && strings.Contains(header.Value, "text/html") {
+			return true
+		}
+	}
+	return false
+}
+
 func replaceTokens(sourceString string) string {
 	var buildTokens = map[string]string{
 		"${BUILD_ID}":            os.Getenv("BUILD_ID"),
@@ -228,25 +641,25 @@ func fromTextOrFile(sourceRoot, text, filePath string) (string, error) {
 	return "", nil
 }
 
-func sliceFromTextOrFile(sourceRoot, text, filePath string) ([]string, error) {
-	var returnList []string
+func addressesFromTextOrFile(sourceRoot, text, filePath string) ([]*mail.Address, error) {
+	var addresses []*mail.Address
 	if text != "" {
-		listArray := strings.Split(text, ",")
-		for _, item := range listArray {
-			returnList = append(returnList, strings.TrimSpace(item))
+		parsed, err := ParseAddresses(text)
+		if err != nil {
+			return nil, err
 		}
+		addresses = append(addresses, parsed...)
 	}
 	if filePath != "" {
 		fileList, err := readSource(sourceRoot, filePath)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Error reading file %s", filePath)
 		}
-		if len(fileList) > 0 {
-			listArray := strings.Split(fileList, ",")
-			for _, item := range listArray {
-				returnList = append(returnList, strings.TrimSpace(item))
-			}
+		parsed, err := ParseAddresses(fileList)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading file %s", filePath)
 		}
+		addresses = append(addresses, parsed...)
 	}
-	return returnList, nil
+	return addresses, nil
 }
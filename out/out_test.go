@@ -1,11 +1,21 @@
 package out_test
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -31,7 +41,7 @@ var _ = Describe("Out", func() {
 		Ω(err).ShouldNot(HaveOccurred())
 	})
 	BeforeEach(func() {
-		smtpServer = NewFakeSMTPServer()
+		smtpServer = NewFakeSMTPServerWithCustomCert("./test_certs/server.crt", "./test_certs/server.key")
 		smtpServer.Boot()
 
 		var err error
@@ -40,6 +50,7 @@ var _ = Describe("Out", func() {
 		inputs.Source.SMTP.Password = "some password"
 		inputs.Source.SMTP.Host = smtpServer.Host
 		inputs.Source.SMTP.Port = smtpServer.Port
+		inputs.Source.SMTP.SkipSSLValidation = true
 
 		inputs.Source.To = []string{"recipient@example.com", "recipient+2@example.com"}
 		inputs.Source.From = "sender@example.com"
@@ -129,6 +140,522 @@ even empty lines
 		})
 	})
 
+	Describe("TLS modes", func() {
+		var tlsServer *FakeSMTPServer
+
+		AfterEach(func() {
+			tlsServer.Close()
+		})
+
+		Context("when the server only accepts implicit TLS", func() {
+			BeforeEach(func() {
+				tlsServer = NewFakeSMTPServerWithImplicitTLS("./test_certs/server.crt", "./test_certs/server.key")
+				tlsServer.Boot()
+
+				inputs.Source.SMTP.Host = tlsServer.Host
+				inputs.Source.SMTP.Port = tlsServer.Port
+				inputs.Source.SMTP.TLSMode = "implicit"
+			})
+
+			Context("and the server certificate is trusted", func() {
+				BeforeEach(func() {
+					inputs.Source.SMTP.SkipSSLValidation = true
+					// smtpd only offers AUTH after STARTTLS
+					inputs.Source.SMTP.Anonymous = true
+				})
+
+				It("sends the email over the TLS connection", func() {
+					output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(output).ToNot(BeEmpty())
+
+					Expect(tlsServer.Deliveries).To(HaveLen(1))
+					Expect(tlsServer.Deliveries[0].Sender).To(Equal("sender@example.com"))
+				})
+			})
+
+			Context("and the server certificate is not trusted", func() {
+				BeforeEach(func() {
+					inputs.Source.SMTP.SkipSSLValidation = false
+				})
+
+				It("fails with an error", func() {
+					output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("Error Dialing smtp server with implicit TLS"))
+					Expect(output).To(BeEmpty())
+					Expect(tlsServer.Deliveries).To(HaveLen(0))
+				})
+			})
+		})
+
+		Context("when the server supports STARTTLS", func() {
+			BeforeEach(func() {
+				tlsServer = NewFakeSMTPServerWithCustomCert("./test_certs/server.crt", "./test_certs/server.key")
+				tlsServer.Boot()
+
+				inputs.Source.SMTP.Host = tlsServer.Host
+				inputs.Source.SMTP.Port = tlsServer.Port
+				inputs.Source.SMTP.SkipSSLValidation = true
+			})
+
+			It("upgrades the connection by default", func() {
+				_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tlsServer.Peers).To(HaveLen(1))
+				Expect(tlsServer.Peers[0].TLS).ToNot(BeNil())
+			})
+
+			Context("and 'tls_mode' is 'none'", func() {
+				BeforeEach(func() {
+					inputs.Source.SMTP.TLSMode = "none"
+					inputs.Source.SMTP.Anonymous = true
+				})
+
+				It("sends the email without upgrading the connection", func() {
+					_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(tlsServer.Peers).To(HaveLen(1))
+					Expect(tlsServer.Peers[0].TLS).To(BeNil())
+				})
+			})
+		})
+
+		Context("when the server does not support STARTTLS", func() {
+			BeforeEach(func() {
+				tlsServer = NewFakeSMTPServer()
+				tlsServer.Boot()
+
+				inputs.Source.SMTP.Host = tlsServer.Host
+				inputs.Source.SMTP.Port = tlsServer.Port
+			})
+
+			failWithRequireTLSError := func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("SMTP server does not advertise STARTTLS"))
+				Expect(output).To(BeEmpty())
+				Expect(tlsServer.Deliveries).To(HaveLen(0))
+			}
+
+			sendInCleartext := func() {
+				_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(tlsServer.Peers).To(HaveLen(1))
+				Expect(tlsServer.Peers[0].TLS).To(BeNil())
+			}
+
+			Context("and credentials are configured", func() {
+				It("refuses to send in cleartext", failWithRequireTLSError)
+
+				Context("and 'require_tls' is 'false'", func() {
+					BeforeEach(func() {
+						requireTLS := false
+						inputs.Source.SMTP.RequireTLS = &requireTLS
+					})
+
+					It("continues in cleartext until the server fails to offer AUTH", func() {
+						output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+						Expect(err).To(HaveOccurred())
+						Expect(err.Error()).To(ContainSubstring("SMTP server does not advertise AUTH but credentials were configured"))
+						Expect(output).To(BeEmpty())
+						Expect(tlsServer.Deliveries).To(HaveLen(0))
+					})
+
+					Context("and the server offers AUTH", func() {
+						var saslServer *FakeSASLServer
+
+						BeforeEach(func() {
+							saslServer = NewFakeSASLServer("PLAIN")
+							saslServer.Boot()
+
+							inputs.Source.SMTP.Host = saslServer.Host
+							inputs.Source.SMTP.Port = saslServer.Port
+						})
+
+						AfterEach(func() {
+							saslServer.Close()
+						})
+
+						It("authenticates and sends the email in cleartext", func() {
+							output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+							Expect(err).ToNot(HaveOccurred())
+							Expect(output).ToNot(BeEmpty())
+
+							Expect(saslServer.AuthMechanism).To(Equal("PLAIN"))
+							Expect(saslServer.AuthResponse).To(Equal("\x00some username\x00some password"))
+							Expect(saslServer.Deliveries).To(Equal(1))
+						})
+					})
+				})
+			})
+
+			Context("and 'anonymous' is 'true'", func() {
+				BeforeEach(func() {
+					inputs.Source.SMTP.Anonymous = true
+				})
+
+				It("sends the email in cleartext", sendInCleartext)
+
+				Context("and 'require_tls' is 'true'", func() {
+					BeforeEach(func() {
+						requireTLS := true
+						inputs.Source.SMTP.RequireTLS = &requireTLS
+					})
+
+					It("refuses to send in cleartext", failWithRequireTLSError)
+				})
+			})
+		})
+
+		Context("when 'tls_mode' is 'none' and TLS is required", func() {
+			BeforeEach(func() {
+				tlsServer = NewFakeSMTPServer()
+				tlsServer.Boot()
+				inputs.Source.SMTP.TLSMode = "none"
+			})
+
+			It("returns a configuration error", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(`Invalid configuration: "source.smtp.tls_mode" is "none" but "source.smtp.require_tls" is enabled (the default when authenticating). Set require_tls: false to send without TLS`))
+				Expect(output).To(BeEmpty())
+			})
+		})
+
+		Context("when 'tls_mode' is not a known mode", func() {
+			BeforeEach(func() {
+				tlsServer = NewFakeSMTPServer()
+				tlsServer.Boot()
+				inputs.Source.SMTP.TLSMode = "sometimes"
+			})
+
+			It("returns a configuration error", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(`Invalid configuration: invalid value "sometimes" for field "source.smtp.tls_mode". Must be one of "starttls", "implicit" or "none"`))
+				Expect(output).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Using a client certificate", func() {
+		var mtlsServer *FakeSMTPServer
+
+		readCert := func(path string) string {
+			contents, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			return string(contents)
+		}
+
+		BeforeEach(func() {
+			inputs.Source.SMTP.Username = ""
+			inputs.Source.SMTP.Password = ""
+			inputs.Source.SMTP.ClientCert = readCert("./test_certs/client.crt")
+			inputs.Source.SMTP.ClientKey = readCert("./test_certs/client.key")
+		})
+
+		AfterEach(func() {
+			mtlsServer.Close()
+		})
+
+		verifyClientCertificate := func() {
+			output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).ToNot(BeEmpty())
+
+			Expect(mtlsServer.Peers).To(HaveLen(1))
+			Expect(mtlsServer.Peers[0].TLS).ToNot(BeNil())
+			Expect(mtlsServer.Peers[0].TLS.PeerCertificates).ToNot(BeEmpty())
+			Expect(mtlsServer.Peers[0].TLS.PeerCertificates[0].Subject.CommonName).To(Equal("email-resource"))
+		}
+
+		Context("when the server uses STARTTLS", func() {
+			BeforeEach(func() {
+				mtlsServer = NewFakeSMTPServerWithCustomCert("./test_certs/server.crt", "./test_certs/server.key")
+				mtlsServer.RequireClientCert("./test_certs/clientCA.pem")
+				mtlsServer.Boot()
+
+				inputs.Source.SMTP.Host = mtlsServer.Host
+				inputs.Source.SMTP.Port = mtlsServer.Port
+			})
+
+			It("authenticates with the client certificate", verifyClientCertificate)
+
+			Context("when no client certificate is configured", func() {
+				BeforeEach(func() {
+					inputs.Source.SMTP.ClientCert = ""
+					inputs.Source.SMTP.ClientKey = ""
+					inputs.Source.SMTP.Anonymous = true
+				})
+
+				It("fails to start TLS", func() {
+					output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("unable to start TLS"))
+					Expect(output).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the server uses implicit TLS", func() {
+			BeforeEach(func() {
+				mtlsServer = NewFakeSMTPServerWithImplicitTLS("./test_certs/server.crt", "./test_certs/server.key")
+				mtlsServer.RequireClientCert("./test_certs/clientCA.pem")
+				mtlsServer.Boot()
+
+				inputs.Source.SMTP.Host = mtlsServer.Host
+				inputs.Source.SMTP.Port = mtlsServer.Port
+				inputs.Source.SMTP.TLSMode = "implicit"
+			})
+
+			It("sends the email", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(output).ToNot(BeEmpty())
+				Expect(mtlsServer.Deliveries).To(HaveLen(1))
+			})
+		})
+
+		Context("when the client key is missing", func() {
+			BeforeEach(func() {
+				mtlsServer = NewFakeSMTPServer()
+				mtlsServer.Boot()
+				inputs.Source.SMTP.ClientKey = ""
+			})
+
+			It("returns a configuration error", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(`Invalid configuration: "source.smtp.client_cert" and "source.smtp.client_key" must be specified together`))
+				Expect(output).To(BeEmpty())
+			})
+		})
+
+		Context("when the client key does not match the certificate", func() {
+			BeforeEach(func() {
+				mtlsServer = NewFakeSMTPServerWithCustomCert("./test_certs/server.crt", "./test_certs/server.key")
+				mtlsServer.Boot()
+
+				inputs.Source.SMTP.Host = mtlsServer.Host
+				inputs.Source.SMTP.Port = mtlsServer.Port
+				inputs.Source.SMTP.ClientKey = readCert("./test_certs/server.key")
+			})
+
+			It("returns an error", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("unable to load client certificate"))
+				Expect(output).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("Authentication", func() {
+		It("authenticates with the configured credentials", func() {
+			_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(smtpServer.Peers).To(HaveLen(1))
+			Expect(smtpServer.Peers[0].Username).To(Equal("some username"))
+			Expect(smtpServer.Peers[0].Password).To(Equal("some password"))
+		})
+
+		Context("when the mechanism is pinned to one the server supports", func() {
+			BeforeEach(func() {
+				inputs.Source.SMTP.AuthMechanism = "plain"
+			})
+
+			It("authenticates with that mechanism", func() {
+				_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(smtpServer.Peers[0].Username).To(Equal("some username"))
+			})
+		})
+
+		Context("when the mechanism is pinned to one the server does not support", func() {
+			BeforeEach(func() {
+				inputs.Source.SMTP.AuthMechanism = "cram-md5"
+			})
+
+			It("returns an error", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("SMTP server does not support auth mechanism CRAM-MD5, it advertises: PLAIN LOGIN"))
+				Expect(output).To(BeEmpty())
+				Expect(smtpServer.Deliveries).To(HaveLen(0))
+			})
+		})
+
+		Context("when the server does not offer AUTH", func() {
+			var noAuthServer *FakeSMTPServer
+
+			BeforeEach(func() {
+				noAuthServer = NewFakeSMTPServerWithCustomCert("./test_certs/server.crt", "./test_certs/server.key")
+				noAuthServer.DisableAuth()
+				noAuthServer.Boot()
+
+				inputs.Source.SMTP.Host = noAuthServer.Host
+				inputs.Source.SMTP.Port = noAuthServer.Port
+			})
+
+			AfterEach(func() {
+				noAuthServer.Close()
+			})
+
+			It("fails instead of sending unauthenticated", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("SMTP server does not advertise AUTH but credentials were configured"))
+				Expect(output).To(BeEmpty())
+				Expect(noAuthServer.Deliveries).To(HaveLen(0))
+			})
+
+			Context("and 'anonymous' is 'true'", func() {
+				BeforeEach(func() {
+					inputs.Source.SMTP.Anonymous = true
+				})
+
+				It("sends the email", func() {
+					_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(noAuthServer.Deliveries).To(HaveLen(1))
+				})
+			})
+		})
+
+		Context("when the server offers CRAM-MD5", func() {
+			var saslServer *FakeSASLServer
+
+			BeforeEach(func() {
+				saslServer = NewFakeSASLServer("PLAIN", "LOGIN", "CRAM-MD5")
+				saslServer.Boot()
+
+				requireTLS := false
+				inputs.Source.SMTP.Host = saslServer.Host
+				inputs.Source.SMTP.Port = saslServer.Port
+				inputs.Source.SMTP.RequireTLS = &requireTLS
+			})
+
+			AfterEach(func() {
+				saslServer.Close()
+			})
+
+			It("prefers CRAM-MD5 over the other mechanisms", func() {
+				_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+
+				mac := hmac.New(md5.New, []byte("some password"))
+				mac.Write([]byte(saslServer.Challenge))
+				Expect(saslServer.AuthMechanism).To(Equal("CRAM-MD5"))
+				Expect(saslServer.AuthResponse).To(Equal("some username " + hex.EncodeToString(mac.Sum(nil))))
+				Expect(saslServer.Deliveries).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("Using OAuth2 authentication", func() {
+		var tokenServer *httptest.Server
+		var tokenRequests int
+		var saslServer *FakeSASLServer
+
+		BeforeEach(func() {
+			saslServer = NewFakeSASLServer("PLAIN", "XOAUTH2")
+			saslServer.Boot()
+
+			requireTLS := false
+			inputs.Source.SMTP.Host = saslServer.Host
+			inputs.Source.SMTP.Port = saslServer.Port
+			inputs.Source.SMTP.RequireTLS = &requireTLS
+
+			tokenRequests = 0
+			tokenServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tokenRequests++
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"access_token":"some-access-token","token_type":"Bearer"}`))
+			}))
+
+			inputs.Source.SMTP.Password = ""
+			inputs.Source.SMTP.AuthMechanism = "xoauth2"
+		})
+
+		AfterEach(func() {
+			tokenServer.Close()
+			saslServer.Close()
+		})
+
+		Context("when a token endpoint is configured", func() {
+			BeforeEach(func() {
+				inputs.Source.SMTP.OAuth2.TokenURL = tokenServer.URL
+				inputs.Source.SMTP.OAuth2.ClientID = "some-client"
+				inputs.Source.SMTP.OAuth2.RefreshToken = "some-refresh-token"
+			})
+
+			It("fetches an access token and sends the email", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(output).ToNot(BeEmpty())
+				Expect(tokenRequests).To(Equal(1))
+				Expect(saslServer.AuthMechanism).To(Equal("XOAUTH2"))
+				Expect(saslServer.AuthResponse).To(Equal("user=some username\x01auth=Bearer some-access-token\x01\x01"))
+				Expect(saslServer.Deliveries).To(Equal(1))
+			})
+
+			Context("when the token endpoint fails", func() {
+				BeforeEach(func() {
+					tokenServer.Config.Handler = http.NotFoundHandler()
+				})
+
+				It("returns an error without sending the email", func() {
+					output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("Error fetching access token"))
+					Expect(output).To(BeEmpty())
+					Expect(saslServer.Deliveries).To(Equal(0))
+				})
+			})
+		})
+
+		Context("when a static access token is configured", func() {
+			BeforeEach(func() {
+				inputs.Source.SMTP.AccessToken = "some-static-token"
+				inputs.Source.SMTP.OAuth2.TokenURL = tokenServer.URL
+			})
+
+			It("does not call the token endpoint", func() {
+				_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tokenRequests).To(Equal(0))
+				Expect(saslServer.AuthResponse).To(ContainSubstring("auth=Bearer some-static-token"))
+			})
+		})
+
+		Context("when neither an access token nor a token endpoint is configured", func() {
+			It("returns a configuration error", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(`Invalid configuration: missing required field "source.smtp.access_token" or "source.smtp.oauth2.token_url" when using OAuth2 authentication`))
+				Expect(output).To(BeEmpty())
+			})
+		})
+
+		Context("when the auth mechanism is unknown", func() {
+			BeforeEach(func() {
+				inputs.Source.SMTP.AuthMechanism = "kerberos"
+			})
+
+			It("returns a configuration error", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(`Invalid configuration: invalid value "kerberos" for field "source.smtp.auth_mechanism". Must be one of "auto", "cram-md5", "plain", "login", "xoauth2" or "oauthbearer"`))
+				Expect(output).To(BeEmpty())
+			})
+		})
+	})
+
 	It("should report the current time as a version and exit 0", func() {
 		output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
 		Expect(err).ToNot(HaveOccurred())
@@ -142,15 +669,82 @@ even empty lines
 		Expect(untyped).To(HaveKey("version"))
 	})
 
-	It("should report all the expected metadata fields", func() {
+	It("should report the message id but not the message in the version", func() {
 		output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
 		Expect(err).ToNot(HaveOccurred())
-		Expect(output).ToNot(BeEmpty())
 		var outdata out.Output
 		Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
-		Expect(outdata.Metadata).To(ContainElement(Equal(out.MetadataItem{Name: "smtp_host", Value: smtpServer.Host})))
-		Expect(outdata.Metadata).To(ContainElement(Equal(out.MetadataItem{Name: "subject", Value: "some subject line"})))
-		Expect(outdata.Metadata).To(ContainElement(Equal(out.MetadataItem{Name: "version", Value: "the-version"})))
+		Expect(outdata.Version.MessageID).To(MatchRegexp(`^<[0-9]+\.[0-9a-f]+@example\.com>$`))
+		Expect(outdata.Version.Message).To(BeEmpty())
+		Expect(outdata.Metadata).To(ContainElement(Equal(out.MetadataItem{Name: "message_id", Value: outdata.Version.MessageID})))
+		Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("Message-ID: " + outdata.Version.MessageID))
+
+		var untyped struct {
+			Version map[string]interface{}
+		}
+		Expect(json.Unmarshal([]byte(output), &untyped)).To(Succeed())
+		Expect(untyped.Version).To(HaveLen(2))
+	})
+
+	Context("when 'include_message_in_version' is set", func() {
+		BeforeEach(func() {
+			inputs.Params.IncludeMessageInVersion = true
+		})
+
+		It("should report the sent message in the version", func() {
+			output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			var outdata out.Output
+			Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+
+			message := decodeVersionMessage(outdata.Version.Message)
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			Expect(message).To(ContainSubstring("Message-ID: " + outdata.Version.MessageID + "\r\n"))
+			Expect(message).To(ContainSubstring("Subject: some subject line"))
+		})
+
+		Context("when the message is too large for the version", func() {
+			BeforeEach(func() {
+				random := make([]byte, 64*1024)
+				_, err := rand.Read(random)
+				Expect(err).ToNot(HaveOccurred())
+				createSource("attachments/random.bin", string(random))
+				inputs.Params.AttachmentGlobs = []string{"attachments/*.bin"}
+			})
+
+			It("fails before sending it", func() {
+				_, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(MatchRegexp(`^message is [0-9]+ bytes compressed and encoded, more than the 65536 bytes allowed by "params.include_message_in_version"$`))
+				Expect(smtpServer.Deliveries).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when a Message-ID header is provided", func() {
+		BeforeEach(func() {
+			createSource("headers.txt", "Message-ID: <custom@example.com>")
+			inputs.Params.Headers = "headers.txt"
+		})
+
+		It("uses it as the message id", func() {
+			output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			var outdata out.Output
+			Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+			Expect(outdata.Version.MessageID).To(Equal("<custom@example.com>"))
+		})
+	})
+
+	It("should report all the expected metadata fields", func() {
+		output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output).ToNot(BeEmpty())
+		var outdata out.Output
+		Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+		Expect(outdata.Metadata).To(ContainElement(Equal(out.MetadataItem{Name: "smtp_host", Value: smtpServer.Host})))
+		Expect(outdata.Metadata).To(ContainElement(Equal(out.MetadataItem{Name: "subject", Value: "some subject line"})))
+		Expect(outdata.Metadata).To(ContainElement(Equal(out.MetadataItem{Name: "version", Value: "the-version"})))
 	})
 
 	It("should send an email", func() {
@@ -169,228 +763,1066 @@ it has many lines
 
 even empty lines
 
-!`))
+!`))
+	})
+
+	Context("when the 'Subject' parameter is empty", func() {
+		BeforeEach(func() {
+			inputs.Params.Subject = ""
+		})
+
+		Context("but the 'SubjectText' paramter is given", func() {
+			BeforeEach(func() {
+				inputs.Params.SubjectText = "some subject line"
+			})
+
+			It("succeeds and sends an email", func() {
+				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(output).ToNot(BeEmpty())
+
+				Expect(smtpServer.Deliveries).To(HaveLen(1))
+				delivery := smtpServer.Deliveries[0]
+				Expect(string(delivery.Data)).To(ContainSubstring("some subject line"))
+			})
+		})
+
+		Context("and the 'SubjectText' paramter is empty", func() {
+			It("returns an error", func() {
+				inputBytes, err := json.Marshal(inputs)
+				Expect(err).NotTo(HaveOccurred())
+
+				output, err := out.Execute(sourceRoot, "", inputBytes)
+				Expect(err).Should(HaveOccurred())
+				Expect(err.Error()).Should(BeEquivalentTo(`Invalid configuration: missing required field "params.subject" or "params.subject_text". Must specify at least one`))
+				Expect(output).To(BeEmpty())
+				Expect(smtpServer.Deliveries).To(HaveLen(0))
+			})
+		})
+	})
+
+	Context("when the subject has an extra newline", func() {
+		BeforeEach(func() {
+			createSource(inputs.Params.Subject, "some subject line\n\n")
+		})
+
+		It("strips the extra newline", func() {
+			output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(output).ToNot(BeEmpty())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			delivery := smtpServer.Deliveries[0]
+			Expect(string(delivery.Data)).To(ContainSubstring("some subject line"))
+
+		})
+	})
+
+	Context("when the subject has template syntax", func() {
+		BeforeEach(func() {
+			os.Setenv("BUILD_ID", "5")
+			createSource(inputs.Params.Subject, "some subject line for #${BUILD_ID}")
+		})
+		var subject string
+
+		verifyTemplateInterpolation := func() {
+			out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			delivery := smtpServer.Deliveries[0]
+			Expect(string(delivery.Data)).To(ContainSubstring("some subject line for #5"))
+		}
+
+		BeforeEach(func() {
+			os.Setenv("BUILD_ID", "5")
+			subject = "some subject line for #${BUILD_ID}"
+		})
+
+		Context("when the subject is given as file", func() {
+			BeforeEach(func() {
+				createSource(inputs.Params.Subject, subject)
+			})
+
+			It("interpolates the template", verifyTemplateInterpolation)
+		})
+
+		Context("when the subject is given as text", func() {
+			BeforeEach(func() {
+				inputs.Params.Subject = ""
+				inputs.Params.SubjectText = subject
+			})
+
+			It("interpolates the template", verifyTemplateInterpolation)
+		})
+	})
+
+	Context("when templating is enabled", func() {
+		BeforeEach(func() {
+			os.Setenv("BUILD_ID", "5")
+			os.Setenv("BUILD_NAME", "12")
+			os.Setenv("BUILD_JOB_NAME", "deploy")
+			os.Setenv("BUILD_PIPELINE_NAME", "main")
+			os.Setenv("BUILD_TEAM_NAME", "ops")
+			os.Setenv("ATC_EXTERNAL_URL", "https://ci.example.com")
+			os.Setenv("DEPLOY_TARGET", "production")
+
+			inputs.Params.Template = true
+			inputs.Params.Vars = map[string]interface{}{"release": "v1.2.3"}
+			createSource(inputs.Params.Subject, "{{ .Build.JobName }} #{{ .Build.Name }} released {{ .Vars.release }}")
+			createSource(inputs.Params.Body, "Deployed to {{ .Env.DEPLOY_TARGET }}\n{{ .Build.URL }}")
+		})
+
+		AfterEach(func() {
+			for _, name := range []string{"BUILD_NAME", "BUILD_JOB_NAME", "BUILD_PIPELINE_NAME", "BUILD_TEAM_NAME", "ATC_EXTERNAL_URL", "DEPLOY_TARGET"} {
+				os.Unsetenv(name)
+			}
+		})
+
+		It("renders the subject and body with build metadata, environment variables and vars", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			data := string(smtpServer.Deliveries[0].Data)
+			Expect(data).To(ContainSubstring("Subject: deploy #12 released v1.2.3"))
+			Expect(data).To(ContainSubstring("Deployed to production\nhttps://ci.example.com/teams/ops/pipelines/main/jobs/deploy/builds/12"))
+		})
+
+		It("renders the headers", func() {
+			createSource("headers.txt", "X-Release: {{ .Vars.release }}")
+			inputs.Params.Headers = "headers.txt"
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("X-Release: v1.2.3"))
+		})
+
+		It("reads files, JSON and YAML from the inputs", func() {
+			createSource("release/notes.txt", "Fixed everything")
+			createSource("release/info.json", `{"commits": [{"sha": "abc123"}]}`)
+			createSource("release/info.yml", "owner:\n  name: Platform Team\n")
+			createSource(inputs.Params.Body, `{{ readFile "release/notes.txt" }}
+{{ range (readJSON "release/info.json").commits }}{{ .sha }}{{ end }}
+{{ (readYAML "release/info.yml").owner.name }}`)
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			data := string(smtpServer.Deliveries[0].Data)
+			Expect(data).To(ContainSubstring("Fixed everything"))
+			Expect(data).To(ContainSubstring("abc123"))
+			Expect(data).To(ContainSubstring("Platform Team"))
+		})
+
+		It("refuses to read files outside of the inputs", func() {
+			createSource(inputs.Params.Body, `{{ readFile "../../etc/passwd" }}`)
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("is outside of the put's input directories"))
+			Expect(smtpServer.Deliveries).To(BeEmpty())
+		})
+
+		It("escapes values in HTML bodies", func() {
+			createSource("headers.txt", "Content-Type: text/html; charset=UTF-8")
+			inputs.Params.Headers = "headers.txt"
+			inputs.Params.Vars["release"] = "<b>v1.2.3</b>"
+			createSource(inputs.Params.Body, "<p>{{ .Vars.release }}</p>")
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("&lt;b&gt;v1.2.3&lt;/b&gt;"))
+		})
+
+		It("returns an error when a var is missing", func() {
+			createSource(inputs.Params.Body, "{{ .Vars.unknown }}")
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unable to render body template"))
+		})
+
+		It("leaves template syntax alone when templating is disabled", func() {
+			inputs.Params.Template = false
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("{{ .Build.JobName }}"))
+		})
+	})
+
+	Context("when a headers file is provided", func() {
+		var headers string
+
+		BeforeEach(func() {
+			headers = `Header-1: value
+Header-2: value`
+
+			headersFilePath := "some/path/to/headers.txt"
+			createSource(headersFilePath, headers)
+			inputs.Params.Headers = headersFilePath
+		})
+
+		It("should add the headers to the email", func() {
+			out.Execute(sourceRoot, "", []byte(inputdata))
+
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			delivery := smtpServer.Deliveries[0]
+			Expect(string(delivery.Data)).To(ContainSubstring("Header-1: value\n"))
+			Expect(string(delivery.Data)).To(ContainSubstring("Header-2: value\n"))
+			Expect(string(delivery.Data)).To(ContainSubstring(`
+this is a body
+it has many lines
+
+even empty lines
+
+!`))
+		})
+
+		Context("when a header is folded and its value contains a colon", func() {
+			BeforeEach(func() {
+				createSource(inputs.Params.Headers, "X-Link: https://example.com/a: b\nList-Unsubscribe: <mailto:leave@example.com>,\n <https://example.com/leave>\n")
+			})
+
+			It("adds the unfolded header", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(smtpServer.Deliveries).To(HaveLen(1))
+				data := string(smtpServer.Deliveries[0].Data)
+				Expect(data).To(ContainSubstring("X-Link: https://example.com/a: b\n"))
+				Expect(data).To(ContainSubstring("List-Unsubscribe: <mailto:leave@example.com>, <https://example.com/leave>\n"))
+			})
+		})
+
+		Context("when a header line is malformed", func() {
+			BeforeEach(func() {
+				createSource(inputs.Params.Headers, "Header-1: value\nHeader-2 value\n")
+			})
+
+			It("returns an error naming the line", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(`unable to parse headers from some/path/to/headers.txt: line 2: expected "Name: value" but got "Header-2 value"`))
+				Expect(smtpServer.Deliveries).To(BeEmpty())
+			})
+		})
+
+		Context("when a header has an extra newline", func() {
+			BeforeEach(func() {
+				headers = `Header-1: value-1
+Header-2: value-2
+Header-3: value-3
+
+
+`
+				createSource(inputs.Params.Headers, headers)
+			})
+
+			It("strips the extra newline", func() {
+				out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(smtpServer.Deliveries).To(HaveLen(1))
+				delivery := smtpServer.Deliveries[0]
+				Expect(string(delivery.Data)).To(ContainSubstring("Header-1: value-1\n"))
+				Expect(string(delivery.Data)).To(ContainSubstring("Header-2: value-2\n"))
+				Expect(string(delivery.Data)).To(ContainSubstring("Header-3: value-3\n"))
+			})
+		})
+	})
+
+	Context("when a headers map is provided", func() {
+		BeforeEach(func() {
+			os.Setenv("BUILD_ID", "5")
+			inputs.Params.HeadersMap = map[string]interface{}{
+				"X-Tag":      []interface{}{"nightly", "build-${BUILD_ID}"},
+				"X-Priority": 1,
+			}
+		})
+
+		It("adds every header with tokens replaced", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("X-Priority: 1\nX-Tag: nightly\nX-Tag: build-5\n"))
+		})
+
+		It("keeps large numbers as given", func() {
+			inputs.Params.HeadersMap = map[string]interface{}{"X-Build": 1234567}
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("X-Build: 1234567\n"))
+		})
+
+		Context("and a headers file", func() {
+			BeforeEach(func() {
+				createSource("headers.txt", "X-Tag: from-file")
+				inputs.Params.Headers = "headers.txt"
+			})
+
+			It("adds the headers from the file first", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(smtpServer.Deliveries).To(HaveLen(1))
+				Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("X-Tag: from-file\nX-Priority: 1\nX-Tag: nightly\nX-Tag: build-5\n"))
+			})
+		})
+
+		Context("and templating is enabled", func() {
+			BeforeEach(func() {
+				inputs.Params.Template = true
+				inputs.Params.Vars = map[string]interface{}{"channel": "stable"}
+				inputs.Params.HeadersMap = map[string]interface{}{"X-Channel": "{{ .Vars.channel }}"}
+			})
+
+			It("renders the header values", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(smtpServer.Deliveries).To(HaveLen(1))
+				Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("X-Channel: stable\n"))
+			})
+
+			Context("and a rendered value ends in a newline", func() {
+				BeforeEach(func() {
+					createSource("tag.txt", "v1.2\n")
+					inputs.Params.HeadersMap = map[string]interface{}{"X-Tag": `{{ readFile "tag.txt" }}`}
+				})
+
+				It("trims the newline so the header block stays intact", func() {
+					_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(smtpServer.Deliveries).To(HaveLen(1))
+
+					message, err := mail.ReadMessage(bytes.NewReader(smtpServer.Deliveries[0].Data))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(message.Header.Get("X-Tag")).To(Equal("v1.2"))
+					Expect(message.Header.Get("MIME-Version")).To(Equal("1.0"))
+				})
+			})
+
+			Context("and a rendered value contains a line break", func() {
+				BeforeEach(func() {
+					inputs.Params.Vars = map[string]interface{}{"v": "x\r\nBcc: evil@example.com"}
+					inputs.Params.HeadersMap = map[string]interface{}{"X-Tag": "{{ .Vars.v }}"}
+				})
+
+				It("should return an error", func() {
+					_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+					Expect(err).To(MatchError(`invalid "params.headers_map": value of header X-Tag contains a line break`))
+					Expect(smtpServer.Deliveries).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("and a value is invalid", func() {
+			BeforeEach(func() {
+				inputs.Params.HeadersMap = map[string]interface{}{"X-Injected": "a\nBcc: victim@example.com"}
+			})
+
+			It("should return an error", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(MatchError(`invalid "params.headers_map": value of header X-Injected contains a line break`))
+				Expect(smtpServer.Deliveries).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("body", func() {
+
+		verifyBody := func(expectedBody string) func() {
+			return func() {
+				output, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(output).ToNot(BeEmpty())
+
+				Expect(smtpServer.Deliveries).To(HaveLen(1))
+				delivery := smtpServer.Deliveries[0]
+
+				Expect(string(delivery.Data)).To(ContainSubstring(expectedBody))
+			}
+		}
+
+		Context("when body file is provided", func() {
+			BeforeEach(func() {
+				createSource(inputs.Params.Body, "some body")
+				inputs.Params.BodyText = ""
+			})
+
+			It("uses the text from the body file", verifyBody("some body"))
+		})
+
+		Context("when body text is provided", func() {
+			BeforeEach(func() {
+				inputs.Params.Body = ""
+				inputs.Params.BodyText = "some body"
+			})
+			It("uses the body text", verifyBody("some body"))
+		})
+
+		Context("when body text and body file is provided", func() {
+			BeforeEach(func() {
+				createSource(inputs.Params.Body, "some body from file")
+				inputs.Params.BodyText = "some body from text"
+			})
+			It("uses the body text", verifyBody("some body from text"))
+		})
+
+	})
+
+	Context("when an HTML body is provided", func() {
+		BeforeEach(func() {
+			inputs.Params.HTMLBody = "some/other/path/to/body.html"
+			createSource(inputs.Params.HTMLBody, "<h1>Report</h1><p>All <b>green</b></p>")
+		})
+
+		It("sends the plain and the HTML body as alternatives", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			data := string(smtpServer.Deliveries[0].Data)
+			Expect(data).To(ContainSubstring("Content-Type: multipart/alternative"))
+			Expect(data).To(ContainSubstring("Content-Type: text/plain; charset=UTF-8"))
+			Expect(data).To(ContainSubstring("this is a body"))
+			Expect(data).To(ContainSubstring("Content-Type: text/html; charset=UTF-8"))
+			Expect(data).To(ContainSubstring("<h1>Report</h1><p>All <b>green</b></p>"))
+		})
+
+		Context("and no plain body is provided", func() {
+			BeforeEach(func() {
+				inputs.Params.Body = ""
+				inputs.Params.HTMLBody = ""
+				inputs.Params.HTMLBodyText = "<h1>Report</h1><p>All <b>green</b></p>"
+			})
+
+			It("generates the plain body from the HTML", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(smtpServer.Deliveries).To(HaveLen(1))
+				data := string(smtpServer.Deliveries[0].Data)
+				Expect(data).To(ContainSubstring("\nReport\n"))
+				Expect(data).To(ContainSubstring("All green\n"))
+				Expect(data).To(ContainSubstring("<h1>Report</h1>"))
+			})
+		})
+	})
+
+	Context("when inline images are provided", func() {
+		BeforeEach(func() {
+			inputs.Params.HTMLBodyText = `<p><img src="cid:chart.png"></p>`
+			inputs.Params.InlineImages = []string{"charts/*.png"}
+			createSource("charts/chart.png", "\x89PNG\r\n\x1a\n")
+		})
+
+		It("embeds them in the HTML body", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			data := string(smtpServer.Deliveries[0].Data)
+			Expect(data).To(ContainSubstring("Content-Type: multipart/related;"))
+			Expect(data).To(ContainSubstring("Content-Type: image/png; name=chart.png"))
+			Expect(data).To(ContainSubstring("Content-Disposition: inline; filename=chart.png"))
+			Expect(data).To(ContainSubstring("Content-ID: <chart.png>"))
+		})
+
+		Context("and an image name cannot be used as a Content-ID", func() {
+			BeforeEach(func() {
+				createSource("charts/build status.png", "\x89PNG\r\n\x1a\n")
+			})
+
+			It("should return an error", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(`inline image name "build status.png" cannot be used as a Content-ID`))
+				Expect(smtpServer.Deliveries).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the body format is markdown", func() {
+		BeforeEach(func() {
+			inputs.Params.BodyFormat = "markdown"
+			createSource(inputs.Params.Body, "# Release\n\n* fixed *everything*\n")
+		})
+
+		It("sends the rendered HTML and keeps the Markdown as plain text", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			data := string(smtpServer.Deliveries[0].Data)
+			Expect(data).To(ContainSubstring("Content-Type: multipart/alternative"))
+			Expect(data).To(ContainSubstring("# Release"))
+			Expect(data).To(ContainSubstring("* fixed *everything*"))
+			Expect(data).To(ContainSubstring("<h1>Release</h1>"))
+			Expect(data).To(ContainSubstring("<li>fixed <em>everything</em></li>"))
+		})
+
+		Context("and an HTML body is given as well", func() {
+			BeforeEach(func() {
+				inputs.Params.HTMLBodyText = "<p>hello</p>"
+			})
+
+			It("should return an error", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(`Invalid configuration: "params.body_format" is "markdown" but "params.html_body" or "params.html_body_text" is set. The HTML body is rendered from the Markdown body`))
+			})
+		})
+	})
+
+	Context("when the body format is unknown", func() {
+		BeforeEach(func() {
+			inputs.Params.BodyFormat = "rst"
+		})
+
+		It("should return an error", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(`Invalid configuration: invalid value "rst" for field "params.body_format". Must be one of "text" or "markdown"`))
+		})
+	})
+
+	Context("when the body and the body_text is empty", func() {
+		BeforeEach(func() {
+			inputs.Params.Body = ""
+			inputs.Params.BodyText = ""
+		})
+
+		Context("when the 'SendEmptyBody' parameter is true", func() {
+			BeforeEach(func() {
+				inputs.Params.SendEmptyBody = true
+			})
+			It("should succeed and send a message with an empty body", func() {
+				inputBytes, err := json.Marshal(inputs)
+				Expect(err).NotTo(HaveOccurred())
+
+				output, err := out.Execute(sourceRoot, "", inputBytes)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(output).ShouldNot(BeEmpty())
+				Expect(smtpServer.Deliveries).To(HaveLen(1))
+				delivery := smtpServer.Deliveries[0]
+				Expect(string(delivery.Data)).To(ContainSubstring("some subject line"))
+			})
+		})
+		Context("when the 'SendEmptyBody' parameter is false", func() {
+			BeforeEach(func() {
+				inputs.Params.SendEmptyBody = false
+			})
+
+			It("should not return an error and not send a message", func() {
+				inputBytes, err := json.Marshal(inputs)
+				Expect(err).NotTo(HaveOccurred())
+
+				output, err := out.Execute(sourceRoot, "", inputBytes)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(output).ShouldNot(BeEmpty())
+				Expect(smtpServer.Deliveries).To(HaveLen(0))
+			})
+		})
+	})
+
+	Context("when recipients have display names", func() {
+		BeforeEach(func() {
+			inputs.Source.From = `"Build Bot" <sender@example.com>`
+			inputs.Source.To = []string{`"Doe, Jane" <jane@example.com>`}
+			inputs.Params.CcText = "John Smith <john@example.com>"
+		})
+
+		It("keeps the names in the headers and sends to the bare addresses", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			delivery := smtpServer.Deliveries[0]
+			Expect(delivery.Sender).To(Equal("sender@example.com"))
+			Expect(delivery.Recipients).To(Equal([]string{"jane@example.com", "recipient+3@example.com", "john@example.com"}))
+			Expect(string(delivery.Data)).To(ContainSubstring(`From: "Build Bot" <sender@example.com>`))
+			Expect(string(delivery.Data)).To(ContainSubstring(`To: "Doe, Jane" <jane@example.com>,recipient+3@example.com`))
+			Expect(string(delivery.Data)).To(ContainSubstring(`Cc: "John Smith" <john@example.com>`))
+		})
+	})
+
+	Context("when the recipients file is separated by semicolons and new lines", func() {
+		BeforeEach(func() {
+			inputs.Source.To = nil
+			createSource(inputs.Params.To, "one@example.com; two@example.com\nthree@example.com,\n\n")
+		})
+
+		It("sends to every address", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			Expect(smtpServer.Deliveries[0].Recipients).To(Equal([]string{"one@example.com", "two@example.com", "three@example.com"}))
+		})
+	})
+
+	Context("when an address appears in more than one list", func() {
+		BeforeEach(func() {
+			inputs.Params.CcText = "Recipient@example.com, cc@example.com"
+			inputs.Params.BccText = "cc@example.com, recipient+3@example.com, bcc@example.com"
+		})
+
+		It("sends to it only once", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			Expect(smtpServer.Deliveries[0].Recipients).To(Equal([]string{
+				"recipient@example.com", "recipient+2@example.com", "recipient+3@example.com", "cc@example.com", "bcc@example.com",
+			}))
+			Expect(string(smtpServer.Deliveries[0].Data)).To(ContainSubstring("Cc: cc@example.com\n"))
+		})
+	})
+
+	Context("when an address is invalid", func() {
+		It("fails before connecting for an address in source", func() {
+			inputs.Source.Cc = []string{"not an address"}
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			output, err := out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal(`Invalid configuration: invalid "source.cc": invalid address "not an address": no angle-addr`))
+			Expect(output).To(BeEmpty())
+			Expect(smtpServer.Peers).To(BeEmpty())
+		})
+
+		It("fails before connecting for an address in a file", func() {
+			createSource(inputs.Params.To, "someone@example.com, @example.com")
+
+			output, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`invalid address "@example.com"`))
+			Expect(output).To(BeEmpty())
+			Expect(smtpServer.Peers).To(BeEmpty())
+		})
+
+		It("fails for an invalid sender", func() {
+			inputs.Source.From = "sender@"
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix(`Invalid configuration: invalid "source.from": invalid address "sender@"`))
+		})
 	})
 
-	Context("when the 'Subject' parameter is empty", func() {
+	Context("when addresses are internationalized", func() {
 		BeforeEach(func() {
-			inputs.Params.Subject = ""
+			inputs.Source.From = "Zoë Bot <bot@bücher.example>"
+			inputs.Source.To = []string{"José <jose@münchen.example>"}
 		})
 
-		Context("but the 'SubjectText' paramter is given", func() {
+		It("encodes display names and sends to the punycode domains", func() {
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(smtpServer.Deliveries).To(HaveLen(1))
+			delivery := smtpServer.Deliveries[0]
+			Expect(delivery.Sender).To(Equal("bot@xn--bcher-kva.example"))
+			Expect(delivery.Recipients).To(ContainElement("jose@xn--mnchen-3ya.example"))
+			Expect(string(delivery.Data)).To(ContainSubstring("From: =?utf-8?q?Zo=C3=AB_Bot?= <bot@xn--bcher-kva.example>"))
+			Expect(string(delivery.Data)).To(ContainSubstring("To: =?utf-8?q?Jos=C3=A9?= <jose@xn--mnchen-3ya.example>"))
+		})
+
+		Context("and a local part is not ASCII", func() {
+			var utf8Server *FakeSASLServer
+
 			BeforeEach(func() {
-				inputs.Params.SubjectText = "some subject line"
+				utf8Server = NewFakeSASLServer()
+				utf8Server.Boot()
+
+				requireTLS := false
+				inputs.Source.SMTP.Host = utf8Server.Host
+				inputs.Source.SMTP.Port = utf8Server.Port
+				inputs.Source.SMTP.RequireTLS = &requireTLS
+				inputs.Source.SMTP.Anonymous = true
+				inputs.Source.To = []string{"josé@münchen.example"}
 			})
 
-			It("succeeds and sends an email", func() {
-				output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
-				Expect(err).ToNot(HaveOccurred())
-				Expect(output).ToNot(BeEmpty())
-
-				Expect(smtpServer.Deliveries).To(HaveLen(1))
-				delivery := smtpServer.Deliveries[0]
-				Expect(string(delivery.Data)).To(ContainSubstring("some subject line"))
+			AfterEach(func() {
+				utf8Server.Close()
 			})
-		})
 
-		Context("and the 'SubjectText' paramter is empty", func() {
-			It("returns an error", func() {
-				inputBytes, err := json.Marshal(inputs)
-				Expect(err).NotTo(HaveOccurred())
+			It("sends with SMTPUTF8 when the server advertises it", func() {
+				utf8Server.Extensions = []string{"8BITMIME", "SMTPUTF8"}
 
-				output, err := out.Execute(sourceRoot, "", inputBytes)
-				Expect(err).Should(HaveOccurred())
-				Expect(err.Error()).Should(BeEquivalentTo(`Invalid configuration: missing required field "params.subject" or "params.subject_text". Must specify at least one`))
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(utf8Server.Deliveries).To(Equal(1))
+				Expect(utf8Server.Commands).To(ContainElement("MAIL FROM:<bot@xn--bcher-kva.example> BODY=8BITMIME SMTPUTF8"))
+				Expect(utf8Server.Commands).To(ContainElement("RCPT TO:<josé@xn--mnchen-3ya.example>"))
+			})
+
+			It("fails when the server does not advertise SMTPUTF8", func() {
+				output, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal("SMTP server does not advertise SMTPUTF8, which is required to send to or from josé@xn--mnchen-3ya.example"))
 				Expect(output).To(BeEmpty())
-				Expect(smtpServer.Deliveries).To(HaveLen(0))
+				Expect(utf8Server.Commands).To(BeEmpty())
 			})
 		})
 	})
 
-	Context("when the subject has an extra newline", func() {
+	Context("when the server rejects recipients", func() {
+		var rejectingServer *FakeSMTPServer
+
 		BeforeEach(func() {
-			createSource(inputs.Params.Subject, "some subject line\n\n")
+			rejectingServer = NewFakeSMTPServerWithCustomCert("./test_certs/server.crt", "./test_certs/server.key")
+			rejectingServer.RejectRecipients("recipient+2@example.com")
+			rejectingServer.Boot()
+
+			inputs.Source.SMTP.Host = rejectingServer.Host
+			inputs.Source.SMTP.Port = rejectingServer.Port
 		})
 
-		It("strips the extra newline", func() {
-			output, err := out.Execute(sourceRoot, "the-version", []byte(inputdata))
+		AfterEach(func() {
+			rejectingServer.Close()
+		})
+
+		It("sends to the others and reports every recipient in the metadata", func() {
+			output, err := out.Execute(sourceRoot, "", []byte(inputdata))
 			Expect(err).ToNot(HaveOccurred())
-			Expect(output).ToNot(BeEmpty())
-			Expect(smtpServer.Deliveries).To(HaveLen(1))
-			delivery := smtpServer.Deliveries[0]
-			Expect(string(delivery.Data)).To(ContainSubstring("some subject line"))
 
+			Expect(rejectingServer.Deliveries).To(HaveLen(1))
+			Expect(rejectingServer.Deliveries[0].Recipients).To(Equal([]string{"recipient@example.com", "recipient+3@example.com"}))
+
+			var outdata out.Output
+			Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "recipient", Value: "recipient@example.com: accepted (250 Go ahead)"}))
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "recipient", Value: "recipient+2@example.com: rejected (550 mailbox unavailable)"}))
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "recipient", Value: "recipient+3@example.com: accepted (250 Go ahead)"}))
 		})
-	})
 
-	Context("when the subject has template syntax", func() {
-		BeforeEach(func() {
-			os.Setenv("BUILD_ID", "5")
-			createSource(inputs.Params.Subject, "some subject line for #${BUILD_ID}")
+		Context("and some of them are blind copies", func() {
+			BeforeEach(func() {
+				inputs.Source.To = []string{"recipient@example.com"}
+				inputs.Source.Bcc = []string{"recipient+2@example.com", "hidden@example.com"}
+				inputs.Params.ReportFile = "report/delivery.json"
+			})
+
+			It("only counts them in the metadata and lists them in the report file", func() {
+				output, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+
+				var outdata out.Output
+				Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+				Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "bcc", Value: "1 accepted, 1 rejected"}))
+				for _, item := range outdata.Metadata {
+					Expect(item.Value).ToNot(ContainSubstring("recipient+2@example.com"))
+					Expect(item.Value).ToNot(ContainSubstring("hidden@example.com"))
+				}
+
+				contents, err := ioutil.ReadFile(filepath.Join(sourceRoot, "report/delivery.json"))
+				Expect(err).ToNot(HaveOccurred())
+				var report out.DeliveryReport
+				Expect(json.Unmarshal(contents, &report)).To(Succeed())
+				Expect(report.Recipients).To(ContainElement(out.RecipientStatus{Address: "recipient+2@example.com", Accepted: false, Code: 550, Message: "mailbox unavailable"}))
+				Expect(report.Recipients).To(ContainElement(out.RecipientStatus{Address: "hidden@example.com", Accepted: true, Code: 250, Message: "Go ahead"}))
+			})
 		})
-		var subject string
 
-		verifyTemplateInterpolation := func() {
-			out.Execute(sourceRoot, "", []byte(inputdata))
-			Expect(smtpServer.Deliveries).To(HaveLen(1))
-			delivery := smtpServer.Deliveries[0]
-			Expect(string(delivery.Data)).To(ContainSubstring("some subject line for #5"))
-		}
+		Context("and a report file is given", func() {
+			BeforeEach(func() {
+				inputs.Params.ReportFile = "report/delivery.json"
+			})
 
-		BeforeEach(func() {
-			os.Setenv("BUILD_ID", "5")
-			subject = "some subject line for #${BUILD_ID}"
+			It("writes the status of every recipient to it", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+
+				contents, err := ioutil.ReadFile(filepath.Join(sourceRoot, "report/delivery.json"))
+				Expect(err).ToNot(HaveOccurred())
+				var report out.DeliveryReport
+				Expect(json.Unmarshal(contents, &report)).To(Succeed())
+				Expect(report.MessageID).ToNot(BeEmpty())
+				Expect(report.SMTPHost).To(Equal(net.JoinHostPort(rejectingServer.Host, rejectingServer.Port)))
+				Expect(report.Recipients).To(Equal([]out.RecipientStatus{
+					{Address: "recipient@example.com", Accepted: true, Code: 250, Message: "Go ahead"},
+					{Address: "recipient+2@example.com", Accepted: false, Code: 550, Message: "mailbox unavailable"},
+					{Address: "recipient+3@example.com", Accepted: true, Code: 250, Message: "Go ahead"},
+				}))
+			})
 		})
 
-		Context("when the subject is given as file", func() {
+		Context("and 'fail_on_rejected_recipient' is 'any'", func() {
 			BeforeEach(func() {
-				createSource(inputs.Params.Subject, subject)
+				inputs.Params.FailOnRejectedRecipient = "any"
 			})
 
-			It("interpolates the template", verifyTemplateInterpolation)
+			It("fails naming the rejected recipients", func() {
+				output, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(MatchError("1 of 3 recipients were rejected: recipient+2@example.com (550 mailbox unavailable)"))
+				Expect(output).To(BeEmpty())
+			})
 		})
 
-		Context("when the subject is given as text", func() {
+		Context("and every recipient is rejected", func() {
 			BeforeEach(func() {
-				inputs.Params.Subject = ""
-				inputs.Params.SubjectText = subject
+				inputs.Source.To = []string{"recipient+2@example.com"}
+				inputs.Params.To = ""
 			})
 
-			It("interpolates the template", verifyTemplateInterpolation)
+			It("fails without sending the message", func() {
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(MatchError("1 of 1 recipients were rejected: recipient+2@example.com (550 mailbox unavailable)"))
+				Expect(rejectingServer.Deliveries).To(BeEmpty())
+			})
+
+			Context("and 'fail_on_rejected_recipient' is 'never'", func() {
+				BeforeEach(func() {
+					inputs.Params.FailOnRejectedRecipient = "never"
+				})
+
+				It("succeeds", func() {
+					output, err := out.Execute(sourceRoot, "", []byte(inputdata))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(output).To(ContainSubstring("recipient+2@example.com: rejected"))
+					Expect(rejectingServer.Deliveries).To(BeEmpty())
+				})
+			})
 		})
 	})
 
-	Context("when a headers file is provided", func() {
-		var headers string
-
-		BeforeEach(func() {
-			headers = `Header-1: value
-Header-2: value`
+	Context("when 'fail_on_rejected_recipient' is not a known policy", func() {
+		It("fails", func() {
+			inputs.Params.FailOnRejectedRecipient = "some"
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
 
-			headersFilePath := "some/path/to/headers.txt"
-			createSource(headersFilePath, headers)
-			inputs.Params.Headers = headersFilePath
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(MatchError(`Invalid configuration: invalid value "some" for field "params.fail_on_rejected_recipient". Must be one of "never", "any" or "all"`))
 		})
+	})
 
-		It("should add the headers to the email", func() {
-			out.Execute(sourceRoot, "", []byte(inputdata))
+	Describe("Retries", func() {
+		var flakyServer *FakeSASLServer
 
-			Expect(smtpServer.Deliveries).To(HaveLen(1))
-			delivery := smtpServer.Deliveries[0]
-			Expect(string(delivery.Data)).To(ContainSubstring("Header-1: value\n"))
-			Expect(string(delivery.Data)).To(ContainSubstring("Header-2: value\n"))
-			Expect(string(delivery.Data)).To(ContainSubstring(`
-this is a body
-it has many lines
+		BeforeEach(func() {
+			flakyServer = NewFakeSASLServer()
+			flakyServer.Boot()
 
-even empty lines
+			requireTLS := false
+			inputs.Source.SMTP.Host = flakyServer.Host
+			inputs.Source.SMTP.Port = flakyServer.Port
+			inputs.Source.SMTP.RequireTLS = &requireTLS
+			inputs.Source.SMTP.Anonymous = true
+			inputs.Source.SMTP.Retry.InitialBackoff = "1ms"
+		})
 
-!`))
+		AfterEach(func() {
+			flakyServer.Close()
 		})
 
-		Context("when a header has an extra newline", func() {
-			BeforeEach(func() {
-				headers = `Header-1: value-1
-Header-2: value-2
-Header-3: value-3
+		mailCommands := func() int {
+			count := 0
+			for _, command := range flakyServer.Commands {
+				if strings.HasPrefix(command, "MAIL") {
+					count++
+				}
+			}
+			return count
+		}
 
+		It("does not retry by default", func() {
+			flakyServer.TransientFailures = 1
 
-`
-				createSource(inputs.Params.Headers, headers)
-			})
+			_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(`451 "4.3.0 Try again later"`))
+			Expect(mailCommands()).To(Equal(1))
+		})
 
-			It("strips the extra newline", func() {
-				out.Execute(sourceRoot, "", []byte(inputdata))
-				Expect(smtpServer.Deliveries).To(HaveLen(1))
-				delivery := smtpServer.Deliveries[0]
-				Expect(string(delivery.Data)).To(ContainSubstring("Header-1: value-1\n"))
-				Expect(string(delivery.Data)).To(ContainSubstring("Header-2: value-2\n"))
-				Expect(string(delivery.Data)).To(ContainSubstring("Header-3: value-3\n"))
+		Context("when more attempts are configured", func() {
+			BeforeEach(func() {
+				inputs.Source.SMTP.Retry.Attempts = 3
 			})
-		})
-	})
 
-	Context("body", func() {
+			It("retries temporary failures until the message is sent", func() {
+				flakyServer.TransientFailures = 2
 
-		verifyBody := func(expectedBody string) func() {
-			return func() {
 				output, err := out.Execute(sourceRoot, "", []byte(inputdata))
 				Expect(err).ToNot(HaveOccurred())
-				Expect(output).ToNot(BeEmpty())
+				Expect(mailCommands()).To(Equal(3))
+				Expect(flakyServer.Deliveries).To(Equal(1))
 
-				Expect(smtpServer.Deliveries).To(HaveLen(1))
-				delivery := smtpServer.Deliveries[0]
+				var outdata out.Output
+				Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+				Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "delivered_by", Value: net.JoinHostPort(flakyServer.Host, flakyServer.Port)}))
+			})
 
-				Expect(string(delivery.Data)).To(ContainSubstring(expectedBody))
-			}
-		}
+			It("gives up after the last attempt", func() {
+				flakyServer.TransientFailures = 5
 
-		Context("when body file is provided", func() {
-			BeforeEach(func() {
-				createSource(inputs.Params.Body, "some body")
-				inputs.Params.BodyText = ""
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(mailCommands()).To(Equal(3))
+				Expect(flakyServer.Deliveries).To(Equal(0))
 			})
 
-			It("uses the text from the body file", verifyBody("some body"))
-		})
+			It("does not retry when the reply to the message data is lost", func() {
+				flakyServer.DroppedDeliveries = 1
 
-		Context("when body text is provided", func() {
-			BeforeEach(func() {
-				inputs.Params.Body = ""
-				inputs.Params.BodyText = "some body"
+				_, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("the message may have been delivered"))
+				Expect(mailCommands()).To(Equal(1))
+				Expect(flakyServer.DeliveryCount()).To(Equal(1))
+			})
+
+			It("does not retry failures that are not in 'retry_on'", func() {
+				inputs.Source.SMTP.Retry.RetryOn = []string{"connection"}
+				flakyServer.TransientFailures = 1
+				inputBytes, err := json.Marshal(inputs)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = out.Execute(sourceRoot, "", inputBytes)
+				Expect(err).To(HaveOccurred())
+				Expect(mailCommands()).To(Equal(1))
 			})
-			It("uses the body text", verifyBody("some body"))
 		})
 
-		Context("when body text and body file is provided", func() {
+		Context("when fallback hosts are configured", func() {
 			BeforeEach(func() {
-				createSource(inputs.Params.Body, "some body from file")
-				inputs.Params.BodyText = "some body from text"
+				unavailable, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+				unavailableHost, unavailablePort, err := net.SplitHostPort(unavailable.Addr().String())
+				Expect(err).ToNot(HaveOccurred())
+				unavailable.Close()
+
+				inputs.Source.SMTP.Host = unavailableHost
+				inputs.Source.SMTP.Port = unavailablePort
+				inputs.Source.SMTP.FallbackHosts = []string{net.JoinHostPort(flakyServer.Host, flakyServer.Port)}
 			})
-			It("uses the body text", verifyBody("some body from text"))
-		})
 
-	})
+			It("sends through the first fallback host that is available", func() {
+				output, err := out.Execute(sourceRoot, "", []byte(inputdata))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(flakyServer.Deliveries).To(Equal(1))
 
-	Context("when the body and the body_text is empty", func() {
-		BeforeEach(func() {
-			inputs.Params.Body = ""
-			inputs.Params.BodyText = ""
-		})
+				var outdata out.Output
+				Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+				Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "delivered_by", Value: net.JoinHostPort(flakyServer.Host, flakyServer.Port)}))
+			})
 
-		Context("when the 'SendEmptyBody' parameter is true", func() {
-			BeforeEach(func() {
-				inputs.Params.SendEmptyBody = true
+			It("does not fall back when the reply to the message data is lost", func() {
+				inputs.Source.SMTP.Host = flakyServer.Host
+				inputs.Source.SMTP.Port = flakyServer.Port
+				inputs.Source.SMTP.FallbackHosts = []string{net.JoinHostPort(flakyServer.Host, flakyServer.Port)}
+				flakyServer.DroppedDeliveries = 1
+				inputBytes, err := json.Marshal(inputs)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = out.Execute(sourceRoot, "", inputBytes)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("the message may have been delivered"))
+				Expect(flakyServer.DeliveryCount()).To(Equal(1))
 			})
-			It("should succeed and send a message with an empty body", func() {
+
+			It("uses the port of the primary host for fallback hosts without one", func() {
+				inputs.Source.SMTP.Port = flakyServer.Port
+				inputs.Source.SMTP.Host = "unresolvable.invalid"
+				inputs.Source.SMTP.FallbackHosts = []string{flakyServer.Host}
 				inputBytes, err := json.Marshal(inputs)
 				Expect(err).NotTo(HaveOccurred())
 
-				output, err := out.Execute(sourceRoot, "", inputBytes)
-				Expect(err).ShouldNot(HaveOccurred())
-				Expect(output).ShouldNot(BeEmpty())
-				Expect(smtpServer.Deliveries).To(HaveLen(1))
-				delivery := smtpServer.Deliveries[0]
-				Expect(string(delivery.Data)).To(ContainSubstring("some subject line"))
+				_, err = out.Execute(sourceRoot, "", inputBytes)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(flakyServer.Deliveries).To(Equal(1))
 			})
 		})
-		Context("when the 'SendEmptyBody' parameter is false", func() {
-			BeforeEach(func() {
-				inputs.Params.SendEmptyBody = false
-			})
 
-			It("should not return an error and not send a message", func() {
+		Context("when the retry policy is invalid", func() {
+			It("fails before sending", func() {
+				inputs.Source.SMTP.Retry.MaxBackoff = "soon"
 				inputBytes, err := json.Marshal(inputs)
 				Expect(err).NotTo(HaveOccurred())
 
-				output, err := out.Execute(sourceRoot, "", inputBytes)
-				Expect(err).ShouldNot(HaveOccurred())
-				Expect(output).ShouldNot(BeEmpty())
-				Expect(smtpServer.Deliveries).To(HaveLen(0))
+				_, err = out.Execute(sourceRoot, "", inputBytes)
+				Expect(err).To(MatchError(`Invalid configuration: invalid value "soon" for field "source.smtp.retry.max_backoff". Must be a duration such as "2s"`))
+				Expect(flakyServer.Commands).To(BeEmpty())
 			})
 		})
 	})
 
+	Describe("Timeouts", func() {
+		var stallingServer *FakeSASLServer
+
+		BeforeEach(func() {
+			stallingServer = NewFakeSASLServer()
+			stallingServer.Boot()
+
+			requireTLS := false
+			inputs.Source.SMTP.Host = stallingServer.Host
+			inputs.Source.SMTP.Port = stallingServer.Port
+			inputs.Source.SMTP.RequireTLS = &requireTLS
+			inputs.Source.SMTP.Anonymous = true
+		})
+
+		AfterEach(func() {
+			stallingServer.Close()
+		})
+
+		It("fails when connecting takes longer than 'dial_timeout'", func() {
+			inputs.Source.SMTP.DialTimeout = "1ns"
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("SMTP session timed out during dial: "))
+		})
+
+		It("fails when a command is not answered within 'command_timeout'", func() {
+			inputs.Source.SMTP.CommandTimeout = "50ms"
+			stallingServer.StallOn = "MAIL"
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("SMTP session timed out during MAIL: "))
+			Expect(err.Error()).To(ContainSubstring("i/o timeout"))
+		})
+
+		It("fails when the session takes longer than 'session_timeout'", func() {
+			inputs.Source.SMTP.SessionTimeout = "100ms"
+			stallingServer.StallOn = "RCPT"
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			start := time.Now()
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("SMTP session timed out during RCPT: "))
+			Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		})
+
+		It("fails before connecting when a timeout is invalid", func() {
+			inputs.Source.SMTP.CommandTimeout = "-1s"
+			inputBytes, err := json.Marshal(inputs)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = out.Execute(sourceRoot, "", inputBytes)
+			Expect(err).To(MatchError(`Invalid configuration: invalid value "-1s" for field "source.smtp.command_timeout". Must be a duration such as "2s"`))
+			Expect(stallingServer.Commands).To(BeEmpty())
+		})
+	})
+
 	Context("when the 'From' is empty", func() {
 		It("should print an error and exit 1", func() {
 			inputs.Source.From = ""
@@ -0,0 +1,233 @@
+package out
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/pkg/errors"
+)
+
+// pgpKeys holds the parsed source.pgp settings and params.pgp_keyring.
+type pgpKeys struct {
+	signer  *openpgp.Entity
+	keyring openpgp.EntityList
+}
+
+func (p PGP) configured() bool {
+	return p.PrivateKey != "" || p.Passphrase != "" || len(p.RecipientKeys) > 0
+}
+
+// signingKey parses the private key messages are signed with and unlocks it
+// with the passphrase. It returns nil if no private key is configured.
+func (p PGP) signingKey() (*openpgp.Entity, error) {
+	if p.PrivateKey == "" {
+		if p.Passphrase != "" {
+			return nil, errors.New(`"source.pgp.passphrase" is set but "source.pgp.private_key" is not`)
+		}
+		return nil, nil
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(p.PrivateKey))
+	if err != nil {
+		return nil, errors.Wrap(err, `invalid "source.pgp.private_key"`)
+	}
+	if len(entities) != 1 {
+		return nil, errors.Errorf(`"source.pgp.private_key" holds %d keys. Must hold exactly one`, len(entities))
+	}
+	entity := entities[0]
+	if entity.PrivateKey == nil {
+		return nil, errors.New(`"source.pgp.private_key" is a public key. Must be a private key`)
+	}
+	if entity.PrivateKey.Encrypted {
+		if p.Passphrase == "" {
+			return nil, errors.New(`"source.pgp.private_key" is protected by a passphrase but "source.pgp.passphrase" is not set`)
+		}
+		if err := entity.DecryptPrivateKeys([]byte(p.Passphrase)); err != nil {
+			return nil, errors.Wrap(err, `invalid "source.pgp.passphrase"`)
+		}
+	}
+	return entity, nil
+}
+
+// publicKeys parses the public keys given in source.pgp.recipient_keys and
+// keyring, the armored or binary content of params.pgp_keyring.
+func (p PGP) publicKeys(keyring []byte) (openpgp.EntityList, error) {
+	var entities openpgp.EntityList
+	for i, text := range p.RecipientKeys {
+		parsed, err := openpgp.ReadArmoredKeyRing(strings.NewReader(text))
+		if err != nil {
+			return nil, errors.Wrapf(err, `invalid "source.pgp.recipient_keys[%d]"`, i)
+		}
+		entities = append(entities, parsed...)
+	}
+	if len(keyring) > 0 {
+		var parsed openpgp.EntityList
+		var err error
+		if bytes.HasPrefix(bytes.TrimSpace(keyring), []byte("-----BEGIN")) {
+			parsed, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(keyring))
+		} else {
+			parsed, err = openpgp.ReadKeyRing(bytes.NewReader(keyring))
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, `invalid "params.pgp_keyring"`)
+		}
+		entities = append(entities, parsed...)
+	}
+	return entities, nil
+}
+
+// keys parses the signing key and the public keys given inline and in
+// keyring.
+func (p PGP) keys(keyring []byte) (*pgpKeys, error) {
+	signer, err := p.signingKey()
+	if err != nil {
+		return nil, err
+	}
+	entities, err := p.publicKeys(keyring)
+	if err != nil {
+		return nil, err
+	}
+	if signer == nil && len(entities) == 0 {
+		return nil, errors.New(`missing required field "source.pgp.private_key", "source.pgp.recipient_keys" or "params.pgp_keyring". Must specify at least one`)
+	}
+	return &pgpKeys{signer: signer, keyring: entities}, nil
+}
+
+// recipientKeys returns the key of every envelope recipient, matched by the
+// address of its identities.
+func (k *pgpKeys) recipientKeys(envelope []string) ([]*openpgp.Entity, error) {
+	var to []*openpgp.Entity
+	now := time.Now()
+	for _, addr := range envelope {
+		var found *openpgp.Entity
+		for _, entity := range k.keyring {
+			if _, ok := entity.EncryptionKey(now); !ok {
+				continue
+			}
+			for _, identity := range entity.Identities {
+				if strings.EqualFold(identity.UserId.Email, addr) {
+					found = entity
+				}
+			}
+		}
+		if found == nil {
+			return nil, errors.Errorf("no OpenPGP public key found for recipient %s", addr)
+		}
+		to = append(to, found)
+	}
+	return to, nil
+}
+
+// protect signs the body of msg as multipart/signed if only a private key is
+// configured. If public keys are configured it encrypts the body for every
+// envelope recipient as multipart/encrypted, signed in the same pass when a
+// private key is configured too (RFC 3156 section 6.2). Header fields other
+// than the Content-* ones stay outside, so the message can be routed.
+//
+// The key ID of every recipient is readable from the encrypted message, so
+// encrypting is refused when there are blind copy recipients.
+func (k *pgpKeys) protect(msg []byte, envelope, bcc []string) ([]byte, error) {
+	outer, entity, err := splitMIMEEntity(msg)
+	if err != nil {
+		return nil, err
+	}
+	config := &packet.Config{DefaultHash: crypto.SHA256}
+	if len(k.keyring) == 0 {
+		if entity, err = k.sign(entity, config); err != nil {
+			return nil, errors.Wrap(err, "Error signing mail with OpenPGP")
+		}
+	} else {
+		if len(bcc) > 0 {
+			return nil, errors.New("OpenPGP encryption would reveal the bcc recipients to every recipient through their key IDs. Remove the bcc recipients or send them a separate message")
+		}
+		to, err := k.recipientKeys(envelope)
+		if err != nil {
+			return nil, err
+		}
+		if entity, err = k.encrypt(entity, to, config); err != nil {
+			return nil, errors.Wrap(err, "Error encrypting mail with OpenPGP")
+		}
+	}
+	return append(outer, entity...), nil
+}
+
+func (k *pgpKeys) sign(entity []byte, config *packet.Config) ([]byte, error) {
+	var signature bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&signature, k.signer, bytes.NewReader(entity), config); err != nil {
+		return nil, err
+	}
+
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/signed", map[string]string{
+		"protocol": "application/pgp-signature",
+		"micalg":   "pgp-sha256",
+		"boundary": boundary,
+	}))
+	fmt.Fprintf(buf, "--%s\r\n", boundary)
+	buf.Write(entity)
+	fmt.Fprintf(buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pgp-signature; name=\"signature.asc\"\r\n")
+	buf.WriteString("Content-Description: OpenPGP digital signature\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"signature.asc\"\r\n\r\n")
+	buf.Write(crlf(signature.Bytes()))
+	fmt.Fprintf(buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+func (k *pgpKeys) encrypt(entity []byte, to []*openpgp.Entity, config *packet.Config) ([]byte, error) {
+	var ciphertext bytes.Buffer
+	armored, err := armor.Encode(&ciphertext, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openpgp.Encrypt(armored, to, k.signer, nil, config)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(plaintext, bytes.NewReader(entity)); err != nil {
+		return nil, err
+	}
+	if err := plaintext.Close(); err != nil {
+		return nil, err
+	}
+	if err := armored.Close(); err != nil {
+		return nil, err
+	}
+
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/encrypted", map[string]string{
+		"protocol": "application/pgp-encrypted",
+		"boundary": boundary,
+	}))
+	fmt.Fprintf(buf, "--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pgp-encrypted\r\n")
+	buf.WriteString("Content-Description: PGP/MIME version identification\r\n\r\n")
+	buf.WriteString("Version: 1\r\n")
+	fmt.Fprintf(buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/octet-stream; name=\"encrypted.asc\"\r\n")
+	buf.WriteString("Content-Description: OpenPGP encrypted message\r\n")
+	buf.WriteString("Content-Disposition: inline; filename=\"encrypted.asc\"\r\n\r\n")
+	buf.Write(crlf(ciphertext.Bytes()))
+	fmt.Fprintf(buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// crlf converts the line endings of armored data to CRLF.
+func crlf(data []byte) []byte {
+	return bytes.Replace(bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+}
@@ -0,0 +1,228 @@
+package out_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OpenPGP/MIME", func() {
+	fixture := newSMTPOutFixture()
+	var senderKey, janeKey, auditKey *openpgp.Entity
+
+	newKey := func(name, email string) *openpgp.Entity {
+		entity, err := openpgp.NewEntity(name, "", email, &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+		Expect(err).NotTo(HaveOccurred())
+		return entity
+	}
+
+	armorPublicKey := func(entity *openpgp.Entity) string {
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entity.Serialize(w)).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+		return buf.String()
+	}
+
+	armorPrivateKey := func(entity *openpgp.Entity, passphrase string) string {
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entity.EncryptPrivateKeys([]byte(passphrase), nil)).To(Succeed())
+		Expect(entity.SerializePrivateWithoutSigning(w, nil)).To(Succeed())
+		Expect(entity.DecryptPrivateKeys([]byte(passphrase))).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+		return buf.String()
+	}
+
+	delivered := func() (*mail.Message, []byte) {
+		message := fixture.deliveredMessage()
+		body, err := ioutil.ReadAll(message.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return message, body
+	}
+
+	// splitParts returns the raw parts of a multipart body of the given type.
+	splitParts := func(header mail.Header, body []byte, expectedType string) (map[string]string, []string) {
+		mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mediaType).To(Equal(expectedType))
+		delimiter := "--" + params["boundary"]
+		Expect(string(body)).To(HavePrefix(delimiter + "\r\n"))
+		parts := strings.Split(strings.TrimPrefix(string(body), delimiter+"\r\n"), "\r\n"+delimiter)
+		Expect(parts).To(HaveLen(3))
+		Expect(parts[2]).To(HavePrefix("--"))
+		return params, []string{parts[0], strings.TrimPrefix(parts[1], "\r\n")}
+	}
+
+	partBody := func(part string) string {
+		message, err := mail.ReadMessage(strings.NewReader(part))
+		Expect(err).NotTo(HaveOccurred())
+		body, err := ioutil.ReadAll(message.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return string(body)
+	}
+
+	decrypt := func(header mail.Header, body []byte, key *openpgp.Entity) *openpgp.MessageDetails {
+		params, parts := splitParts(header, body, "multipart/encrypted")
+		Expect(params).To(HaveKeyWithValue("protocol", "application/pgp-encrypted"))
+		Expect(parts[0]).To(HavePrefix("Content-Type: application/pgp-encrypted\r\n"))
+		Expect(partBody(parts[0])).To(ContainSubstring("Version: 1"))
+
+		block, err := armor.Decode(strings.NewReader(partBody(parts[1])))
+		Expect(err).NotTo(HaveOccurred())
+		md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{key, senderKey}, nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(md.IsEncrypted).To(BeTrue())
+		return md
+	}
+
+	BeforeEach(func() {
+		senderKey = newKey("Build Bot", "bot@example.com")
+		janeKey = newKey("Jane Doe", "jane@example.net")
+		auditKey = newKey("Audit", "audit@example.net")
+
+		fixture.inputs.Source.To = []string{"Jane Doe <jane@example.net>"}
+		fixture.inputs.Source.PGP.PrivateKey = armorPrivateKey(senderKey, "correct horse")
+		fixture.inputs.Source.PGP.Passphrase = "correct horse"
+	})
+
+	It("signs the message with a detached signature", func() {
+		_, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		message, body := delivered()
+		Expect(message.Header.Get("Subject")).To(Equal("Build passed"))
+		params, parts := splitParts(message.Header, body, "multipart/signed")
+		Expect(params).To(HaveKeyWithValue("protocol", "application/pgp-signature"))
+		Expect(params).To(HaveKeyWithValue("micalg", "pgp-sha256"))
+		Expect(parts[0]).To(HavePrefix("Content-Type: multipart/alternative"))
+		Expect(parts[0]).To(ContainSubstring("the build passed"))
+		Expect(parts[1]).To(HavePrefix("Content-Type: application/pgp-signature"))
+
+		signer, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{senderKey}, strings.NewReader(parts[0]), strings.NewReader(partBody(parts[1])), nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(signer.PrimaryKey.KeyId).To(Equal(senderKey.PrimaryKey.KeyId))
+
+		_, err = openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{senderKey}, strings.NewReader(strings.Replace(parts[0], "passed", "failed", 1)), strings.NewReader(partBody(parts[1])), nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("when recipient keys are configured", func() {
+		BeforeEach(func() {
+			fixture.inputs.Source.PGP.RecipientKeys = []string{armorPublicKey(janeKey)}
+		})
+
+		It("encrypts and signs the message for the recipient", func() {
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			message, body := delivered()
+			Expect(message.Header.Get("Subject")).To(Equal("Build passed"))
+			Expect(string(body)).NotTo(ContainSubstring("the build passed"))
+
+			md := decrypt(message.Header, body, janeKey)
+			entity, err := ioutil.ReadAll(md.UnverifiedBody)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(md.IsSigned).To(BeTrue())
+			Expect(md.SignatureError).NotTo(HaveOccurred())
+			Expect(md.SignedBy.PublicKey.KeyId).To(Equal(senderKey.PrimaryKey.KeyId))
+			Expect(string(entity)).To(HavePrefix("Content-Type: multipart/alternative"))
+			Expect(string(entity)).To(ContainSubstring("the build passed"))
+		})
+
+		It("fails when a recipient has no key", func() {
+			fixture.inputs.Source.Cc = []string{"nobody@example.net"}
+			_, err := fixture.run()
+			Expect(err).To(MatchError("no OpenPGP public key found for recipient nobody@example.net"))
+			Expect(fixture.smtpServer.Deliveries).To(BeEmpty())
+		})
+	})
+
+	Context("when a keyring file is given in the inputs", func() {
+		BeforeEach(func() {
+			var keyring bytes.Buffer
+			Expect(janeKey.Serialize(&keyring)).To(Succeed())
+			Expect(auditKey.Serialize(&keyring)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(fixture.sourceRoot, "keys"), 0700)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(fixture.sourceRoot, "keys", "pubring.gpg"), keyring.Bytes(), 0600)).To(Succeed())
+
+			fixture.inputs.Source.PGP = out.PGP{}
+			fixture.inputs.Source.Cc = []string{"audit@example.net"}
+			fixture.inputs.Params.PGPKeyring = "keys/pubring.gpg"
+		})
+
+		It("encrypts the message for every recipient", func() {
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			message, body := delivered()
+			for _, key := range []*openpgp.Entity{janeKey, auditKey} {
+				md := decrypt(message.Header, body, key)
+				entity, err := ioutil.ReadAll(md.UnverifiedBody)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(md.IsSigned).To(BeFalse())
+				Expect(string(entity)).To(ContainSubstring("the build passed"))
+			}
+		})
+
+		It("fails instead of revealing blind copy recipients", func() {
+			fixture.inputs.Source.Cc = nil
+			fixture.inputs.Source.Bcc = []string{"audit@example.net"}
+			_, err := fixture.run()
+			Expect(err).To(MatchError("OpenPGP encryption would reveal the bcc recipients to every recipient through their key IDs. Remove the bcc recipients or send them a separate message"))
+			Expect(fixture.smtpServer.Deliveries).To(BeEmpty())
+		})
+
+		It("fails when the keyring file does not exist", func() {
+			fixture.inputs.Params.PGPKeyring = "keys/missing.gpg"
+			_, err := fixture.run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("Error reading OpenPGP keyring: "))
+		})
+	})
+
+	Context("when the configuration is invalid", func() {
+		It("fails when the passphrase is wrong", func() {
+			fixture.inputs.Source.PGP.Passphrase = "wrong"
+			_, err := fixture.run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix(`Invalid configuration: invalid "source.pgp.passphrase": `))
+		})
+
+		It("fails when the key is protected and no passphrase is given", func() {
+			fixture.inputs.Source.PGP.Passphrase = ""
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.pgp.private_key" is protected by a passphrase but "source.pgp.passphrase" is not set`))
+		})
+
+		It("fails when a public key is given as the private key", func() {
+			fixture.inputs.Source.PGP.PrivateKey = armorPublicKey(senderKey)
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.pgp.private_key" is a public key. Must be a private key`))
+		})
+
+		It("fails together with S/MIME", func() {
+			fixture.inputs.Source.SMIME.RecipientCertificates = []string{"some certificate"}
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.smime" and "source.pgp" cannot be used together`))
+		})
+
+		AfterEach(func() {
+			Expect(fixture.smtpServer.Deliveries).To(BeEmpty())
+		})
+	})
+})
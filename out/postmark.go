@@ -0,0 +1,116 @@
+package out
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const postmarkEndpoint = "https://api.postmarkapp.com"
+
+type postmarkHeader struct {
+	Name  string
+	Value string
+}
+
+type postmarkAttachment struct {
+	Name        string
+	Content     string
+	ContentType string
+	ContentID   string `json:",omitempty"`
+}
+
+type postmarkMessage struct {
+	From          string
+	To            string
+	Cc            string `json:",omitempty"`
+	Bcc           string `json:",omitempty"`
+	ReplyTo       string `json:",omitempty"`
+	Subject       string
+	TextBody      string               `json:",omitempty"`
+	HtmlBody      string               `json:",omitempty"`
+	Headers       []postmarkHeader     `json:",omitempty"`
+	Attachments   []postmarkAttachment `json:",omitempty"`
+	MessageStream string               `json:",omitempty"`
+}
+
+func (config Postmark) validate() error {
+	if config.ServerToken == "" {
+		return errors.New(`missing required field "source.postmark.server_token"`)
+	}
+	return nil
+}
+
+// request builds a request to the email API. The API does not accept a
+// composed message, so msg is taken apart into its parts. Reply-To is sent as
+// the ReplyTo field rather than as a header.
+func (config Postmark) request(from string, to []string, msg []byte) (*http.Request, error) {
+	parsed, err := parseMessage(msg, to)
+	if err != nil {
+		return nil, err
+	}
+
+	sender := *parsed.from
+	sender.Address = from
+	message := postmarkMessage{
+		From:          formatAddress(&sender),
+		To:            postmarkAddresses(parsed.to),
+		Cc:            postmarkAddresses(parsed.cc),
+		Bcc:           postmarkAddresses(parsed.bcc),
+		Subject:       parsed.subject,
+		TextBody:      parsed.text,
+		HtmlBody:      parsed.html,
+		MessageStream: config.MessageStream,
+	}
+	var replyTo []*mail.Address
+	for _, header := range parsed.headers {
+		if textproto.CanonicalMIMEHeaderKey(header.Name) == "Reply-To" {
+			addresses, err := mail.ParseAddressList(header.Value)
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to parse Reply-To header")
+			}
+			replyTo = append(replyTo, addresses...)
+			continue
+		}
+		message.Headers = append(message.Headers, postmarkHeader{Name: header.Name, Value: header.Value})
+	}
+	message.ReplyTo = postmarkAddresses(replyTo)
+	for _, a := range parsed.attachments {
+		attachment := postmarkAttachment{
+			Name:        a.name,
+			Content:     base64.StdEncoding.EncodeToString(a.content),
+			ContentType: a.contentType,
+		}
+		if a.inline {
+			attachment.ContentID = "cid:" + a.contentID
+		}
+		message.Attachments = append(message.Attachments, attachment)
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := endpointURL(config.Endpoint, postmarkEndpoint, "/email")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Postmark-Server-Token", config.ServerToken)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func postmarkAddresses(addresses []*mail.Address) string {
+	return strings.Join(formatAddresses(addresses), ", ")
+}
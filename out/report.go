@@ -0,0 +1,105 @@
+package out
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	FailOnRejectedNever = "never"
+	FailOnRejectedAny   = "any"
+	FailOnRejectedAll   = "all"
+)
+
+// DeliveryReport - the outcome of sending a message, written to
+// params.report_file
+type DeliveryReport struct {
+	MessageID  string            `json:"message_id"`
+	SMTPHost   string            `json:"smtp_host"`
+	Recipients []RecipientStatus `json:"recipients"`
+}
+
+// recipientMetadata returns a metadata item for every recipient, such as
+// "jane@example.com: accepted (250 OK)". Transports without reply codes
+// leave the code out. Metadata can be seen by anyone who can see the
+// pipeline, so the blind copy recipients in bcc are only counted, in a single
+// item such as "2 accepted, 1 rejected".
+func recipientMetadata(statuses []RecipientStatus, bcc []string) []MetadataItem {
+	blind := map[string]bool{}
+	for _, addr := range bcc {
+		blind[strings.ToLower(addr)] = true
+	}
+
+	items := make([]MetadataItem, 0, len(statuses))
+	var bccAccepted, bccRejected int
+	for _, status := range statuses {
+		if blind[strings.ToLower(status.Address)] {
+			if status.Accepted {
+				bccAccepted++
+			} else {
+				bccRejected++
+			}
+			continue
+		}
+		outcome := "rejected"
+		if status.Accepted {
+			outcome = "accepted"
+		}
+		reply := status.Message
+		if status.Code != 0 {
+			reply = fmt.Sprintf("%d %s", status.Code, status.Message)
+		}
+		items = append(items, MetadataItem{
+			Name:  "recipient",
+			Value: fmt.Sprintf("%s: %s (%s)", status.Address, outcome, reply),
+		})
+	}
+	if bccAccepted+bccRejected > 0 {
+		items = append(items, MetadataItem{
+			Name:  "bcc",
+			Value: fmt.Sprintf("%d accepted, %d rejected", bccAccepted, bccRejected),
+		})
+	}
+	return items
+}
+
+func writeReport(sourceRoot, reportPath string, report DeliveryReport) error {
+	if !filepath.IsAbs(reportPath) {
+		reportPath = filepath.Join(sourceRoot, reportPath)
+	}
+	contents, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal delivery report")
+	}
+	if err := os.MkdirAll(filepath.Dir(reportPath), 0755); err != nil {
+		return errors.Wrapf(err, "unable to write delivery report to %s", reportPath)
+	}
+	if err := ioutil.WriteFile(reportPath, contents, 0644); err != nil {
+		return errors.Wrapf(err, "unable to write delivery report to %s", reportPath)
+	}
+	return nil
+}
+
+// checkRejections returns an error if the rejected recipients fail the put
+// under policy, naming each of them.
+func checkRejections(policy string, statuses []RecipientStatus) error {
+	var rejected []string
+	for _, status := range statuses {
+		if !status.Accepted {
+			rejected = append(rejected, fmt.Sprintf("%s (%d %s)", status.Address, status.Code, status.Message))
+		}
+	}
+	switch {
+	case len(rejected) == 0, policy == FailOnRejectedNever:
+		return nil
+	case policy == FailOnRejectedAll && len(rejected) < len(statuses):
+		return nil
+	}
+	return errors.Errorf("%d of %d recipients were rejected: %s", len(rejected), len(statuses), strings.Join(rejected, ", "))
+}
@@ -0,0 +1,113 @@
+package out
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RetryOnConnection = "connection"
+	RetryOn4xx        = "4xx"
+	RetryOn5xx        = "5xx"
+)
+
+// RetryPolicy - how often and for which failures sending is retried against
+// each SMTP host
+type RetryPolicy struct {
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+	RetryOn        []string
+}
+
+// DefaultRetryPolicy tries every host once, falling back to the next host on
+// connection failures and temporary 4xx replies.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       1,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+	Jitter:         0.1,
+	RetryOn:        []string{RetryOnConnection, RetryOn4xx},
+}
+
+// backoff returns how long to wait before the given retry, counting from 1.
+// The wait doubles with every retry up to MaxBackoff, and is then moved by up
+// to Jitter of itself in either direction.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < retry && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(wait))
+	}
+	return wait
+}
+
+// retryable reports whether err belongs to one of the classes in RetryOn.
+func (p RetryPolicy) retryable(err error) bool {
+	if isAfterDelivery(err) {
+		return false
+	}
+	class := failureClass(errors.Cause(err))
+	for _, retryOn := range p.RetryOn {
+		if retryOn == class {
+			return true
+		}
+	}
+	return false
+}
+
+func failureClass(err error) string {
+	if protoErr, ok := err.(*textproto.Error); ok {
+		switch {
+		case protoErr.Code >= 400 && protoErr.Code < 500:
+			return RetryOn4xx
+		case protoErr.Code >= 500:
+			return RetryOn5xx
+		}
+	}
+	if _, ok := err.(net.Error); ok {
+		return RetryOnConnection
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return RetryOnConnection
+	}
+	return ""
+}
+
+// afterDeliveryError - a failure after the server accepted or may have
+// accepted the message, which is never retried as that could send the message
+// twice
+type afterDeliveryError struct {
+	error
+}
+
+// Cause returns the failure, so that timeouts are still reported as such.
+func (e afterDeliveryError) Cause() error {
+	return e.error
+}
+
+// isAfterDelivery reports whether err is or wraps an afterDeliveryError.
+func isAfterDelivery(err error) bool {
+	for err != nil {
+		if _, ok := err.(afterDeliveryError); ok {
+			return true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = causer.Cause()
+	}
+	return false
+}
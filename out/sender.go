@@ -6,14 +6,55 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/smtp"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
+const (
+	TLSModeStartTLS = "starttls"
+	TLSModeImplicit = "implicit"
+	TLSModeNone     = "none"
+)
+
+const (
+	AuthMechanismAuto        = "auto"
+	AuthMechanismCRAMMD5     = "cram-md5"
+	AuthMechanismPlain       = "plain"
+	AuthMechanismLogin       = "login"
+	AuthMechanismXOAuth2     = "xoauth2"
+	AuthMechanismOAuthBearer = "oauthbearer"
+)
+
+// passwordAuthPreference and tokenAuthPreference list the mechanisms that are
+// tried when auth_mechanism is "auto", strongest first.
+var (
+	passwordAuthPreference = []string{AuthMechanismCRAMMD5, AuthMechanismLogin, AuthMechanismPlain}
+	tokenAuthPreference    = []string{AuthMechanismXOAuth2, AuthMechanismOAuthBearer}
+)
+
+// Timeouts - how long connecting, each SMTP command and the whole session of
+// an attempt may take. Zero means no limit
+type Timeouts struct {
+	Dial    time.Duration
+	Command time.Duration
+	Session time.Duration
+}
+
+// DefaultTimeouts follow the minimum timeouts RFC 5321 recommends for SMTP
+// clients, without a limit on the whole session.
+var DefaultTimeouts = Timeouts{
+	Dial:    30 * time.Second,
+	Command: 5 * time.Minute,
+}
+
 func NewSender(host, port, username, password string, debug bool, logger *log.Logger) *Sender {
 	return &Sender{
 		host:        host,
@@ -23,6 +64,8 @@ func NewSender(host, port, username, password string, debug bool, logger *log.Lo
 		logger:      logger,
 		username:    username,
 		password:    password,
+		Retry:       DefaultRetryPolicy,
+		Timeouts:    DefaultTimeouts,
 	}
 }
 
@@ -34,11 +77,20 @@ type Sender struct {
 	logger                                  *log.Logger
 	HostOrigin                              string
 	CaCert                                  string
+	ClientCert, ClientKey                   string
+	TLSMode                                 string
 	Anonymous, LoginAuth, SkipSSLValidation bool
+	RequireTLS                              bool
+	AuthMechanism                           string
+	AccessToken                             string
 	username                                string
 	password                                string
 	From                                    string
 	To                                      []string
+	FallbackHosts                           []string
+	Retry                                   RetryPolicy
+	Timeouts                                Timeouts
+	deliveredBy                             string
 }
 
 func (s *Sender) AddAttachment(filePath string) error {
@@ -50,16 +102,73 @@ func (s *Sender) AddAttachment(filePath string) error {
 	return nil
 }
 
-func (s *Sender) Send(msg []byte) error {
-	var c *smtp.Client
+// RecipientStatus - whether the SMTP server accepted a recipient, with the
+// code and text of its reply
+type RecipientStatus struct {
+	Address  string `json:"address"`
+	Accepted bool   `json:"accepted"`
+	Code     int    `json:"code"`
+	Message  string `json:"message"`
+}
+
+// Send sends msg to every recipient and returns the status of each of them.
+// Recipients the server permanently rejects are skipped; if it rejects all of
+// them the message is not sent. Failures are retried following Retry, first
+// against the configured host and then against each of FallbackHosts.
+func (s *Sender) Send(msg []byte) ([]RecipientStatus, error) {
+	relays := append([]string{net.JoinHostPort(s.host, s.port)}, s.FallbackHosts...)
 	var err error
+	for i, relay := range relays {
+		relaySender := *s
+		relaySender.host, relaySender.port, err = net.SplitHostPort(relay)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid SMTP host %s", relay)
+		}
+		for attempt := 1; attempt <= s.Retry.Attempts; attempt++ {
+			if attempt > 1 {
+				wait := s.Retry.backoff(attempt - 1)
+				s.logger.Printf("Retrying %s in %s\n", relay, wait)
+				time.Sleep(wait)
+			}
+			var statuses []RecipientStatus
+			statuses, err = relaySender.send(msg)
+			if err == nil {
+				s.deliveredBy = relay
+				return statuses, nil
+			}
+			s.logger.Printf("Attempt %d of %d to send through %s failed: %s\n", attempt, s.Retry.Attempts, relay, err)
+			if !s.Retry.retryable(err) {
+				return nil, err
+			}
+		}
+		if i < len(relays)-1 {
+			s.logger.Printf("Giving up on %s, trying %s\n", relay, relays[i+1])
+		}
+	}
+	return nil, err
+}
+
+// DeliveredBy returns the host:port of the SMTP server that accepted the
+// message.
+func (s *Sender) DeliveredBy() string {
+	return s.deliveredBy
+}
+
+func (s *Sender) send(msg []byte) (statuses []RecipientStatus, err error) {
+	var c *smtp.Client
 	var wc io.WriteCloser
+	phase := "dial"
+	defer func() {
+		if netErr, ok := errors.Cause(err).(net.Error); ok && netErr.Timeout() {
+			err = errors.Wrapf(err, "SMTP session timed out during %s", phase)
+		}
+	}()
 	if s.debug {
 		s.logger.Println("Dialing")
 	}
-	c, err = smtp.Dial(fmt.Sprintf("%s:%s", s.host, s.port))
+	c, err = s.dial()
 	if err != nil {
-		return errors.Wrap(err, "Error Dialing smtp server")
+		return nil, err
 	}
 	defer c.Close()
 
@@ -68,128 +177,328 @@ func (s *Sender) Send(msg []byte) error {
 	if s.HostOrigin != "" {
 		hostOrigin = s.HostOrigin
 	}
+	phase = "EHLO"
 	if s.debug {
 		s.logger.Println("Saying Hello to SMTP Server")
 	}
 	if err = c.Hello(hostOrigin); err != nil {
-		return errors.Wrap(err, fmt.Sprintf("unable to connect with hello with host name %s, try setting property host_origin", hostOrigin))
+		return nil, errors.Wrap(err, fmt.Sprintf("unable to connect with hello with host name %s, try setting property host_origin", hostOrigin))
 	}
-	if s.debug {
-		s.logger.Println("STARTTLS with SMTP Server")
-	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		config := s.tlsConfig()
+	if s.TLSMode != TLSModeImplicit && s.TLSMode != TLSModeNone {
+		phase = "STARTTLS"
+		if s.debug {
+			s.logger.Println("STARTTLS with SMTP Server")
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			config, err := s.tlsConfig()
+			if err != nil {
+				return nil, err
+			}
 
-		if err = c.StartTLS(config); err != nil {
-			return errors.Wrap(err, "unable to start TLS")
+			if err = c.StartTLS(config); err != nil {
+				return nil, errors.Wrap(err, "unable to start TLS")
+			}
+		} else if s.RequireTLS {
+			return nil, errors.New("SMTP server does not advertise STARTTLS, refusing to continue in cleartext because require_tls is enabled")
+		}
+	}
+	if s.RequireTLS {
+		if state, ok := c.TLSConnectionState(); !ok || !state.HandshakeComplete {
+			return nil, errors.New("connection to SMTP server is not encrypted, refusing to continue because require_tls is enabled")
 		}
 	}
 
+	phase = "AUTH"
 	if s.debug {
 		s.logger.Println("Authenticating with SMTP Server")
 	}
 	err = s.doAuth(c)
 	if err != nil {
-		return errors.Wrap(err, "Error doing auth:")
+		return nil, errors.Wrap(err, "Error doing auth:")
 	}
+	for _, addr := range append([]string{s.From}, s.To...) {
+		if isASCII(addr) {
+			continue
+		}
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return nil, errors.Errorf("SMTP server does not advertise SMTPUTF8, which is required to send to or from %s", addr)
+		}
+		break
+	}
+	phase = "MAIL"
 	if s.debug {
 		s.logger.Println("Setting From")
 	}
 	if err = c.Mail(s.From); err != nil {
-		return errors.Wrap(err, "Error setting from:")
+		return nil, errors.Wrap(err, "Error setting from:")
 	}
+	phase = "RCPT"
 	if s.debug {
 		s.logger.Println("Setting TO")
 	}
+	statuses = make([]RecipientStatus, 0, len(s.To))
+	accepted := 0
 	for _, addr := range s.To {
-		if err = c.Rcpt(addr); err != nil {
-			if errCode, ok := err.(*textproto.Error); ok && errCode.Code == 550 {
-				s.logger.Printf("Skipping %s: %s\n", addr, err.Error())
-				continue
-			}
-			return errors.Wrap(err, "Error setting to:")
+		status, err := rcpt(c, addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error setting to:")
+		}
+		if !status.Accepted {
+			s.logger.Printf("Skipping %s: %d %s\n", addr, status.Code, status.Message)
+		} else {
+			accepted++
 		}
+		statuses = append(statuses, status)
+	}
+	if accepted == 0 {
+		c.Quit()
+		return statuses, nil
 	}
 
+	phase = "DATA"
 	if s.debug {
 		s.logger.Println("Getting Data from SMTP Server")
 	}
 	wc, err = c.Data()
 	if err != nil {
-		return errors.Wrap(err, "Error getting Data:")
+		return nil, errors.Wrap(err, "Error getting Data:")
 	}
 	if s.debug {
 		s.logger.Println(fmt.Sprintf("Writing message to SMTP Server %s", string(msg)))
 	}
 	_, err = wc.Write(msg)
 	if err != nil {
-		return errors.Wrap(err, "Error writting message data:")
+		return nil, errors.Wrap(err, "Error writting message data:")
 	}
 	if s.debug {
 		s.logger.Println("Closing connection to SMTP Server")
 	}
 	err = wc.Close()
 	if err != nil {
-		return errors.Wrap(err, "Error closing:")
+		err = errors.Wrap(err, "Error closing:")
+		// without a reply to the end of the data the server may still have
+		// accepted the message
+		if failureClass(errors.Cause(err)) == RetryOnConnection {
+			return nil, afterDeliveryError{errors.Wrap(err, "the message may have been delivered")}
+		}
+		return nil, err
 	}
+	phase = "QUIT"
 	if s.debug {
 		s.logger.Println("Quitting connection to SMTP Server")
 	}
 	err = c.Quit()
 	if err != nil {
-		return errors.Wrap(err, "Error quitting:")
+		return nil, afterDeliveryError{errors.Wrap(err, "Error quitting:")}
 	}
-	return nil
+	return statuses, nil
+}
+
+// rcpt issues RCPT TO for addr. Permanent rejections are returned as a status
+// rather than an error so the remaining recipients can still be sent to.
+func rcpt(c *smtp.Client, addr string) (RecipientStatus, error) {
+	id, err := c.Text.Cmd("RCPT TO:<%s>", addr)
+	if err != nil {
+		return RecipientStatus{}, err
+	}
+	c.Text.StartResponse(id)
+	defer c.Text.EndResponse(id)
+	code, message, err := c.Text.ReadResponse(25)
+	if err != nil {
+		if protoErr, ok := err.(*textproto.Error); ok && code >= 500 {
+			return RecipientStatus{Address: addr, Code: protoErr.Code, Message: protoErr.Msg}, nil
+		}
+		return RecipientStatus{}, err
+	}
+	return RecipientStatus{Address: addr, Accepted: true, Code: code, Message: message}, nil
+}
+
+func (s *Sender) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(s.host, s.port)
+	var deadline time.Time
+	if s.Timeouts.Session > 0 {
+		deadline = time.Now().Add(s.Timeouts.Session)
+	}
+	dialer := &net.Dialer{Timeout: s.Timeouts.Dial, Deadline: deadline}
+	if s.TLSMode != TLSModeImplicit {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error Dialing smtp server")
+		}
+		c, err := smtp.NewClient(s.withDeadlines(conn, deadline), s.host)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "Error Dialing smtp server")
+		}
+		return c, nil
+	}
+
+	config, err := s.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error Dialing smtp server with implicit TLS")
+	}
+	tlsConn := tls.Client(s.withDeadlines(conn, deadline), config)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Error Dialing smtp server with implicit TLS")
+	}
+	c, err := smtp.NewClient(tlsConn, s.host)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Error Dialing smtp server with implicit TLS")
+	}
+	return c, nil
+}
+
+func (s *Sender) withDeadlines(conn net.Conn, deadline time.Time) net.Conn {
+	if s.Timeouts.Command <= 0 && deadline.IsZero() {
+		return conn
+	}
+	return &deadlineConn{Conn: conn, timeout: s.Timeouts.Command, deadline: deadline}
 }
 
-func (s *Sender) tlsConfig() *tls.Config {
+// deadlineConn moves the deadline of the connection forward by timeout before
+// every read and write, so that each SMTP command has to be answered within
+// timeout, but never past the deadline of the whole session.
+type deadlineConn struct {
+	net.Conn
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.extend()
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.extend()
+	return c.Conn.Write(b)
+}
+
+func (c *deadlineConn) extend() {
+	deadline := c.deadline
+	if c.timeout > 0 {
+		next := time.Now().Add(c.timeout)
+		if deadline.IsZero() || next.Before(deadline) {
+			deadline = next
+		}
+	}
+	c.Conn.SetDeadline(deadline)
+}
+
+func (s *Sender) tlsConfig() (*tls.Config, error) {
 	config := &tls.Config{
 		ServerName: s.host,
 	}
 
+	if s.ClientCert != "" || s.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(s.ClientCert), []byte(s.ClientKey))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
 	if s.SkipSSLValidation {
 		config.InsecureSkipVerify = s.SkipSSLValidation
-		return config
+		return config, nil
 	}
 
 	if s.CaCert != "" {
 		caPool := x509.NewCertPool()
 		caPool.AppendCertsFromPEM([]byte(s.CaCert))
 		config.RootCAs = caPool
-		return config
+		return config, nil
 	}
 
-	return config
+	return config, nil
 }
 
 func (s *Sender) doAuth(c *smtp.Client) error {
 	if s.Anonymous {
 		return nil
 	}
-	if s.LoginAuth {
-		auth := LoginAuth(s.username, s.password)
+	if s.username == "" && s.ClientCert != "" {
+		// the client certificate presented during the TLS handshake
+		// authenticates the session
+		return nil
+	}
+	ok, advertised := c.Extension("AUTH")
+	if !ok {
+		return errors.New("SMTP server does not advertise AUTH but credentials were configured, specify anonymous: true to send without authenticating")
+	}
+	mechanism, err := s.negotiateAuthMechanism(strings.Fields(advertised))
+	if err != nil {
+		return err
+	}
+	if s.debug {
+		s.logger.Printf("Using auth mechanism %s, server advertises %s\n", strings.ToUpper(mechanism), advertised)
+	}
+	auth, authType, err := s.auth(mechanism)
+	if err != nil {
+		return err
+	}
+	if err := c.Auth(auth); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("unable to auth using type %s", authType))
+	}
+	return nil
+}
 
-		if auth != nil {
-			if ok, _ := c.Extension("AUTH"); ok {
-				if err := c.Auth(auth); err != nil {
-					return errors.Wrap(err, "unable to auth using type Login Auth")
-				}
+// negotiateAuthMechanism picks the mechanism to authenticate with from the
+// ones advertised by the server. A pinned mechanism must be advertised,
+// otherwise the strongest advertised mechanism usable with the configured
+// credentials is chosen.
+func (s *Sender) negotiateAuthMechanism(advertised []string) (string, error) {
+	offered := func(mechanism string) bool {
+		for _, name := range advertised {
+			if strings.EqualFold(name, mechanism) {
+				return true
 			}
 		}
-	} else {
-		auth := smtp.PlainAuth(
-			"",
-			s.username,
-			s.password,
-			s.host,
-		)
-		if auth != nil {
-			if ok, _ := c.Extension("AUTH"); ok {
-				if err := c.Auth(auth); err != nil {
-					return errors.Wrap(err, "unable to auth using type Plain Auth")
-				}
-			}
+		return false
+	}
+
+	mechanism := s.AuthMechanism
+	if mechanism == "" && s.LoginAuth {
+		mechanism = AuthMechanismLogin
+	}
+	if mechanism != "" && mechanism != AuthMechanismAuto {
+		if !offered(mechanism) {
+			return "", errors.Errorf("SMTP server does not support auth mechanism %s, it advertises: %s", strings.ToUpper(mechanism), strings.Join(advertised, " "))
 		}
+		return mechanism, nil
 	}
-	return nil
+
+	preference := passwordAuthPreference
+	if s.AccessToken != "" {
+		preference = tokenAuthPreference
+	}
+	for _, candidate := range preference {
+		if offered(candidate) {
+			return candidate, nil
+		}
+	}
+	return "", errors.Errorf("SMTP server does not support any usable auth mechanism, it advertises: %s", strings.Join(advertised, " "))
+}
+
+func (s *Sender) auth(mechanism string) (smtp.Auth, string, error) {
+	switch mechanism {
+	case AuthMechanismCRAMMD5:
+		return smtp.CRAMMD5Auth(s.username, s.password), "CRAM-MD5", nil
+	case AuthMechanismPlain:
+		return smtp.PlainAuth("", s.username, s.password, s.host), "Plain Auth", nil
+	case AuthMechanismLogin:
+		return LoginAuth(s.username, s.password), "Login Auth", nil
+	case AuthMechanismXOAuth2:
+		return XOAuth2Auth(s.username, s.AccessToken), "XOAUTH2", nil
+	case AuthMechanismOAuthBearer:
+		port, _ := strconv.Atoi(s.port)
+		return OAuthBearerAuth(s.username, s.AccessToken, s.host, port), "OAUTHBEARER", nil
+	}
+	return nil, "", errors.Errorf("unsupported auth mechanism %q", mechanism)
 }
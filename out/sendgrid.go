@@ -0,0 +1,154 @@
+package out
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+
+	"github.com/pkg/errors"
+)
+
+const sendGridEndpoint = "https://api.sendgrid.com"
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to,omitempty"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridMessage struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	ReplyToList      []sendGridAddress         `json:"reply_to_list,omitempty"`
+}
+
+func (config SendGrid) validate() error {
+	if config.APIKey == "" {
+		return errors.New(`missing required field "source.sendgrid.api_key"`)
+	}
+	return nil
+}
+
+// request builds a v3 mail send request. The API does not accept a composed
+// message, so msg is taken apart into its parts. The API takes headers as an
+// object, so headers given more than once are rejected.
+func (config SendGrid) request(from string, to []string, msg []byte) (*http.Request, error) {
+	parsed, err := parseMessage(msg, to)
+	if err != nil {
+		return nil, err
+	}
+
+	message := sendGridMessage{
+		Personalizations: []sendGridPersonalization{{
+			To:  sendGridAddresses(parsed.to),
+			Cc:  sendGridAddresses(parsed.cc),
+			Bcc: sendGridAddresses(parsed.bcc),
+		}},
+		From:    sendGridAddress{Email: from, Name: parsed.from.Name},
+		Subject: parsed.subject,
+	}
+	if parsed.text != "" || parsed.html == "" {
+		message.Content = append(message.Content, sendGridContent{Type: "text/plain", Value: parsed.text})
+	}
+	if parsed.html != "" {
+		message.Content = append(message.Content, sendGridContent{Type: "text/html", Value: parsed.html})
+	}
+	for _, a := range parsed.attachments {
+		attachment := sendGridAttachment{
+			Content:     base64.StdEncoding.EncodeToString(a.content),
+			Type:        a.contentType,
+			Filename:    a.name,
+			Disposition: "attachment",
+		}
+		if a.inline {
+			attachment.Disposition = "inline"
+			attachment.ContentID = a.contentID
+		}
+		message.Attachments = append(message.Attachments, attachment)
+	}
+	seen := map[string]bool{}
+	for _, header := range parsed.headers {
+		name := textproto.CanonicalMIMEHeaderKey(header.Name)
+		if seen[name] {
+			return nil, errors.Errorf("header %s is given more than once, which sendgrid does not support", header.Name)
+		}
+		seen[name] = true
+		if name == "Reply-To" {
+			if err := message.setReplyTo(header.Value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if message.Headers == nil {
+			message.Headers = map[string]string{}
+		}
+		message.Headers[header.Name] = header.Value
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := endpointURL(config.Endpoint, sendGridEndpoint, "/v3/mail/send")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// setReplyTo sets the reply_to field from a Reply-To header, which the API
+// does not accept in headers. Lists of more than one address go into
+// reply_to_list instead.
+func (m *sendGridMessage) setReplyTo(value string) error {
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse Reply-To header")
+	}
+	converted := sendGridAddresses(addresses)
+	if len(converted) == 1 {
+		m.ReplyTo = &converted[0]
+		return nil
+	}
+	m.ReplyToList = converted
+	return nil
+}
+
+func sendGridAddresses(addresses []*mail.Address) []sendGridAddress {
+	var converted []sendGridAddress
+	for _, address := range addresses {
+		converted = append(converted, sendGridAddress{Email: address.Address, Name: address.Name})
+	}
+	return converted
+}
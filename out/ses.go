@@ -0,0 +1,131 @@
+package out
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type sesRawMessage struct {
+	Data []byte
+}
+
+type sesMessage struct {
+	FromEmailAddress string
+	Destination      struct {
+		ToAddresses []string
+	}
+	Content struct {
+		Raw sesRawMessage
+	}
+}
+
+func (config SES) validate() error {
+	if config.Region == "" {
+		return errors.New(`missing required field "source.ses.region"`)
+	}
+	if config.AccessKeyID == "" {
+		return errors.New(`missing required field "source.ses.access_key_id"`)
+	}
+	if config.SecretAccessKey == "" {
+		return errors.New(`missing required field "source.ses.secret_access_key"`)
+	}
+	return nil
+}
+
+// request builds a SendEmail request of the v2 API, which sends the composed
+// message as it is to the envelope recipients. The request is signed with AWS
+// Signature Version 4.
+func (config SES) request(from string, to []string, msg []byte) (*http.Request, error) {
+	var message sesMessage
+	message.FromEmailAddress = from
+	message.Destination.ToAddresses = to
+	message.Content.Raw.Data = msg
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := endpointURL(config.Endpoint, fmt.Sprintf("https://email.%s.amazonaws.com", config.Region), "/v2/email/outbound-emails")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	config.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds the Authorization header of AWS Signature Version 4 to req.
+func (config SES) sign(req *http.Request, body []byte, now time.Time) {
+	const service = "ses"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", config.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, config.Region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + config.SecretAccessKey)
+	for _, part := range []string{date, config.Region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
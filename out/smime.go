@@ -0,0 +1,193 @@
+package out
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// smimeKeys holds the parsed source.smime settings.
+type smimeKeys struct {
+	certificate *x509.Certificate
+	chain       []*x509.Certificate
+	key         crypto.PrivateKey
+	recipients  []*x509.Certificate
+}
+
+func (s SMIME) configured() bool {
+	return s.Certificate != "" || s.PrivateKey != "" || len(s.RecipientCertificates) > 0
+}
+
+// keys parses the signing certificate and key, and the certificates messages
+// are encrypted for.
+func (s SMIME) keys() (*smimeKeys, error) {
+	if s.Certificate == "" && len(s.RecipientCertificates) == 0 {
+		return nil, errors.New(`missing required field "source.smime.certificate" or "source.smime.recipient_certificates". Must specify at least one`)
+	}
+	if (s.Certificate == "") != (s.PrivateKey == "") {
+		return nil, errors.New(`"source.smime.certificate" and "source.smime.private_key" must be specified together`)
+	}
+
+	keys := &smimeKeys{}
+	if s.Certificate != "" {
+		pair, err := tls.X509KeyPair([]byte(s.Certificate), []byte(s.PrivateKey))
+		if err != nil {
+			return nil, errors.Wrap(err, `invalid "source.smime.certificate" or "source.smime.private_key"`)
+		}
+		switch pair.PrivateKey.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		default:
+			return nil, errors.Errorf(`"source.smime.private_key" is a %T. Must be an RSA or ECDSA key`, pair.PrivateKey)
+		}
+		for _, der := range pair.Certificate {
+			certificate, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, errors.Wrap(err, `invalid "source.smime.certificate"`)
+			}
+			keys.chain = append(keys.chain, certificate)
+		}
+		keys.certificate, keys.chain = keys.chain[0], keys.chain[1:]
+		keys.key = pair.PrivateKey
+	}
+
+	for i, text := range s.RecipientCertificates {
+		field := fmt.Sprintf("source.smime.recipient_certificates[%d]", i)
+		block, _ := pem.Decode([]byte(text))
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, errors.Errorf(`"%s" is not a PEM encoded certificate`, field)
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, `invalid "%s"`, field)
+		}
+		if _, ok := certificate.PublicKey.(*rsa.PublicKey); !ok {
+			return nil, errors.Errorf(`"%s" has a %T. Must have an RSA key`, field, certificate.PublicKey)
+		}
+		keys.recipients = append(keys.recipients, certificate)
+	}
+	return keys, nil
+}
+
+// protect signs the body of msg, if a signing certificate is configured, and
+// then encrypts it, if recipient certificates are configured. Header fields
+// other than the Content-* ones stay outside, so the message can be routed.
+func (k *smimeKeys) protect(msg []byte) ([]byte, error) {
+	outer, entity, err := splitMIMEEntity(msg)
+	if err != nil {
+		return nil, err
+	}
+	if k.certificate != nil {
+		if entity, err = k.sign(entity); err != nil {
+			return nil, errors.Wrap(err, "Error signing mail with S/MIME")
+		}
+	}
+	if len(k.recipients) > 0 {
+		if entity, err = k.encrypt(entity); err != nil {
+			return nil, errors.Wrap(err, "Error encrypting mail with S/MIME")
+		}
+	}
+	return append(outer, entity...), nil
+}
+
+// sign returns a multipart/signed entity holding entity and a detached
+// signature of it.
+func (k *smimeKeys) sign(entity []byte) ([]byte, error) {
+	signedData, err := pkcs7.NewSignedData(entity)
+	if err != nil {
+		return nil, err
+	}
+	signedData.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := signedData.AddSignerChain(k.certificate, k.key, k.chain, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	signedData.Detach()
+	signature, err := signedData.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Content-Type: %s\r\n\r\n", mime.FormatMediaType("multipart/signed", map[string]string{
+		"protocol": "application/pkcs7-signature",
+		"micalg":   "sha-256",
+		"boundary": boundary,
+	}))
+	fmt.Fprintf(buf, "--%s\r\n", boundary)
+	buf.Write(entity)
+	fmt.Fprintf(buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	if err := writeBase64(buf, signature); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(buf, "\r\n--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// The pkcs7 package takes the content encryption algorithm from a package
+// variable rather than a parameter, and defaults to DES. It is set once here
+// so that encrypting does not change it as a side effect; nothing else in out
+// uses pkcs7 to encrypt.
+func init() {
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+}
+
+// encrypt returns an application/pkcs7-mime entity holding entity encrypted
+// with AES-256 for every recipient certificate.
+func (k *smimeKeys) encrypt(entity []byte) ([]byte, error) {
+	enveloped, err := pkcs7.Encrypt(entity, k.recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=\"smime.p7m\"\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=\"smime.p7m\"\r\n\r\n")
+	if err := writeBase64(buf, enveloped); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes(), nil
+}
+
+// splitMIMEEntity splits msg into its header fields other than the Content-*
+// ones, and the MIME entity made of the Content-* fields and the body.
+func splitMIMEEntity(msg []byte) ([]byte, []byte, error) {
+	end := bytes.Index(msg, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, nil, errors.New("unable to find the end of the message header")
+	}
+	var outer, entity bytes.Buffer
+	content := false
+	for _, line := range strings.SplitAfter(string(msg[:end+2]), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			content = strings.HasPrefix(strings.ToLower(line), "content-")
+		}
+		if content {
+			entity.WriteString(line)
+		} else {
+			outer.WriteString(line)
+		}
+	}
+	entity.Write(msg[end+2:])
+	return outer.Bytes(), entity.Bytes(), nil
+}
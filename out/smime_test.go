@@ -0,0 +1,252 @@
+package out_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("S/MIME", func() {
+	fixture := newSMTPOutFixture()
+	var caCert *x509.Certificate
+	var caKey *rsa.PrivateKey
+	var recipientCert *x509.Certificate
+	var recipientKey *rsa.PrivateKey
+
+	issue := func(name string, key crypto.Signer, isCA bool) *x509.Certificate {
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: name},
+			EmailAddresses:        []string{name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+			BasicConstraintsValid: true,
+		}
+		parent, parentKey := caCert, crypto.Signer(caKey)
+		if isCA {
+			template.IsCA = true
+			template.KeyUsage = x509.KeyUsageCertSign
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+		Expect(err).NotTo(HaveOccurred())
+		certificate, err := x509.ParseCertificate(der)
+		Expect(err).NotTo(HaveOccurred())
+		return certificate
+	}
+
+	encodeCertificate := func(certificate *x509.Certificate) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}))
+	}
+
+	encodeKey := func(key crypto.PrivateKey) string {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		Expect(err).NotTo(HaveOccurred())
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	}
+
+	// verifySigned checks the detached signature of a multipart/signed entity
+	// against the test CA and returns the signed entity.
+	verifySigned := func(header mail.Header, body []byte) []byte {
+		mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mediaType).To(Equal("multipart/signed"))
+		Expect(params).To(HaveKeyWithValue("protocol", "application/pkcs7-signature"))
+		Expect(params).To(HaveKeyWithValue("micalg", "sha-256"))
+
+		delimiter := "--" + params["boundary"]
+		parts := strings.Split(string(body), "\r\n"+delimiter)
+		Expect(strings.HasPrefix(parts[0], delimiter+"\r\n")).To(BeTrue())
+		Expect(parts).To(HaveLen(3))
+		signed := []byte(strings.TrimPrefix(parts[0], delimiter+"\r\n"))
+
+		signaturePart, err := mail.ReadMessage(strings.NewReader(strings.TrimPrefix(parts[1], "\r\n")))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(signaturePart.Header.Get("Content-Type")).To(HavePrefix("application/pkcs7-signature"))
+		encoded, err := ioutil.ReadAll(signaturePart.Body)
+		Expect(err).NotTo(HaveOccurred())
+		der, err := base64.StdEncoding.DecodeString(strings.Replace(string(encoded), "\r\n", "", -1))
+		Expect(err).NotTo(HaveOccurred())
+
+		p7, err := pkcs7.Parse(der)
+		Expect(err).NotTo(HaveOccurred())
+		p7.Content = signed
+		roots := x509.NewCertPool()
+		roots.AddCert(caCert)
+		Expect(p7.VerifyWithChain(roots)).To(Succeed())
+		Expect(p7.GetOnlySigner().Subject.CommonName).To(Equal("bot@example.com"))
+		return signed
+	}
+
+	decrypt := func(header mail.Header, body []byte) *mail.Message {
+		Expect(header.Get("Content-Type")).To(HavePrefix("application/pkcs7-mime; smime-type=enveloped-data"))
+		Expect(header.Get("Content-Transfer-Encoding")).To(Equal("base64"))
+		der, err := base64.StdEncoding.DecodeString(strings.Replace(string(body), "\r\n", "", -1))
+		Expect(err).NotTo(HaveOccurred())
+		p7, err := pkcs7.Parse(der)
+		Expect(err).NotTo(HaveOccurred())
+		entity, err := p7.Decrypt(recipientCert, recipientKey)
+		Expect(err).NotTo(HaveOccurred())
+		message, err := mail.ReadMessage(bytes.NewReader(entity))
+		Expect(err).NotTo(HaveOccurred())
+		return message
+	}
+
+	readBody := func(message *mail.Message) []byte {
+		body, err := ioutil.ReadAll(message.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return body
+	}
+
+	BeforeEach(func() {
+		var err error
+		caKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		caCert = issue("Test CA", caKey, true)
+		signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		recipientKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		recipientCert = issue("audit@example.net", recipientKey, false)
+
+		fixture.inputs.Source.To = []string{"audit@example.net"}
+		fixture.inputs.Source.SMIME.Certificate = encodeCertificate(issue("bot@example.com", signingKey, false)) + encodeCertificate(caCert)
+		fixture.inputs.Source.SMIME.PrivateKey = encodeKey(signingKey)
+		fixture.inputs.Params.HeadersMap = map[string]interface{}{"X-Build": "42"}
+	})
+
+	It("signs the message with a detached signature", func() {
+		_, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		message := fixture.deliveredMessage()
+		Expect(message.Header.Get("Subject")).To(Equal("Build passed"))
+		Expect(message.Header.Get("X-Build")).To(Equal("42"))
+		Expect(message.Header.Get("MIME-Version")).To(Equal("1.0"))
+
+		signed, err := mail.ReadMessage(bytes.NewReader(verifySigned(message.Header, readBody(message))))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(signed.Header.Get("Content-Type")).To(HavePrefix("multipart/alternative"))
+		Expect(signed.Header.Get("Subject")).To(BeEmpty())
+		Expect(string(readBody(signed))).To(ContainSubstring("the build passed"))
+	})
+
+	It("signs with an ECDSA key", func() {
+		signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).NotTo(HaveOccurred())
+		fixture.inputs.Source.SMIME.Certificate = encodeCertificate(issue("bot@example.com", signingKey, false))
+		fixture.inputs.Source.SMIME.PrivateKey = encodeKey(signingKey)
+		_, err = fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		message := fixture.deliveredMessage()
+		verifySigned(message.Header, readBody(message))
+	})
+
+	It("detects a changed body", func() {
+		_, err := fixture.run()
+		Expect(err).NotTo(HaveOccurred())
+
+		message := fixture.deliveredMessage()
+		body := bytes.Replace(readBody(message), []byte("Content-Type: multipart/alternative"), []byte("Content-Type: multipart/mixed"), 1)
+		mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mediaType).To(Equal("multipart/signed"))
+		delimiter := "--" + params["boundary"]
+		parts := strings.Split(string(body), "\r\n"+delimiter)
+		encoded := strings.SplitN(parts[1], "\r\n\r\n", 2)[1]
+		der, err := base64.StdEncoding.DecodeString(strings.Replace(encoded, "\r\n", "", -1))
+		Expect(err).NotTo(HaveOccurred())
+		p7, err := pkcs7.Parse(der)
+		Expect(err).NotTo(HaveOccurred())
+		p7.Content = []byte(strings.TrimPrefix(parts[0], delimiter+"\r\n"))
+		Expect(p7.Verify()).NotTo(Succeed())
+	})
+
+	Context("when recipient certificates are configured", func() {
+		BeforeEach(func() {
+			fixture.inputs.Source.SMIME.RecipientCertificates = []string{encodeCertificate(recipientCert)}
+		})
+
+		It("signs and then encrypts the message", func() {
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			message := fixture.deliveredMessage()
+			Expect(message.Header.Get("Subject")).To(Equal("Build passed"))
+			body := readBody(message)
+			Expect(string(body)).NotTo(ContainSubstring("the build passed"))
+
+			decrypted := decrypt(message.Header, body)
+			signed, err := mail.ReadMessage(bytes.NewReader(verifySigned(decrypted.Header, readBody(decrypted))))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(readBody(signed))).To(ContainSubstring("the build passed"))
+		})
+
+		It("only encrypts the message without a signing certificate", func() {
+			fixture.inputs.Source.SMIME.Certificate = ""
+			fixture.inputs.Source.SMIME.PrivateKey = ""
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			message := fixture.deliveredMessage()
+			decrypted := decrypt(message.Header, readBody(message))
+			Expect(decrypted.Header.Get("Content-Type")).To(HavePrefix("multipart/alternative"))
+			Expect(string(readBody(decrypted))).To(ContainSubstring("the build passed"))
+		})
+	})
+
+	Context("when the configuration is invalid", func() {
+		It("fails when the certificate is given without the private key", func() {
+			fixture.inputs.Source.SMIME.PrivateKey = ""
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.smime.certificate" and "source.smime.private_key" must be specified together`))
+		})
+
+		It("fails when the private key does not match the certificate", func() {
+			otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).NotTo(HaveOccurred())
+			fixture.inputs.Source.SMIME.PrivateKey = encodeKey(otherKey)
+			_, err = fixture.run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix(`Invalid configuration: invalid "source.smime.certificate" or "source.smime.private_key": `))
+		})
+
+		It("fails when a recipient certificate is not PEM encoded", func() {
+			fixture.inputs.Source.SMIME.RecipientCertificates = []string{"not a certificate"}
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.smime.recipient_certificates[0]" is not a PEM encoded certificate`))
+		})
+
+		It("fails with a transport that composes the message again", func() {
+			fixture.inputs.Source.Transport = "postmark"
+			fixture.inputs.Source.Postmark.ServerToken = "some-token"
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: "source.smime" cannot be used with transport "postmark", which composes the message again`))
+		})
+
+		AfterEach(func() {
+			Expect(fixture.smtpServer.Deliveries).To(BeEmpty())
+		})
+	})
+})
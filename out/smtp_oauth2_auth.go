@@ -0,0 +1,67 @@
+package out
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// gs2NameEscaper escapes an authorization identity for use in a GS2 header,
+// see RFC 5801 section 4.
+var gs2NameEscaper = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+type xoauth2Auth struct {
+	username, token string
+}
+
+// XOAuth2Auth returns an smtp.Auth that implements the XOAUTH2 mechanism used
+// by Gmail and Microsoft 365.
+func XOAuth2Auth(username, token string) smtp.Auth {
+	return &xoauth2Auth{username, token}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", a.username, a.token)
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// the server sends a JSON error challenge which must be answered with
+		// an empty response before it reports the failure
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+type oauthBearerAuth struct {
+	username, token, host string
+	port                  int
+}
+
+// OAuthBearerAuth returns an smtp.Auth that implements the OAUTHBEARER
+// mechanism described in RFC 7628.
+func OAuthBearerAuth(username, token, host string, port int) smtp.Auth {
+	return &oauthBearerAuth{username, token, host, port}
+}
+
+func (a *oauthBearerAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := fmt.Sprintf("n,a=%s,\x01", gs2NameEscaper.Replace(a.username))
+	if a.host != "" {
+		resp += fmt.Sprintf("host=%s\x01", a.host)
+	}
+	if a.port != 0 {
+		resp += fmt.Sprintf("port=%d\x01", a.port)
+	}
+	resp += fmt.Sprintf("auth=Bearer %s\x01\x01", a.token)
+	return "OAUTHBEARER", []byte(resp), nil
+}
+
+func (a *oauthBearerAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// RFC 7628 section 3.2.3: the client acknowledges the error
+		// challenge with a single %x01
+		return []byte{0x01}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,49 @@
+package out_test
+
+import (
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OAuth2 SMTP auth", func() {
+	Context("XOAUTH2", func() {
+		It("sends the user and bearer token in the initial response", func() {
+			auth := out.XOAuth2Auth("someone@example.com", "some-token")
+
+			mechanism, resp, err := auth.Start(nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mechanism).Should(Equal("XOAUTH2"))
+			Expect(string(resp)).Should(Equal("user=someone@example.com\x01auth=Bearer some-token\x01\x01"))
+		})
+
+		It("answers an error challenge with an empty response", func() {
+			auth := out.XOAuth2Auth("someone@example.com", "some-token")
+
+			resp, err := auth.Next([]byte(`{"status":"401"}`), true)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(resp).ShouldNot(BeNil())
+			Expect(resp).Should(BeEmpty())
+		})
+	})
+
+	Context("OAUTHBEARER", func() {
+		It("sends a GS2 header, host, port and bearer token in the initial response", func() {
+			auth := out.OAuthBearerAuth("some,one=@example.com", "some-token", "smtp.example.com", 587)
+
+			mechanism, resp, err := auth.Start(nil)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(mechanism).Should(Equal("OAUTHBEARER"))
+			Expect(string(resp)).Should(Equal("n,a=some=2Cone=3D@example.com,\x01host=smtp.example.com\x01port=587\x01auth=Bearer some-token\x01\x01"))
+		})
+
+		It("acknowledges an error challenge", func() {
+			auth := out.OAuthBearerAuth("someone@example.com", "some-token", "smtp.example.com", 587)
+
+			resp, err := auth.Next([]byte(`{"status":"invalid_token"}`), true)
+			Expect(err).ShouldNot(HaveOccurred())
+			Expect(resp).Should(Equal([]byte{0x01}))
+		})
+	})
+})
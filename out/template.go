@@ -0,0 +1,189 @@
+package out
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TemplateData - values available to subject, body and headers templates
+// when params.template is enabled
+type TemplateData struct {
+	Build BuildMetadata
+	Env   map[string]string
+	Vars  map[string]interface{}
+}
+
+// BuildMetadata - the Concourse build that runs the put
+type BuildMetadata struct {
+	ID             string
+	Name           string
+	JobName        string
+	PipelineName   string
+	TeamName       string
+	ATCExternalURL string
+}
+
+// URL returns the link to the build in the Concourse web UI, or an empty
+// string when the build is not part of a pipeline job.
+func (b BuildMetadata) URL() string {
+	if b.ATCExternalURL == "" || b.TeamName == "" || b.PipelineName == "" || b.JobName == "" || b.Name == "" {
+		return ""
+	}
+	return strings.TrimSuffix(b.ATCExternalURL, "/") +
+		"/teams/" + url.PathEscape(b.TeamName) +
+		"/pipelines/" + url.PathEscape(b.PipelineName) +
+		"/jobs/" + url.PathEscape(b.JobName) +
+		"/builds/" + url.PathEscape(b.Name)
+}
+
+type templateRenderer struct {
+	sourceRoot string
+	data       TemplateData
+}
+
+func newTemplateRenderer(sourceRoot string, vars map[string]interface{}) *templateRenderer {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	if vars == nil {
+		vars = map[string]interface{}{}
+	}
+
+	return &templateRenderer{
+		sourceRoot: sourceRoot,
+		data: TemplateData{
+			Build: BuildMetadata{
+				ID:             env["BUILD_ID"],
+				Name:           env["BUILD_NAME"],
+				JobName:        env["BUILD_JOB_NAME"],
+				PipelineName:   env["BUILD_PIPELINE_NAME"],
+				TeamName:       env["BUILD_TEAM_NAME"],
+				ATCExternalURL: env["ATC_EXTERNAL_URL"],
+			},
+			Env:  env,
+			Vars: vars,
+		},
+	}
+}
+
+func (r *templateRenderer) funcs() map[string]interface{} {
+	return map[string]interface{}{
+		"readFile": r.readFile,
+		"readJSON": r.readJSON,
+		"readYAML": r.readYAML,
+	}
+}
+
+// renderText renders text as a text/template.
+func (r *templateRenderer) renderText(name, text string) (string, error) {
+	tmpl, err := texttemplate.New(name).Funcs(r.funcs()).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse %s template", name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, r.data); err != nil {
+		return "", errors.Wrapf(err, "unable to render %s template", name)
+	}
+	return buf.String(), nil
+}
+
+// renderHTML renders text as an html/template, escaping values according to
+// the context they are used in.
+func (r *templateRenderer) renderHTML(name, text string) (string, error) {
+	tmpl, err := htmltemplate.New(name).Funcs(r.funcs()).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse %s template", name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, r.data); err != nil {
+		return "", errors.Wrapf(err, "unable to render %s template", name)
+	}
+	return buf.String(), nil
+}
+
+// inputPath resolves path relative to the put's working directory and
+// rejects paths outside of it.
+func (r *templateRenderer) inputPath(path string) (string, error) {
+	root, err := filepath.Abs(r.sourceRoot)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("%s is outside of the put's input directories", path)
+	}
+	return path, nil
+}
+
+func (r *templateRenderer) readFile(path string) (string, error) {
+	path, err := r.inputPath(path)
+	if err != nil {
+		return "", err
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(contents), nil
+}
+
+func (r *templateRenderer) readJSON(path string) (interface{}, error) {
+	contents, err := r.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(contents), &value); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse %s as JSON", path)
+	}
+	return value, nil
+}
+
+func (r *templateRenderer) readYAML(path string) (interface{}, error) {
+	contents, err := r.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(contents), &value); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse %s as YAML", path)
+	}
+	return stringKeys(value), nil
+}
+
+// stringKeys converts the map[interface{}]interface{} values produced by the
+// YAML decoder into map[string]interface{}, so YAML and JSON documents can be
+// used the same way in templates.
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = stringKeys(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = stringKeys(item)
+		}
+	}
+	return value
+}
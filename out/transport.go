@@ -0,0 +1,260 @@
+package out
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TransportSMTP     = "smtp"
+	TransportSendGrid = "sendgrid"
+	TransportMailgun  = "mailgun"
+	TransportSES      = "ses"
+	TransportPostmark = "postmark"
+	TransportMaildir  = "maildir"
+	TransportMbox     = "mbox"
+	TransportPickup   = "pickup"
+)
+
+// Transport - delivers a composed message to its recipients. Sender delivers
+// through SMTP, httpTransport through the HTTP API of a provider and
+// localTransport into a local file
+type Transport interface {
+	Send(msg []byte) ([]RecipientStatus, error)
+	// DeliveredBy returns the host that accepted the message, or the file it
+	// was written to.
+	DeliveredBy() string
+}
+
+// httpRequestBuilder builds the API request that sends msg to the envelope
+// recipients.
+type httpRequestBuilder func(from string, to []string, msg []byte) (*http.Request, error)
+
+// httpTransport - delivers messages through the HTTP API of a provider, which
+// accepts or rejects the message as a whole
+type httpTransport struct {
+	provider string
+	client   *http.Client
+	request  httpRequestBuilder
+	from     string
+	to       []string
+	host     string
+}
+
+func newHTTPTransport(source Source, from string, to []string, client *http.Client) (*httpTransport, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
+	t := &httpTransport{provider: source.transport(), client: client, from: from, to: to}
+	switch t.provider {
+	case TransportSendGrid:
+		t.request = source.SendGrid.request
+	case TransportMailgun:
+		t.request = source.Mailgun.request
+	case TransportSES:
+		t.request = source.SES.request
+	case TransportPostmark:
+		t.request = source.Postmark.request
+	default:
+		return nil, errors.Errorf("unknown transport %q", t.provider)
+	}
+	return t, nil
+}
+
+func (t *httpTransport) Send(msg []byte) ([]RecipientStatus, error) {
+	req, err := t.request(t.from, t.to, msg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to build %s request", t.provider)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to send through %s", t.provider)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s response", t.provider)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, errors.Errorf("%s API returned %s: %s", t.provider, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	t.host = req.URL.Host
+	statuses := make([]RecipientStatus, 0, len(t.to))
+	for _, addr := range t.to {
+		statuses = append(statuses, RecipientStatus{Address: addr, Accepted: true, Code: resp.StatusCode, Message: http.StatusText(resp.StatusCode)})
+	}
+	return statuses, nil
+}
+
+func (t *httpTransport) DeliveredBy() string {
+	return t.host
+}
+
+// endpointURL joins path onto endpoint, or onto fallback if no endpoint is
+// configured.
+func endpointURL(endpoint, fallback, path string) (string, error) {
+	if endpoint == "" {
+		endpoint = fallback
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid endpoint %s", endpoint)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/") + path
+	return base.String(), nil
+}
+
+// parsedMessage - a composed message taken apart again, for APIs that accept
+// its parts rather than the message itself
+type parsedMessage struct {
+	from        *mail.Address
+	to, cc, bcc []*mail.Address
+	subject     string
+	headers     []Header
+	text, html  string
+	attachments []parsedAttachment
+}
+
+type parsedAttachment struct {
+	name        string
+	contentType string
+	contentID   string
+	inline      bool
+	content     []byte
+}
+
+// structuralHeaders are the headers the APIs set themselves from the parts of
+// a parsedMessage.
+var structuralHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Subject": true, "Date": true,
+	"Mime-Version": true, "Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+// parseMessage takes msg apart. Envelope recipients that are in neither the
+// To nor the Cc header are the Bcc recipients.
+func parseMessage(msg []byte, envelope []string) (*parsedMessage, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse message")
+	}
+
+	parsed := &parsedMessage{}
+	decoder := &mime.WordDecoder{}
+	if parsed.subject, err = decoder.DecodeHeader(m.Header.Get("Subject")); err != nil {
+		return nil, errors.Wrap(err, "unable to decode subject")
+	}
+	if parsed.from, err = mail.ParseAddress(m.Header.Get("From")); err != nil {
+		return nil, errors.Wrap(err, "unable to parse From header")
+	}
+	listed := map[string]bool{}
+	for _, list := range []struct {
+		header    string
+		addresses *[]*mail.Address
+	}{{"To", &parsed.to}, {"Cc", &parsed.cc}} {
+		if m.Header.Get(list.header) == "" {
+			continue
+		}
+		if *list.addresses, err = m.Header.AddressList(list.header); err != nil {
+			return nil, errors.Wrapf(err, "unable to parse %s header", list.header)
+		}
+		for _, address := range *list.addresses {
+			listed[strings.ToLower(address.Address)] = true
+		}
+	}
+	for _, addr := range envelope {
+		if !listed[strings.ToLower(addr)] {
+			parsed.bcc = append(parsed.bcc, &mail.Address{Address: addr})
+		}
+	}
+
+	head := msg
+	if end := bytes.Index(msg, []byte("\r\n\r\n")); end >= 0 {
+		head = msg[:end]
+	}
+	headers, err := ParseHeaders(bytes.NewReader(head))
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range headers {
+		if !structuralHeaders[textproto.CanonicalMIMEHeaderKey(header.Name)] {
+			parsed.headers = append(parsed.headers, header)
+		}
+	}
+
+	if err := parsed.addPart(m.Header.Get("Content-Type"), m.Header.Get("Content-Transfer-Encoding"), "", "", m.Body); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+func (p *parsedMessage) addPart(contentType, encoding, disposition, contentID string, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "unable to read MIME part")
+			}
+			err = p.addPart(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"), part.Header.Get("Content-ID"), part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(encoding) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return errors.Wrapf(err, "unable to decode %s part", mediaType)
+	}
+
+	dispositionType, dispositionParams, _ := mime.ParseMediaType(disposition)
+	switch {
+	case dispositionType == "attachment" || dispositionType == "inline":
+		name := dispositionParams["filename"]
+		if name == "" {
+			name = params["name"]
+		}
+		p.attachments = append(p.attachments, parsedAttachment{
+			name:        name,
+			contentType: mediaType,
+			contentID:   strings.Trim(contentID, "<>"),
+			inline:      dispositionType == "inline",
+			content:     content,
+		})
+	case mediaType == "text/html":
+		p.html = string(content)
+	default:
+		p.text = string(content)
+	}
+	return nil
+}
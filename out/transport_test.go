@@ -0,0 +1,325 @@
+package out_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pivotal-cf/email-resource/out"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP transports", func() {
+	fixture := newOutFixture()
+	var apiServer *httptest.Server
+	var requests []*http.Request
+	var bodies [][]byte
+	var status int
+	var response string
+
+	BeforeEach(func() {
+		Expect(os.MkdirAll(filepath.Join(fixture.sourceRoot, "reports"), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(fixture.sourceRoot, "reports", "report.txt"), []byte("all green"), 0600)).To(Succeed())
+
+		requests, bodies = nil, nil
+		status = http.StatusOK
+		response = `{}`
+		apiServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			Expect(err).NotTo(HaveOccurred())
+			requests = append(requests, r)
+			bodies = append(bodies, body)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			w.Write([]byte(response))
+		}))
+
+		fixture.inputs.Source.To = []string{"Jane Doe <jane@example.com>"}
+		fixture.inputs.Source.Bcc = []string{"audit@example.com"}
+		fixture.inputs.Params.HeadersMap = map[string]interface{}{"X-Build": "42"}
+		fixture.inputs.Params.AttachmentGlobs = []string{"reports/*.txt"}
+	})
+
+	AfterEach(func() {
+		apiServer.Close()
+	})
+
+	Context("when the transport is unknown", func() {
+		It("fails", func() {
+			fixture.inputs.Source.Transport = "pigeon"
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: invalid value "pigeon" for field "source.transport". Must be one of "smtp", "sendgrid", "mailgun", "ses", "postmark", "maildir", "mbox" or "pickup"`))
+		})
+	})
+
+	Describe("SendGrid", func() {
+		BeforeEach(func() {
+			status = http.StatusAccepted
+			response = ""
+			fixture.inputs.Source.Transport = "sendgrid"
+			fixture.inputs.Source.SendGrid.APIKey = "some-api-key"
+			fixture.inputs.Source.SendGrid.Endpoint = apiServer.URL
+		})
+
+		It("sends the parts of the message to the mail send API", func() {
+			output, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].URL.Path).To(Equal("/v3/mail/send"))
+			Expect(requests[0].Header.Get("Authorization")).To(Equal("Bearer some-api-key"))
+
+			var message map[string]interface{}
+			Expect(json.Unmarshal(bodies[0], &message)).To(Succeed())
+			Expect(message["from"]).To(Equal(map[string]interface{}{"email": "bot@example.com", "name": "Build Bot"}))
+			Expect(message["subject"]).To(Equal("Build passed"))
+			Expect(message["personalizations"]).To(Equal([]interface{}{map[string]interface{}{
+				"to":  []interface{}{map[string]interface{}{"email": "jane@example.com", "name": "Jane Doe"}},
+				"bcc": []interface{}{map[string]interface{}{"email": "audit@example.com"}},
+			}}))
+			Expect(message["content"]).To(Equal([]interface{}{
+				map[string]interface{}{"type": "text/plain", "value": "the build passed"},
+				map[string]interface{}{"type": "text/html", "value": "<p>the build <b>passed</b></p>"},
+			}))
+			Expect(message["headers"]).To(HaveKeyWithValue("X-Build", "42"))
+			Expect(message["attachments"]).To(Equal([]interface{}{map[string]interface{}{
+				"content":     base64.StdEncoding.EncodeToString([]byte("all green")),
+				"type":        "text/plain",
+				"filename":    "report.txt",
+				"disposition": "attachment",
+			}}))
+
+			var outdata out.Output
+			Expect(json.Unmarshal([]byte(output), &outdata)).To(Succeed())
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "transport", Value: "sendgrid"}))
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "delivered_by", Value: strings.TrimPrefix(apiServer.URL, "http://")}))
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "recipient", Value: "jane@example.com: accepted (202 Accepted)"}))
+			Expect(outdata.Metadata).To(ContainElement(out.MetadataItem{Name: "bcc", Value: "1 accepted, 0 rejected"}))
+		})
+
+		It("fails with the error returned by the API", func() {
+			status = http.StatusUnauthorized
+			response = `{"errors":[{"message":"The provided authorization grant is invalid"}]}`
+
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`sendgrid API returned 401 Unauthorized: {"errors":[{"message":"The provided authorization grant is invalid"}]}`))
+		})
+
+		It("sends the Reply-To header as the reply_to field", func() {
+			fixture.inputs.Params.HeadersMap = map[string]interface{}{"Reply-To": "Ops Team <ops@example.com>"}
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			var message map[string]interface{}
+			Expect(json.Unmarshal(bodies[0], &message)).To(Succeed())
+			Expect(message["reply_to"]).To(Equal(map[string]interface{}{"email": "ops@example.com", "name": "Ops Team"}))
+			Expect(message["headers"]).NotTo(HaveKey("Reply-To"))
+		})
+
+		It("rejects headers given more than once", func() {
+			fixture.inputs.Params.HeadersMap = map[string]interface{}{"X-Tag": []interface{}{"nightly", "stable"}}
+			_, err := fixture.run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("header X-Tag is given more than once, which sendgrid does not support"))
+			Expect(requests).To(BeEmpty())
+		})
+
+		It("requires an API key", func() {
+			fixture.inputs.Source.SendGrid.APIKey = ""
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: missing required field "source.sendgrid.api_key"`))
+			Expect(requests).To(BeEmpty())
+		})
+	})
+
+	Describe("Mailgun", func() {
+		BeforeEach(func() {
+			response = `{"id":"<20240101.1@mg.example.com>","message":"Queued. Thank you."}`
+			fixture.inputs.Source.Transport = "mailgun"
+			fixture.inputs.Source.Mailgun.APIKey = "some-api-key"
+			fixture.inputs.Source.Mailgun.Domain = "mg.example.com"
+			fixture.inputs.Source.Mailgun.Endpoint = apiServer.URL
+		})
+
+		It("sends the composed message to the messages.mime API", func() {
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].URL.Path).To(Equal("/v3/mg.example.com/messages.mime"))
+			username, password, ok := requests[0].BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(username).To(Equal("api"))
+			Expect(password).To(Equal("some-api-key"))
+
+			request, err := http.NewRequest(http.MethodPost, "/", strings.NewReader(string(bodies[0])))
+			Expect(err).NotTo(HaveOccurred())
+			request.Header = requests[0].Header
+			Expect(request.ParseMultipartForm(1 << 20)).To(Succeed())
+			Expect(request.MultipartForm.Value["to"]).To(Equal([]string{"jane@example.com", "audit@example.com"}))
+			file, _, err := request.FormFile("message")
+			Expect(err).NotTo(HaveOccurred())
+			message, err := ioutil.ReadAll(file)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(message)).To(ContainSubstring("Subject: Build passed\r\n"))
+			Expect(string(message)).To(ContainSubstring("X-Build: 42\r\n"))
+			Expect(string(message)).NotTo(ContainSubstring("audit@example.com"))
+		})
+
+		It("requires a domain", func() {
+			fixture.inputs.Source.Mailgun.Domain = ""
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: missing required field "source.mailgun.domain"`))
+		})
+	})
+
+	Describe("SES", func() {
+		BeforeEach(func() {
+			response = `{"MessageId":"some-message-id"}`
+			fixture.inputs.Source.Transport = "ses"
+			fixture.inputs.Source.SES.Region = "eu-west-1"
+			fixture.inputs.Source.SES.AccessKeyID = "AKIDEXAMPLE"
+			fixture.inputs.Source.SES.SecretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+			fixture.inputs.Source.SES.SessionToken = "some-session-token"
+			fixture.inputs.Source.SES.Endpoint = apiServer.URL
+		})
+
+		It("sends the composed message to the v2 API with a valid signature", func() {
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].URL.Path).To(Equal("/v2/email/outbound-emails"))
+			Expect(requests[0].Header.Get("X-Amz-Security-Token")).To(Equal("some-session-token"))
+			Expect(requests[0].Header.Get("Authorization")).To(Equal(expectedSESAuthorization(requests[0], bodies[0], fixture.inputs.Source.SES)))
+
+			var message struct {
+				FromEmailAddress string
+				Destination      struct{ ToAddresses []string }
+				Content          struct{ Raw struct{ Data []byte } }
+			}
+			Expect(json.Unmarshal(bodies[0], &message)).To(Succeed())
+			Expect(message.FromEmailAddress).To(Equal("bot@example.com"))
+			Expect(message.Destination.ToAddresses).To(Equal([]string{"jane@example.com", "audit@example.com"}))
+			Expect(string(message.Content.Raw.Data)).To(ContainSubstring("Subject: Build passed\r\n"))
+		})
+
+		It("requires credentials", func() {
+			fixture.inputs.Source.SES.SecretAccessKey = ""
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`Invalid configuration: missing required field "source.ses.secret_access_key"`))
+		})
+	})
+
+	Describe("Postmark", func() {
+		BeforeEach(func() {
+			response = `{"ErrorCode":0,"Message":"OK","MessageID":"some-message-id"}`
+			fixture.inputs.Source.Transport = "postmark"
+			fixture.inputs.Source.Postmark.ServerToken = "some-server-token"
+			fixture.inputs.Source.Postmark.MessageStream = "outbound"
+			fixture.inputs.Source.Postmark.Endpoint = apiServer.URL
+		})
+
+		It("sends the parts of the message to the email API", func() {
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].URL.Path).To(Equal("/email"))
+			Expect(requests[0].Header.Get("X-Postmark-Server-Token")).To(Equal("some-server-token"))
+
+			var message map[string]interface{}
+			Expect(json.Unmarshal(bodies[0], &message)).To(Succeed())
+			Expect(message).To(HaveKeyWithValue("From", `"Build Bot" <bot@example.com>`))
+			Expect(message).To(HaveKeyWithValue("To", `"Jane Doe" <jane@example.com>`))
+			Expect(message).To(HaveKeyWithValue("Bcc", "audit@example.com"))
+			Expect(message).NotTo(HaveKey("Cc"))
+			Expect(message).To(HaveKeyWithValue("Subject", "Build passed"))
+			Expect(message).To(HaveKeyWithValue("TextBody", "the build passed"))
+			Expect(message).To(HaveKeyWithValue("HtmlBody", "<p>the build <b>passed</b></p>"))
+			Expect(message).To(HaveKeyWithValue("MessageStream", "outbound"))
+			Expect(message["Headers"]).To(ContainElement(map[string]interface{}{"Name": "X-Build", "Value": "42"}))
+			Expect(message["Attachments"]).To(Equal([]interface{}{map[string]interface{}{
+				"Name":        "report.txt",
+				"Content":     base64.StdEncoding.EncodeToString([]byte("all green")),
+				"ContentType": "text/plain",
+			}}))
+		})
+
+		It("fails with the error returned by the API", func() {
+			status = http.StatusUnprocessableEntity
+			response = `{"ErrorCode":300,"Message":"Invalid email request"}`
+
+			_, err := fixture.run()
+			Expect(err).To(MatchError(`postmark API returned 422 Unprocessable Entity: {"ErrorCode":300,"Message":"Invalid email request"}`))
+		})
+
+		It("sends the Reply-To header as the ReplyTo field", func() {
+			fixture.inputs.Params.HeadersMap = map[string]interface{}{"Reply-To": "Ops Team <ops@example.com>"}
+			_, err := fixture.run()
+			Expect(err).NotTo(HaveOccurred())
+
+			var message map[string]interface{}
+			Expect(json.Unmarshal(bodies[0], &message)).To(Succeed())
+			Expect(message).To(HaveKeyWithValue("ReplyTo", `"Ops Team" <ops@example.com>`))
+			Expect(message["Headers"]).NotTo(ContainElement(HaveKeyWithValue("Name", "Reply-To")))
+		})
+	})
+})
+
+// expectedSESAuthorization signs r the way AWS does, to check the signature
+// the transport computed.
+func expectedSESAuthorization(r *http.Request, body []byte, config out.SES) string {
+	amzDate := r.Header.Get("X-Amz-Date")
+	date := amzDate[:8]
+
+	var names []string
+	for name := range r.Header {
+		switch lower := strings.ToLower(name); lower {
+		case "authorization", "user-agent", "content-length", "accept-encoding":
+		default:
+			names = append(names, lower)
+		}
+	}
+	names = append(names, "host")
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + value + "\n"
+	}
+
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		r.Method, (&url.URL{Path: r.URL.Path}).EscapedPath(), r.URL.RawQuery,
+		canonicalHeaders, strings.Join(names, ";"), hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + config.Region + "/ses/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	sign := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	key := sign(sign(sign(sign([]byte("AWS4"+config.SecretAccessKey), date), config.Region), "ses"), "aws4_request")
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		config.AccessKeyID, scope, strings.Join(names, ";"), hex.EncodeToString(sign(key, stringToSign)))
+}
@@ -1,7 +1,11 @@
 package out
 
 import (
+	"net"
+	"strings"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 //Input - Struct that represents the input to out
@@ -11,11 +15,93 @@ type Input struct {
 }
 
 type Source struct {
-	SMTP SMTP `json:"smtp"`
-	From string
-	To   []string
-	Cc   []string
-	Bcc  []string
+	SMTP      SMTP     `json:"smtp"`
+	Transport string   `json:"transport"`
+	SendGrid  SendGrid `json:"sendgrid"`
+	Mailgun   Mailgun  `json:"mailgun"`
+	SES       SES      `json:"ses"`
+	Postmark  Postmark `json:"postmark"`
+	Maildir   Maildir  `json:"maildir"`
+	Mbox      Mbox     `json:"mbox"`
+	Pickup    Pickup   `json:"pickup"`
+	DKIM      DKIM     `json:"dkim"`
+	SMIME     SMIME    `json:"smime"`
+	PGP       PGP      `json:"pgp"`
+	DryRun    bool     `json:"dry_run"`
+	From      string
+	To        []string
+	Cc        []string
+	Bcc       []string
+}
+
+// transport returns the configured transport, SMTP unless set otherwise.
+func (s Source) transport() string {
+	if s.Transport == "" {
+		return TransportSMTP
+	}
+	return strings.ToLower(s.Transport)
+}
+
+// SendGrid - credentials for the SendGrid v3 mail send API
+type SendGrid struct {
+	APIKey   string `json:"api_key"`
+	Endpoint string `json:"endpoint"`
+}
+
+// Mailgun - credentials for the Mailgun messages API. Endpoint is
+// https://api.eu.mailgun.net for domains in the EU region
+type Mailgun struct {
+	APIKey   string `json:"api_key"`
+	Domain   string `json:"domain"`
+	Endpoint string `json:"endpoint"`
+}
+
+// SES - credentials for the Amazon SES v2 API
+type SES struct {
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+	Endpoint        string `json:"endpoint"`
+}
+
+// Postmark - credentials for the Postmark email API
+type Postmark struct {
+	ServerToken   string `json:"server_token"`
+	MessageStream string `json:"message_stream"`
+	Endpoint      string `json:"endpoint"`
+}
+
+type Maildir struct {
+	Path string `json:"path"`
+}
+
+type Mbox struct {
+	Path string `json:"path"`
+}
+
+type Pickup struct {
+	Path string `json:"path"`
+}
+
+type DKIM struct {
+	Selector         string   `json:"selector"`
+	Domain           string   `json:"domain"`
+	PrivateKey       string   `json:"private_key"`
+	Headers          []string `json:"headers"`
+	Canonicalization string   `json:"canonicalization"`
+}
+
+type SMIME struct {
+	Certificate           string   `json:"certificate"`
+	PrivateKey            string   `json:"private_key"`
+	RecipientCertificates []string `json:"recipient_certificates"`
+}
+
+type PGP struct {
+	PrivateKey    string   `json:"private_key"`
+	Passphrase    string   `json:"passphrase"`
+	RecipientKeys []string `json:"recipient_keys"`
 }
 
 type Params struct {
@@ -23,17 +109,40 @@ type Params struct {
 	SubjectText     string `json:"subject_text"`
 	Body            string
 	BodyText        string `json:"body_text"`
+	HTMLBody        string `json:"html_body"`
+	HTMLBodyText    string `json:"html_body_text"`
+	BodyFormat      string `json:"body_format"`
 	SendEmptyBody   bool   `json:"send_empty_body"`
 	Headers         string
-	HeadersText     string   `json:"headers_text"`
-	To              string   `json:"to"`
-	ToText          string   `json:"to_text"`
-	Cc              string   `json:"cc"`
-	CcText          string   `json:"cc_text"`
-	Bcc             string   `json:"bcc"`
-	BccText         string   `json:"bcc_text"`
-	Debug           string   `json:"debug"`
-	AttachmentGlobs []string `json:"attachment_globs"`
+	HeadersText     string                 `json:"headers_text"`
+	HeadersMap      map[string]interface{} `json:"headers_map"`
+	To              string                 `json:"to"`
+	ToText          string                 `json:"to_text"`
+	Cc              string                 `json:"cc"`
+	CcText          string                 `json:"cc_text"`
+	Bcc             string                 `json:"bcc"`
+	BccText         string                 `json:"bcc_text"`
+	Debug           string                 `json:"debug"`
+	AttachmentGlobs []string               `json:"attachment_globs"`
+	InlineImages    []string               `json:"inline_images"`
+	Template        bool                   `json:"template"`
+	Vars            map[string]interface{} `json:"vars"`
+	ReportFile      string                 `json:"report_file"`
+	PGPKeyring      string                 `json:"pgp_keyring"`
+	DryRun          bool                   `json:"dry_run"`
+	DryRunFile      string                 `json:"dry_run_file"`
+
+	FailOnRejectedRecipient string `json:"fail_on_rejected_recipient"`
+	IncludeMessageInVersion bool   `json:"include_message_in_version"`
+}
+
+// failOnRejectedRecipient defaults to failing only when every recipient was
+// rejected, as no message is sent then.
+func (p Params) failOnRejectedRecipient() string {
+	if p.FailOnRejectedRecipient == "" {
+		return FailOnRejectedAll
+	}
+	return p.FailOnRejectedRecipient
 }
 
 type SMTP struct {
@@ -41,11 +150,155 @@ type SMTP struct {
 	Port              string
 	Username          string
 	Password          string
-	Anonymous         bool   `json:"anonymous"`
-	SkipSSLValidation bool   `json:"skip_ssl_validation"`
-	CaCert            string `json:"ca_cert"`
-	HostOrigin        string `json:"host_origin"`
-	LoginAuth         bool   `json:"login_auth"`
+	Anonymous         bool     `json:"anonymous"`
+	SkipSSLValidation bool     `json:"skip_ssl_validation"`
+	CaCert            string   `json:"ca_cert"`
+	ClientCert        string   `json:"client_cert"`
+	ClientKey         string   `json:"client_key"`
+	HostOrigin        string   `json:"host_origin"`
+	LoginAuth         bool     `json:"login_auth"`
+	AuthMechanism     string   `json:"auth_mechanism"`
+	AccessToken       string   `json:"access_token"`
+	OAuth2            OAuth2   `json:"oauth2"`
+	TLSMode           string   `json:"tls_mode"`
+	RequireTLS        *bool    `json:"require_tls,omitempty"`
+	FallbackHosts     []string `json:"fallback_hosts"`
+	Retry             Retry    `json:"retry"`
+	DialTimeout       string   `json:"dial_timeout"`
+	CommandTimeout    string   `json:"command_timeout"`
+	SessionTimeout    string   `json:"session_timeout"`
+}
+
+// Retry - how sending is retried when the SMTP server is unavailable or
+// replies with an error. Durations are Go durations such as "500ms" or "2s"
+type Retry struct {
+	Attempts       int      `json:"attempts"`
+	InitialBackoff string   `json:"initial_backoff"`
+	MaxBackoff     string   `json:"max_backoff"`
+	Jitter         *float64 `json:"jitter,omitempty"`
+	RetryOn        []string `json:"retry_on"`
+}
+
+// OAuth2 - token endpoint used to obtain an access token for the XOAUTH2 and
+// OAUTHBEARER mechanisms
+type OAuth2 struct {
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RefreshToken string   `json:"refresh_token"`
+	Scopes       []string `json:"scopes"`
+}
+
+// authMechanism returns the configured SASL mechanism, honouring the older
+// login_auth flag when auth_mechanism is not set.
+func (s SMTP) authMechanism() string {
+	if s.AuthMechanism != "" {
+		return strings.ToLower(s.AuthMechanism)
+	}
+	if s.LoginAuth {
+		return AuthMechanismLogin
+	}
+	return AuthMechanismAuto
+}
+
+// usesOAuth2 reports whether the session authenticates with an OAuth2 access
+// token instead of a password.
+func (s SMTP) usesOAuth2() bool {
+	switch s.authMechanism() {
+	case AuthMechanismXOAuth2, AuthMechanismOAuthBearer:
+		return true
+	case AuthMechanismAuto:
+		return s.AccessToken != "" || s.OAuth2.TokenURL != ""
+	}
+	return false
+}
+
+// requiresTLS reports whether the session must be encrypted. Unless
+// require_tls is set explicitly, authenticated sessions require TLS so that
+// credentials are never sent in cleartext.
+func (s SMTP) requiresTLS() bool {
+	if s.RequireTLS != nil {
+		return *s.RequireTLS
+	}
+	return !s.Anonymous
+}
+
+// fallbackHosts returns the fallback hosts as host:port, using the port of
+// the primary host for those given without one.
+func (s SMTP) fallbackHosts() []string {
+	hosts := make([]string, 0, len(s.FallbackHosts))
+	for _, host := range s.FallbackHosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, s.Port)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// policy returns the retry policy, with unset fields taken from
+// DefaultRetryPolicy.
+func (r Retry) policy() (RetryPolicy, error) {
+	policy := DefaultRetryPolicy
+	if r.Attempts < 0 {
+		return policy, errors.Errorf(`invalid value %d for field "source.smtp.retry.attempts". Must be at least 1`, r.Attempts)
+	}
+	if r.Attempts > 0 {
+		policy.Attempts = r.Attempts
+	}
+	if err := parseDuration("source.smtp.retry.initial_backoff", r.InitialBackoff, &policy.InitialBackoff); err != nil {
+		return policy, err
+	}
+	if err := parseDuration("source.smtp.retry.max_backoff", r.MaxBackoff, &policy.MaxBackoff); err != nil {
+		return policy, err
+	}
+	if r.Jitter != nil {
+		if *r.Jitter < 0 || *r.Jitter > 1 {
+			return policy, errors.Errorf(`invalid value %v for field "source.smtp.retry.jitter". Must be between 0 and 1`, *r.Jitter)
+		}
+		policy.Jitter = *r.Jitter
+	}
+	if r.RetryOn != nil {
+		for _, class := range r.RetryOn {
+			switch class {
+			case RetryOnConnection, RetryOn4xx, RetryOn5xx:
+			default:
+				return policy, errors.Errorf(`invalid value %q for field "source.smtp.retry.retry_on". Must be one of "connection", "4xx" or "5xx"`, class)
+			}
+		}
+		policy.RetryOn = r.RetryOn
+	}
+	return policy, nil
+}
+
+// timeouts returns the configured timeouts, with unset ones taken from
+// DefaultTimeouts.
+func (s SMTP) timeouts() (Timeouts, error) {
+	timeouts := DefaultTimeouts
+	if err := parseDuration("source.smtp.dial_timeout", s.DialTimeout, &timeouts.Dial); err != nil {
+		return timeouts, err
+	}
+	if err := parseDuration("source.smtp.command_timeout", s.CommandTimeout, &timeouts.Command); err != nil {
+		return timeouts, err
+	}
+	if err := parseDuration("source.smtp.session_timeout", s.SessionTimeout, &timeouts.Session); err != nil {
+		return timeouts, err
+	}
+	return timeouts, nil
+}
+
+// parseDuration parses value into duration, leaving duration unchanged if
+// value is empty.
+func parseDuration(field, value string, duration *time.Duration) error {
+	if value == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		return errors.Errorf(`invalid value %q for field "%s". Must be a duration such as "2s"`, value, field)
+	}
+	*duration = parsed
+	return nil
 }
 
 //MetadataItem - metadata within output
@@ -57,7 +310,10 @@ type MetadataItem struct {
 //Output - represents output from out
 type Output struct {
 	Version struct {
-		Time time.Time
+		Time      time.Time
+		MessageID string `json:"message_id,omitempty"`
+		Message   string `json:"message,omitempty"`
+		DryRun    string `json:"dry_run,omitempty"`
 	} `json:"version"`
 	Metadata []MetadataItem
 }